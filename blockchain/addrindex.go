@@ -0,0 +1,253 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	addrIndexPrefix  = []byte("addr-")     // Prefix for the history entries of every address
+	addrIndexFlagKey = []byte("addrindex") // Key present when the address index is enabled
+)
+
+// AddressEvent records an output paid to an address or spent from it on the best chain.
+type AddressEvent struct {
+	PubKeyHash []byte // Public key hash of the address
+	TxID       []byte // ID of the transaction paying or spending
+	BlockHash  []byte // Hash of the block containing the transaction
+	Height     int    // Height of that block
+	Index      int    // Index of the output received, or of the input spending
+	Spent      bool   // True for a spend, false for a received output
+	Amount     int    // Value of the output
+}
+
+// Serialize serializes the address event in the binary encoding.
+func (event AddressEvent) Serialize() []byte {
+	w := newRecordWriter(addrEventRecord)
+	w.writeVarBytes(event.PubKeyHash)
+	w.writeVarBytes(event.TxID)
+	w.writeVarBytes(event.BlockHash)
+	w.writeVarInt(uint64(event.Height))
+	w.writeVarInt(uint64(event.Index))
+	if event.Spent {
+		w.writeByte(1)
+	} else {
+		w.writeByte(0)
+	}
+	w.writeInt64(int64(event.Amount))
+
+	return w.Bytes()
+}
+
+// DeserializeAddressEvent deserializes a byte slice into an address event. Events written in gob
+// by earlier versions are still read.
+func DeserializeAddressEvent(data []byte) (AddressEvent, error) {
+	var event AddressEvent
+
+	if !isBinaryEncoding(data) {
+		decode := gob.NewDecoder(bytes.NewReader(data))
+		err := decode.Decode(&event)
+		return event, err
+	}
+
+	r := newRecordReader(data, addrEventRecord)
+	event.PubKeyHash = r.readVarBytes()
+	event.TxID = r.readVarBytes()
+	event.BlockHash = r.readVarBytes()
+	event.Height = int(r.readVarInt())
+	event.Index = int(r.readVarInt())
+	event.Spent = r.readByte() == 1
+	event.Amount = int(r.readInt64())
+	if err := r.finish(); err != nil {
+		return AddressEvent{}, err
+	}
+
+	return event, nil
+}
+
+// addrIndexAddressPrefix builds the key prefix shared by every history entry of an address.
+func addrIndexAddressPrefix(pubKeyHash []byte) []byte {
+	prefix := append(append([]byte{}, addrIndexPrefix...), byte(len(pubKeyHash)))
+
+	return append(prefix, pubKeyHash...)
+}
+
+// key builds the database key of the event. Keys of an address sort by height, so its
+// history is read in chain order.
+func (event AddressEvent) key() []byte {
+	key := addrIndexAddressPrefix(event.PubKeyHash)
+
+	var height [8]byte
+	binary.BigEndian.PutUint64(height[:], uint64(event.Height))
+	key = append(key, height[:]...)
+	key = append(key, event.TxID...)
+
+	direction := byte(0)
+	if event.Spent {
+		direction = 1
+	}
+	key = append(key, direction)
+
+	var index [4]byte
+	binary.BigEndian.PutUint32(index[:], uint32(event.Index))
+
+	return append(key, index[:]...)
+}
+
+// addrIndexEnabled reports whether the address index is maintained for this database.
+func addrIndexEnabled(txn *badger.Txn) bool {
+	_, err := txn.Get(addrIndexFlagKey)
+
+	return err == nil
+}
+
+// addressEvents lists the outputs received and spent by a block, leaving out outputs whose locking
+// script pays to no address. The spent outputs are taken from the undo record, so the block must
+// have been connected.
+func addressEvents(txn *badger.Txn, block *Block) ([]AddressEvent, error) {
+	var events []AddressEvent
+
+	undo, err := readUndo(txn, block)
+	if err != nil {
+		return nil, err
+	}
+	next := 0 // Undo entries follow the order of the inputs in the block
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for inIdx := range tx.Inputs {
+				if next >= len(undo.Spent) {
+					return nil, errors.New("Undo record of the block is incomplete")
+				}
+				out := undo.Spent[next].Output
+				next++
+				if pubKeyHash := out.PubKeyHash(); pubKeyHash != nil {
+					events = append(events, AddressEvent{pubKeyHash, tx.ID, block.Hash, block.Height, inIdx, true, out.Value})
+				}
+			}
+		}
+		for outIdx, out := range tx.Outputs {
+			if pubKeyHash := out.PubKeyHash(); pubKeyHash != nil {
+				events = append(events, AddressEvent{pubKeyHash, tx.ID, block.Hash, block.Height, outIdx, false, out.Value})
+			}
+		}
+	}
+
+	return events, nil
+}
+
+// indexAddresses records the history entries of a block connected to the best chain.
+func indexAddresses(txn *badger.Txn, block *Block) error {
+	events, err := addressEvents(txn, block)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := txn.Set(event.key(), event.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexAddresses removes the history entries of a block disconnected from the best chain.
+func unindexAddresses(txn *badger.Txn, block *Block) error {
+	events, err := addressEvents(txn, block)
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := txn.Delete(event.key()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddrIndexEnabled reports whether the address index is maintained for this blockchain.
+func (chain *BlockChain) AddrIndexEnabled() bool {
+	enabled := false
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		enabled = addrIndexEnabled(txn)
+		return nil
+	})
+	Handle(err)
+
+	return enabled
+}
+
+// ReindexAddresses enables the address index and rebuilds it from the best chain.
+// It returns the number of indexed history entries.
+func (chain *BlockChain) ReindexAddresses() int {
+	count := 0
+
+	Handle(chain.requireAllBlocks())
+
+	// Removing stale entries before rebuilding
+	UTXOSet := UTXOSet{Blockchain: chain}
+	UTXOSet.DeleteByPrefix(addrIndexPrefix)
+
+	iter := chain.ForwardIterator()
+	for block := iter.Next(); block != nil; block = iter.Next() {
+		err := chain.Database.Update(func(txn *badger.Txn) error {
+			events, err := addressEvents(txn, block)
+			if err != nil {
+				return err
+			}
+			for _, event := range events {
+				if err := txn.Set(event.key(), event.Serialize()); err != nil {
+					return err
+				}
+			}
+			count += len(events)
+			return nil
+		})
+		Handle(err)
+	}
+
+	// Turning the index on only once it is complete
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(addrIndexFlagKey, []byte{1})
+	})
+	Handle(err)
+
+	return count
+}
+
+// AddressHistory returns every output received and spent by a public key hash on the
+// best chain, in chain order. It requires the address index.
+func (chain *BlockChain) AddressHistory(pubKeyHash []byte) ([]AddressEvent, error) {
+	var history []AddressEvent
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		if !addrIndexEnabled(txn) {
+			return errors.New("Address index is not enabled")
+		}
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := addrIndexAddressPrefix(pubKeyHash)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			v, err := it.Item().Value()
+			if err != nil {
+				return err
+			}
+			event, err := DeserializeAddressEvent(v)
+			if err != nil {
+				return err
+			}
+			history = append(history, event)
+		}
+		return nil
+	})
+
+	return history, err
+}
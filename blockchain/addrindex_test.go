@@ -0,0 +1,65 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+)
+
+// historyOf returns the address history of a wallet.
+func historyOf(t *testing.T, chain *BlockChain, w *wallet.Wallet) []AddressEvent {
+	history, err := chain.AddressHistory(wallet.PublicKeyHash(w.PublicKey))
+	assert.NoError(t, err)
+
+	return history
+}
+
+func TestAddressHistory(t *testing.T) {
+	chain, w := newTestChain(t)
+	other := wallet.MakeWallet()
+	UTXOSet := UTXOSet{chain}
+	genesis := tip(t, chain)
+
+	_, err := chain.AddressHistory(wallet.PublicKeyHash(w.PublicKey))
+	assert.EqualError(t, err, "Address index is not enabled")
+	assert.False(t, chain.AddrIndexEnabled())
+	assert.Equal(t, 1, chain.ReindexAddresses(), "Genesis coinbase is indexed")
+	assert.True(t, chain.AddrIndexEnabled())
+
+	// The payment spends the genesis coinbase, leaving change to the payer
+	pay := NewTransaction(w, string(other.Address()), 5, 1, 0, &UTXOSet)
+	block := newTestBlock(genesis, CoinbaseTx(string(other.Address()), "", BlockSubsidy(1)+1), pay)
+	_, err = chain.AddBlock(block)
+	assert.NoError(t, err)
+	last := extendChain(t, chain, block, 1, string(w.Address()))
+
+	payer := genesis.Transactions[0].Outputs[0].Value
+	assert.Equal(t, []AddressEvent{
+		{wallet.PublicKeyHash(w.PublicKey), genesis.Transactions[0].ID, genesis.Hash, 0, 0, false, payer},
+		{wallet.PublicKeyHash(w.PublicKey), pay.ID, block.Hash, 1, 1, false, payer - 6},
+		{wallet.PublicKeyHash(w.PublicKey), pay.ID, block.Hash, 1, 0, true, payer},
+		{wallet.PublicKeyHash(w.PublicKey), last.Transactions[0].ID, last.Hash, 2, 0, false, BlockSubsidy(2)},
+	}, historyOf(t, chain, w), "Received and spent outputs in height order")
+	assert.Len(t, historyOf(t, chain, other), 2)
+
+	// A heavier branch without the payment removes the entries of the disconnected blocks
+	branch := extendChain(t, chain, genesis, 3, string(wallet.MakeWallet().Address()))
+	assert.Equal(t, branch.Hash, chain.LastHash)
+	assert.Equal(t, []AddressEvent{
+		{wallet.PublicKeyHash(w.PublicKey), genesis.Transactions[0].ID, genesis.Hash, 0, 0, false, payer},
+	}, historyOf(t, chain, w))
+	assert.Empty(t, historyOf(t, chain, other))
+
+	// Rebuilding drops entries left behind
+	stale := AddressEvent{wallet.PublicKeyHash(other.PublicKey), pay.ID, block.Hash, 1, 0, false, 5}
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(stale.key(), stale.Serialize())
+	})
+	assert.NoError(t, err)
+	assert.Len(t, historyOf(t, chain, other), 1)
+	assert.Equal(t, 4, chain.ReindexAddresses())
+	assert.Empty(t, historyOf(t, chain, other))
+	assert.Len(t, historyOf(t, chain, w), 1)
+}
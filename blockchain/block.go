@@ -9,31 +9,42 @@ import (
 
 // Block represents a single block in the blockchain.
 type Block struct {
-	Timestamp    int64          // Timestamp of block creation
-	Hash         []byte         // Hash of the block
+	BlockHeader                 // Header fields covered by the proof of work
+	Hash         []byte         // Hash of the block header
 	Transactions []*Transaction // Transactions included in the block
-	PrevHash     []byte         // Hash of the previous block in the chain
-	Nonce        int            // Nonce used for mining (Proof of Work)
 	Height       int            // Height of the block in the blockchain
 }
 
-// HashTransactions creates a hash of all the transactions in the block using a Merkle Tree.
+// HashTransactions creates a hash of all the transactions in the block using a Merkle Tree. From
+// block version 3 on the hardened tree is used, which has no root for a block listing a
+// transaction twice.
 func (b *Block) HashTransactions() []byte {
 	var txHashes [][]byte
 
 	for _, tx := range b.Transactions {
 		txHashes = append(txHashes, tx.Serialize()) // Serializing each transaction
 	}
+
+	if b.Version >= hardenedMerkleVersion {
+		tree, err := NewHardenedMerkleTree(txHashes)
+		if err != nil {
+			return nil
+		}
+		return tree.RootNode.Data
+	}
 	tree := NewMerkleTree(txHashes) // Creating a new Merkle Tree from the transaction hashes
 
 	return tree.RootNode.Data // Returning the root hash of the Merkle Tree
 }
 
-// CreateBlock creates a new block with the given transactions and previous hash.
-func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
-	block := &Block{time.Now().Unix(), []byte{}, txs, prevHash, 0, height}
-	pow := NewProof(block)   // Creating a new proof of work for the block
-	nonce, hash := pow.Run() // Running the proof of work algorithm to mine the block
+// CreateBlock creates a new block with the given transactions, previous hash and target.
+func CreateBlock(txs []*Transaction, prevHash []byte, height int, bits uint32) *Block {
+	header := BlockHeader{blockVersion, prevHash, nil, time.Now().Unix(), bits, 0}
+	block := &Block{header, []byte{}, txs, height}
+	block.MerkleRoot = block.HashTransactions() // Committing to the transactions in the header
+
+	pow := NewProof(&block.BlockHeader) // Creating a new proof of work for the block header
+	nonce, hash := pow.Run()            // Running the proof of work algorithm to mine the block
 
 	block.Hash = hash[:] // Setting the hash of the block
 	block.Nonce = nonce  // Setting the nonce of the block
@@ -43,30 +54,73 @@ func CreateBlock(txs []*Transaction, prevHash []byte, height int) *Block {
 
 // Genesis creates the first block in the blockchain with a coinbase transaction.
 func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0) // Creating the genesis block
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, powLimitBits) // Creating the genesis block
 }
 
-// Serialize encodes the block into a byte slice.
+// Serialize encodes the block into its binary encoding.
 func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res) // Creating a new encoder
+	w := newRecordWriter(blockRecord)
+	w.buf.Write(b.BlockHeader.Serialize()) // The header as it is hashed
+	w.writeVarInt(uint64(b.Height))
 
-	err := encoder.Encode(b) // Encoding the block
-	Handle(err)              // Handling any encoding errors
+	w.writeVarInt(uint64(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		txw := &binaryWriter{}
+		tx.encode(txw)
+		w.writeVarBytes(txw.Bytes()) // Letting readers skip transactions they do not need
+	}
 
-	return res.Bytes() // Returning the encoded byte slice
+	return w.Bytes()
 }
 
-// Deserialize decodes a byte slice into a Block.
+// Deserialize decodes a byte slice into a Block. Blocks written in gob by earlier versions are
+// still read.
 func Deserialize(data []byte) *Block {
+	if !isBinaryEncoding(data) {
+		var block Block
+		decoder := gob.NewDecoder(bytes.NewReader(data)) // Creating a new decoder
+
+		err := decoder.Decode(&block) // Decoding the data into a block
+		Handle(err)                   // Handling any decoding errors
+
+		return &block // Returning the decoded block
+	}
+
+	block, err := DeserializeBlock(data)
+	Handle(err)
+
+	return block
+}
+
+// DeserializeBlock decodes a block from its binary encoding, failing on malformed data instead of
+// panicking, for blocks that come from outside the database.
+func DeserializeBlock(data []byte) (*Block, error) {
 	var block Block
 
-	decoder := gob.NewDecoder(bytes.NewReader(data)) // Creating a new decoder
+	r := newRecordReader(data, blockRecord)
+	headerData := r.readBytes(HeaderLength)
+	block.Height = int(r.readVarInt())
+
+	for i, n := 0, r.readCount(); i < n; i++ {
+		txr := &binaryReader{data: r.readVarBytes()}
+		tx := decodeTransaction(txr)
+		if err := txr.finish(); err != nil && r.err == nil {
+			r.err = err
+		}
+		block.Transactions = append(block.Transactions, tx)
+	}
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
 
-	err := decoder.Decode(&block) // Decoding the data into a block
-	Handle(err)                   // Handling any decoding errors
+	header, err := DeserializeHeader(headerData)
+	if err != nil {
+		return nil, err
+	}
+	block.BlockHeader = *header
+	block.Hash = header.Hash() // The hash is not stored
 
-	return &block // Returning the decoded block
+	return &block, nil
 }
 
 // Handle is a utility function for error handling.
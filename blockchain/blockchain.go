@@ -9,6 +9,7 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"math/big"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -60,14 +61,29 @@ func ContinueBlockChain(nodeId string) *BlockChain {
 	err = db.Update(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
 		Handle(err)
-		lastHash, err = item.Value()
+		lastHash, err = item.ValueCopy(nil)
+		Handle(err)
 
-		return err
+		if err := requireMigrated(txn, lastHash); err != nil {
+			return err
+		}
+
+		// Indexing the heights of databases created before the height index existed
+		return indexHeights(txn, lastHash)
 	})
+	if err == ErrNeedsMigration {
+		db.Close()
+		fmt.Println(err)
+		runtime.Goexit() // Exiting until the database is migrated
+	}
 	Handle(err)
 
 	chain := BlockChain{lastHash, db}
 
+	// Building the compact filters of databases created before they existed
+	_, err = chain.indexFilters()
+	Handle(err)
+
 	return &chain // Returning the existing blockchain
 }
 
@@ -91,16 +107,12 @@ func InitBlockChain(address, nodeId string) *BlockChain {
 
 	// Creating and storing the genesis block in the database
 	err = db.Update(func(txn *badger.Txn) error {
-		cbtx := CoinbaseTx(address, genesisData)
+		cbtx := CoinbaseTx(address, genesisData, BlockSubsidy(0))
 		genesis := Genesis(cbtx)
 		fmt.Println("Genesis created")
-		err = txn.Set(genesis.Hash, genesis.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), genesis.Hash)
-
 		lastHash = genesis.Hash
 
-		return err
+		return storeGenesis(txn, genesis)
 	})
 
 	Handle(err)
@@ -109,38 +121,143 @@ func InitBlockChain(address, nodeId string) *BlockChain {
 	return &blockchain // Returning the new blockchain
 }
 
-// AddBlock adds a new block to the blockchain.
-func (chain *BlockChain) AddBlock(block *Block) {
+// storeGenesis stores the genesis block of a new database as the tip of the best chain.
+func storeGenesis(txn *badger.Txn, genesis *Block) error {
+	if err := txn.Set(genesis.Hash, genesis.Serialize()); err != nil {
+		return err
+	}
+	if err := indexGenesis(txn, genesis); err != nil {
+		return err
+	}
+	if err := storeBlockFilter(txn, genesis); err != nil {
+		return err
+	}
+	if err := txn.Set(heightKey(0), genesis.Hash); err != nil {
+		return err
+	}
+
+	return txn.Set([]byte("lh"), genesis.Hash)
+}
+
+// AddBlock validates and stores a block and switches to the chain with the most cumulative work,
+// disconnecting and connecting blocks so the UTXO set follows the best chain. Blocks breaking a
+// consensus rule are rejected with a *BlockError and remembered as invalid.
+func (chain *BlockChain) AddBlock(block *Block) (TipChange, error) {
+	var change TipChange
+
 	err := chain.Database.Update(func(txn *badger.Txn) error {
 		// Checking if the block already exists in the database
 		if _, err := txn.Get(block.Hash); err == nil {
 			return nil // Block already exists, no need to add
 		}
+		// Rejecting invalid blocks and their descendants without validating them again
+		if _, err := txn.Get(invalidKey(block.Hash)); err == nil {
+			return &BlockError{block.Hash, ErrInvalidAncestor}
+		}
+		if hasInvalidAncestor(txn, block.PrevHash) {
+			return &BlockError{block.Hash, ErrInvalidAncestor}
+		}
+
+		// A second genesis block can never become part of our chain
+		if len(block.PrevHash) == 0 {
+			return nil
+		}
+
+		// Checking the rules that need no other block
+		if err := checkBlockSanity(block); err != nil {
+			return &BlockError{block.Hash, err}
+		}
+
+		// Indexing the header if its parent is known
+		if _, err := readHeader(txn, block.PrevHash); err == nil {
+			if err := indexBlockHeader(txn, block); err != nil {
+				return &BlockError{block.Hash, err}
+			}
+		}
 
 		blockData := block.Serialize()
 		err := txn.Set(block.Hash, blockData) // Storing the serialized block in the database
 		Handle(err)
 
-		// Updating the last hash in the database if this block is the latest
+		// Keeping the block aside until the body of its parent arrives
+		if !hasFullChain(txn, block.PrevHash) {
+			return addOrphan(txn, block)
+		}
+
+		// Finding the heaviest block among the new block and the orphans it completes
+		best, bestWork := block, new(big.Int)
+		queue := []*Block{block}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+
+			// Dropping orphans that break the rules depending on their ancestors, and their descendants
+			if err := indexBlockHeader(txn, current); err != nil {
+				if err := dropOrphans(txn, current); err != nil {
+					return err
+				}
+				continue
+			}
+
+			work, _ := chainWork(txn, current.Hash)
+			if work.Cmp(bestWork) > 0 {
+				best, bestWork = current, work
+			}
+
+			children, err := takeOrphans(txn, current.Hash)
+			if err != nil {
+				return err
+			}
+			queue = append(queue, children...)
+		}
+
+		// Switching the best chain only if the new branch has more work
 		item, err := txn.Get([]byte("lh"))
 		Handle(err)
-		lastHash, _ := item.Value()
-
-		item, err = txn.Get(lastHash)
+		lastHash, err := item.Value()
 		Handle(err)
-		lastBlockData, _ := item.Value()
-
-		lastBlock := Deserialize(lastBlockData)
 
-		if block.Height > lastBlock.Height {
-			err = txn.Set([]byte("lh"), block.Hash)
-			Handle(err)
-			chain.LastHash = block.Hash // Updating the last hash in the blockchain
+		tipWork, ok := chainWork(txn, lastHash)
+		if !ok {
+			return errors.New("Work of the best chain is unknown")
+		}
+		if bestWork.Cmp(tipWork) <= 0 {
+			return nil
 		}
 
-		return nil
+		change, err = chain.reorganize(txn, lastHash, best)
+
+		return err
 	})
-	Handle(err)
+	if err != nil {
+		change = TipChange{}
+	} else if len(change.Connected) > 0 {
+		chain.LastHash = change.Connected[len(change.Connected)-1].Hash // Only once the switch is stored
+	}
+
+	// Remembering blocks that broke a rule so they and their descendants are never retried
+	var blockErr *BlockError
+	if errors.As(err, &blockErr) && !isMutated(err) {
+		markErr := chain.Database.Update(func(txn *badger.Txn) error {
+			return txn.Set(invalidKey(blockErr.Hash), []byte{})
+		})
+		Handle(markErr)
+	}
+
+	return change, err
+}
+
+// indexBlockHeader adds the header of a block to the block index and checks the block height.
+func indexBlockHeader(txn *badger.Txn, block *Block) error {
+	entry, err := addHeader(txn, &block.BlockHeader)
+	if err != nil {
+		return err
+	}
+	if block.Height != entry.Height {
+		return fmt.Errorf("%w: got %d, want %d", ErrBadHeight, block.Height, entry.Height)
+	}
+
+	return nil
 }
 
 // GetBestHeight returns the height of the latest block in the blockchain.
@@ -197,6 +314,9 @@ func (chain *BlockChain) GetBlockHashes() [][]byte {
 	// Iterating through all blocks in the blockchain
 	for {
 		block := iter.Next()
+		if block == nil {
+			break // The older blocks are pruned
+		}
 
 		blocks = append(blocks, block.Hash) // Adding the hash of each block to the slice
 
@@ -213,6 +333,7 @@ func (chain *BlockChain) GetBlockHashes() [][]byte {
 func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
 	var lastHash []byte
 	var lastHeight int
+	var bits uint32
 
 	// Verifying each transaction before adding it to the block
 	for _, tx := range transactions {
@@ -235,22 +356,18 @@ func (chain *BlockChain) MineBlock(transactions []*Transaction) *Block {
 
 		lastHeight = lastBlock.Height
 
+		// Calculating the target the new block has to meet
+		lastEntry, err := readHeader(txn, lastHash)
+		Handle(err)
+		bits, err = calcNextBits(txn, lastEntry)
+
 		return err
 	})
 	Handle(err)
 
 	// Creating and adding the new block to the chain
-	newBlock := CreateBlock(transactions, lastHash, lastHeight+1)
-
-	err = chain.Database.Update(func(txn *badger.Txn) error {
-		err := txn.Set(newBlock.Hash, newBlock.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), newBlock.Hash)
-
-		chain.LastHash = newBlock.Hash
-
-		return err
-	})
+	newBlock := CreateBlock(transactions, lastHash, lastHeight+1, bits)
+	_, err = chain.AddBlock(newBlock)
 	Handle(err)
 
 	return newBlock
@@ -266,6 +383,9 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 	// Iterating through all blocks in the blockchain
 	for {
 		block := iter.Next()
+		if block == nil {
+			break // The older blocks are pruned
+		}
 
 		// Iterating through each transaction in the block
 		for _, tx := range block.Transactions {
@@ -273,6 +393,9 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 
 		Outputs:
 			for outIdx, out := range tx.Outputs {
+				if IsUnspendable(out.LockingScript) {
+					continue // Null-data outputs can never be spent
+				}
 				// Checking if the output was spent
 				if spentTXOs[txID] != nil {
 					for _, spentOut := range spentTXOs[txID] {
@@ -283,6 +406,9 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 				}
 				outs := UTXO[txID]
 				outs.Outputs = append(outs.Outputs, out)
+				outs.Indexes = append(outs.Indexes, outIdx)
+				outs.Height = block.Height
+				outs.Coinbase = tx.IsCoinbase()
 				UTXO[txID] = outs
 			}
 			// Marking inputs as spent
@@ -302,13 +428,26 @@ func (chain *BlockChain) FindUTXO() map[string]TxOutputs {
 	return UTXO
 }
 
-// FindTransaction finds a transaction by its ID.
+// FindTransaction finds a transaction by its ID, through the transaction index when it is enabled.
 func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
+	if bc.TxIndexEnabled() {
+		var tx Transaction
+		err := bc.Database.View(func(txn *badger.Txn) error {
+			var err error
+			tx, err = findIndexedTransaction(txn, ID)
+			return err
+		})
+		return tx, err
+	}
+
 	iter := bc.Iterator() // Getting an iterator to go through the blocks
 
 	// Iterating through all blocks in the blockchain
 	for {
 		block := iter.Next()
+		if block == nil {
+			break // The older blocks are pruned
+		}
 
 		// Searching for the transaction in each block
 		for _, tx := range block.Transactions {
@@ -326,18 +465,126 @@ func (bc *BlockChain) FindTransaction(ID []byte) (Transaction, error) {
 	return Transaction{}, errors.New("Transaction does not exist")
 }
 
+// FindSpendingTransaction searches the best chain, from the tip down to the block holding the
+// output, for the transaction spending an output.
+func (bc *BlockChain) FindSpendingTransaction(txID []byte, index int) (Transaction, error) {
+	utxo := UTXOSet{bc}
+	if _, err := utxo.FindOutput(txID, index); err == nil {
+		return Transaction{}, errors.New("Output is not spent")
+	}
+
+	iter := bc.Iterator()
+	for {
+		block := iter.Next()
+		if block == nil {
+			break // The older blocks are pruned
+		}
+
+		// Searching for the spender in the current block
+		created := false
+		for _, tx := range block.Transactions {
+			for _, in := range tx.Inputs {
+				if bytes.Equal(in.ID, txID) && in.Out == index {
+					return *tx, nil
+				}
+			}
+			created = created || bytes.Equal(tx.ID, txID)
+		}
+
+		// Break if the block holding the output or the genesis block is reached
+		if created || len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return Transaction{}, errors.New("Output is not spent in the best chain")
+}
+
+// findTransactionFrom searches for a transaction in the given block and its ancestors and
+// returns it with the height of the block containing it.
+func findTransactionFrom(txn *badger.Txn, block *Block, ID []byte) (Transaction, int, error) {
+	for {
+		// Searching for the transaction in the current block
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, ID) {
+				return *tx, block.Height, nil
+			}
+		}
+
+		// Break if the genesis block is reached
+		if len(block.PrevHash) == 0 {
+			break
+		}
+
+		item, err := txn.Get(block.PrevHash)
+		if err != nil {
+			break
+		}
+		blockData, err := item.Value()
+		if err != nil {
+			return Transaction{}, 0, err
+		}
+		block = Deserialize(blockData)
+	}
+
+	return Transaction{}, 0, errors.New("Transaction does not exist")
+}
+
+// findSpentTransaction returns a transaction whose outputs are spent by an input. Transactions of
+// pruned blocks are rebuilt with their unspent outputs from the UTXO set, which is all signing and
+// verifying need.
+func (bc *BlockChain) findSpentTransaction(ID []byte) (Transaction, error) {
+	tx, err := bc.FindTransaction(ID)
+	if err == nil || bc.PruneHeight() == 0 {
+		return tx, err
+	}
+
+	var outs TxOutputs
+	dbErr := bc.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(append([]byte{}, utxoPrefix...), ID...))
+		if err != nil {
+			return err
+		}
+		value, err := item.Value()
+		if err != nil {
+			return err
+		}
+		outs = DeserializeOutputs(value)
+		return nil
+	})
+	if dbErr != nil {
+		return Transaction{}, err
+	}
+
+	tx = Transaction{ID: ID}
+	for i, index := range outs.Indexes {
+		for len(tx.Outputs) <= index {
+			tx.Outputs = append(tx.Outputs, TxOutput{0, []byte{OP_RETURN}}) // Spent outputs fail any script
+		}
+		tx.Outputs[index] = outs.Outputs[i]
+	}
+
+	return tx, nil
+}
+
 // SignTransaction signs a transaction using a given private key.
 func (bc *BlockChain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+	bc.SignTransactionWithHashType(tx, privKey, SigHashAll)
+}
+
+// SignTransactionWithHashType signs a transaction using a given private key, committing to the
+// parts of the transaction selected by the hash type.
+func (bc *BlockChain) SignTransactionWithHashType(tx *Transaction, privKey ecdsa.PrivateKey, hashType SigHashType) {
 	prevTXs := make(map[string]Transaction)
 
 	// Retrieving all previous transactions referred in the inputs
 	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
+		prevTX, err := bc.findSpentTransaction(in.ID)
 		Handle(err)
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	tx.Sign(privKey, prevTXs) // Signing the transaction
+	tx.SignWithHashType(privKey, prevTXs, hashType) // Signing the transaction
 }
 
 // VerifyTransaction verifies a transaction's inputs.
@@ -350,8 +597,10 @@ func (bc *BlockChain) VerifyTransaction(tx *Transaction) bool {
 
 	// Retrieving all previous transactions referred in the inputs
 	for _, in := range tx.Inputs {
-		prevTX, err := bc.FindTransaction(in.ID)
-		Handle(err)
+		prevTX, err := bc.findSpentTransaction(in.ID)
+		if err != nil {
+			return false // Unknown inputs can never be valid
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
@@ -0,0 +1,239 @@
+package blockchain
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+)
+
+// useTempDir runs a test inside a temporary directory, where the databases of its nodes are created.
+func useTempDir(t *testing.T) {
+	dir, err := os.Getwd()
+	assert.NoError(t, err)
+	assert.NoError(t, os.Chdir(t.TempDir()))
+	assert.NoError(t, os.Mkdir("tmp", 0755))
+	t.Cleanup(func() { os.Chdir(dir) })
+}
+
+// newTestChain creates the blockchain of a test node whose genesis block pays a new wallet.
+func newTestChain(t *testing.T) (*BlockChain, *wallet.Wallet) {
+	useTempDir(t)
+	w := wallet.MakeWallet()
+	chain := InitBlockChain(string(w.Address()), "test")
+	t.Cleanup(func() { chain.Database.Close() })
+
+	UTXOSet := UTXOSet{chain}
+	UTXOSet.Reindex()
+
+	return chain, w
+}
+
+// newTestBlock builds a block on a parent, TargetSpacing seconds after it so the target stays at
+// the limit, and mines it without printing every attempt.
+func newTestBlock(parent *Block, txs ...*Transaction) *Block {
+	header := BlockHeader{blockVersion, parent.Hash, nil, parent.Timestamp + TargetSpacing, powLimitBits, 0}
+	block := &Block{header, nil, txs, parent.Height + 1}
+	block.MerkleRoot = block.HashTransactions()
+	for !NewProof(&block.BlockHeader).Validate() {
+		block.Nonce++
+	}
+	block.Hash = block.BlockHeader.Hash()
+
+	return block
+}
+
+// extendChain adds blocks paying their subsidy to an address on top of a block and returns the
+// last one.
+func extendChain(t *testing.T, chain *BlockChain, parent *Block, count int, to string) *Block {
+	for i := 0; i < count; i++ {
+		parent = newTestBlock(parent, CoinbaseTx(to, "", BlockSubsidy(parent.Height+1)))
+		_, err := chain.AddBlock(parent)
+		assert.NoError(t, err)
+	}
+
+	return parent
+}
+
+// tip returns the last block of the best chain.
+func tip(t *testing.T, chain *BlockChain) *Block {
+	block, err := chain.GetBlock(chain.LastHash)
+	assert.NoError(t, err)
+
+	return &block
+}
+
+// unspentValue returns the value of the unspent outputs paying to a public key hash.
+func unspentValue(u UTXOSet, pubKeyHash []byte) int {
+	value := 0
+	for _, out := range u.FindUnspentTransactions(pubKeyHash) {
+		value += out.Value
+	}
+
+	return value
+}
+
+func TestReorganizeToHeavierBranch(t *testing.T) {
+	chain, _ := newTestChain(t)
+	a, b := wallet.MakeWallet(), wallet.MakeWallet()
+	UTXOSet := UTXOSet{chain}
+	genesis := tip(t, chain)
+
+	tipA := extendChain(t, chain, genesis, 2, string(a.Address()))
+	assert.Equal(t, tipA.Hash, chain.LastHash)
+	assert.Equal(t, BlockSubsidy(1)+BlockSubsidy(2), unspentValue(UTXOSet, wallet.PublicKeyHash(a.PublicKey)))
+
+	// A branch of equal work does not replace the best chain
+	blockB := newTestBlock(genesis, CoinbaseTx(string(b.Address()), "", BlockSubsidy(1)))
+	_, err := chain.AddBlock(blockB)
+	assert.NoError(t, err)
+	blockB = newTestBlock(blockB, CoinbaseTx(string(b.Address()), "", BlockSubsidy(2)))
+	_, err = chain.AddBlock(blockB)
+	assert.NoError(t, err)
+	assert.Equal(t, tipA.Hash, chain.LastHash, "First seen branch is kept on a tie")
+
+	tipB := newTestBlock(blockB, CoinbaseTx(string(b.Address()), "", BlockSubsidy(3)))
+	change, err := chain.AddBlock(tipB)
+	assert.NoError(t, err)
+	assert.Equal(t, tipB.Hash, chain.LastHash, "Heavier branch becomes the best chain")
+	assert.Len(t, change.Disconnected, 2)
+	assert.Equal(t, tipA.Hash, change.Disconnected[0].Hash, "Disconnection starts at the old tip")
+	assert.Len(t, change.Connected, 3)
+	assert.Equal(t, tipB.Hash, change.Connected[2].Hash, "Connection ends at the new tip")
+
+	assert.Equal(t, 0, unspentValue(UTXOSet, wallet.PublicKeyHash(a.PublicKey)), "Outputs of the old branch are gone")
+	assert.Equal(t, BlockSubsidy(1)+BlockSubsidy(2)+BlockSubsidy(3), unspentValue(UTXOSet, wallet.PublicKeyHash(b.PublicKey)))
+	hash, err := chain.GetBlockHashByHeight(2)
+	assert.NoError(t, err)
+	assert.Equal(t, blockB.Hash, hash, "Height index follows the new branch")
+}
+
+func TestOrphanBlocks(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer func(max int) { MaxOrphanBlocks = max }(MaxOrphanBlocks)
+	MaxOrphanBlocks = 2
+
+	// Blocks arriving in reverse order wait for their parent
+	var blocks []*Block
+	parent := tip(t, chain)
+	for i := 0; i < 4; i++ {
+		parent = newTestBlock(parent, CoinbaseTx(string(w.Address()), "", BlockSubsidy(parent.Height+1)))
+		blocks = append(blocks, parent)
+	}
+	genesisHash := chain.LastHash
+	for i := len(blocks) - 1; i > 0; i-- {
+		_, err := chain.AddBlock(blocks[i])
+		assert.NoError(t, err)
+		assert.Equal(t, genesisHash, chain.LastHash, "Orphans do not move the tip")
+	}
+
+	orphans := 0
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(orphanPrefix); it.ValidForPrefix(orphanPrefix); it.Next() {
+			orphans++
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, MaxOrphanBlocks, orphans, "Full orphan pool evicts a block")
+
+	// The missing parent connects the remaining orphans, evicted ones are accepted when sent again
+	_, err = chain.AddBlock(blocks[0])
+	assert.NoError(t, err)
+	for _, block := range blocks[1:] {
+		_, err := chain.AddBlock(block)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, blocks[3].Hash, chain.LastHash)
+	assert.Equal(t, 4, chain.GetBestHeight())
+}
+
+func TestInvalidOrphanDropsDescendants(t *testing.T) {
+	chain, w := newTestChain(t)
+	coinbase := func(height int) *Transaction {
+		return CoinbaseTx(string(w.Address()), "", BlockSubsidy(height))
+	}
+
+	// The second block claims a wrong height, which is only found once its parent arrives
+	first := newTestBlock(tip(t, chain), coinbase(1))
+	second := newTestBlock(first, coinbase(2))
+	second.Height = 7
+	third := newTestBlock(second, coinbase(8))
+	for _, block := range []*Block{third, second} {
+		_, err := chain.AddBlock(block)
+		assert.NoError(t, err)
+	}
+
+	_, err := chain.AddBlock(first)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Hash, chain.LastHash)
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		for _, block := range []*Block{second, third} {
+			_, err := txn.Get(block.Hash)
+			assert.Equal(t, badger.ErrKeyNotFound, err, "Body of the dropped orphan is deleted")
+		}
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		it.Seek(orphanPrefix)
+		assert.False(t, it.ValidForPrefix(orphanPrefix), "No orphan is left waiting")
+		return nil
+	})
+	assert.NoError(t, err)
+}
+
+func TestDescendantsOfInvalidBlocks(t *testing.T) {
+	chain, w := newTestChain(t)
+	genesis := tip(t, chain)
+	mainTip := extendChain(t, chain, genesis, 2, string(w.Address()))
+
+	// The side branch starts with a block whose coinbase is only checked when it is connected
+	first := newTestBlock(genesis, CoinbaseTx(string(w.Address()), "", BlockSubsidy(1)+1))
+	second := newTestBlock(first, CoinbaseTx(string(w.Address()), "", BlockSubsidy(2)))
+	for _, block := range []*Block{first, second} {
+		_, err := chain.AddBlock(block)
+		assert.NoError(t, err)
+	}
+
+	third := newTestBlock(second, CoinbaseTx(string(w.Address()), "", BlockSubsidy(3)))
+	_, err := chain.AddBlock(third)
+	var blockErr *BlockError
+	assert.True(t, errors.As(err, &blockErr))
+	assert.True(t, errors.Is(err, ErrBadCoinbaseValue), "got %v", err)
+	assert.Equal(t, first.Hash, blockErr.Hash, "Reorganization fails at the invalid block")
+	assert.Equal(t, mainTip.Hash, chain.LastHash, "Tip stays on the stored chain")
+
+	// Later blocks of the branch are refused without connecting the branch again
+	for _, block := range []*Block{third, newTestBlock(third, CoinbaseTx(string(w.Address()), "", BlockSubsidy(4)))} {
+		_, err = chain.AddBlock(block)
+		assert.True(t, errors.As(err, &blockErr))
+		assert.True(t, errors.Is(err, ErrInvalidAncestor), "got %v", err)
+		assert.Equal(t, block.Hash, blockErr.Hash)
+	}
+	assert.Equal(t, mainTip.Hash, chain.LastHash)
+}
+
+func TestReorganizationDepthIsBounded(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer func(depth int) { MaxReorgDepth = depth }(MaxReorgDepth)
+	MaxReorgDepth = 2
+	genesis := tip(t, chain)
+	mainTip := extendChain(t, chain, genesis, 3, string(w.Address()))
+
+	branch := genesis
+	for i := 0; i < 3; i++ {
+		branch = newTestBlock(branch, CoinbaseTx(string(w.Address()), "branch", BlockSubsidy(branch.Height+1)))
+		_, err := chain.AddBlock(branch)
+		assert.NoError(t, err)
+	}
+	heavier := newTestBlock(branch, CoinbaseTx(string(w.Address()), "branch", BlockSubsidy(4)))
+	change, err := chain.AddBlock(heavier)
+	assert.True(t, errors.Is(err, ErrReorgTooDeep), "got %v", err)
+	assert.Empty(t, change.Connected)
+	assert.Equal(t, mainTip.Hash, chain.LastHash, "Tip is kept")
+	assert.Equal(t, 3, chain.GetBestHeight())
+}
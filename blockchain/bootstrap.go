@@ -0,0 +1,303 @@
+package blockchain
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	maxChainFileBlock    = 32 << 20 // Largest block record accepted from a chain file
+	importProgressBlocks = 1000     // Number of imported blocks between progress reports
+)
+
+// ErrBadChecksum is returned when the checksum of a chain file does not match its content.
+var ErrBadChecksum = errors.New("chain file checksum mismatch")
+
+// ExportChain writes every block of the best chain, from the genesis block in height order, to a
+// chain file that ImportBlockChain can seed a new node from. See encoding.go for the layout. It
+// returns the number of exported blocks.
+func (chain *BlockChain) ExportChain(file string) (int, error) {
+	if err := chain.requireAllBlocks(); err != nil {
+		return 0, err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	checksum := sha256.New()
+	buf := bufio.NewWriter(f)
+	out := io.MultiWriter(buf, checksum)
+
+	count := chain.GetBestHeight() + 1
+	head := newRecordWriter(chainFileRecord)
+	head.writeVarInt(uint64(count))
+	if _, err := out.Write(head.Bytes()); err != nil {
+		return 0, err
+	}
+
+	exported := 0
+	iter := chain.ForwardIterator()
+	for block := iter.Next(); block != nil && exported < count; block = iter.Next() {
+		entry := &binaryWriter{}
+		entry.writeVarBytes(block.Serialize())
+		if _, err := out.Write(entry.Bytes()); err != nil {
+			return exported, err
+		}
+		exported++
+	}
+	if exported != count {
+		return exported, fmt.Errorf("Best chain has %d blocks, exported %d", count, exported)
+	}
+
+	if _, err := buf.Write(checksum.Sum(nil)); err != nil {
+		return exported, err
+	}
+	if err := buf.Flush(); err != nil {
+		return exported, err
+	}
+
+	return exported, f.Close()
+}
+
+// verifyChainFile checks the checksum at the end of a chain file and returns the length of the
+// content it covers.
+func verifyChainFile(f *os.File) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := info.Size() - sha256.Size
+	if size < 0 {
+		return 0, ErrBadEncoding
+	}
+
+	checksum := sha256.New()
+	if _, err := io.CopyN(checksum, f, size); err != nil {
+		return 0, err
+	}
+	expected := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(f, expected); err != nil {
+		return 0, err
+	}
+	if !bytes.Equal(checksum.Sum(nil), expected) {
+		return 0, ErrBadChecksum
+	}
+
+	return size, nil
+}
+
+// readChainFileBlock reads the next length-prefixed block record of a chain file.
+func readChainFileBlock(r *bufio.Reader) (*Block, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, ErrBadEncoding
+	}
+	if length > maxChainFileBlock {
+		return nil, fmt.Errorf("%w: block record of %d bytes", ErrBadEncoding, length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, ErrBadEncoding
+	}
+
+	return DeserializeBlock(data)
+}
+
+// checkLegacyBlock checks the rules of a block of the first versions, as migratedb converted it,
+// that need no other block. The first versions mined every block at the easiest target.
+func checkLegacyBlock(block *Block) error {
+	if !bytes.Equal(block.BlockHeader.Hash(), block.Hash) {
+		return ErrBadHash
+	}
+	if block.Bits != powLimitBits {
+		return fmt.Errorf("%w: got %08x, want %08x", ErrBadDifficulty, block.Bits, powLimitBits)
+	}
+	if !NewProof(&block.BlockHeader).Validate() {
+		return ErrBadProofOfWork
+	}
+	if len(block.Transactions) == 0 {
+		return ErrNoTransactions
+	}
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return ErrBadMerkleRoot
+	}
+
+	for i, tx := range block.Transactions {
+		if tx.Version != LegacyTxVersion {
+			return fmt.Errorf("%w: transaction version %d in a legacy block", ErrBadVersion, tx.Version)
+		}
+		if tx.IsCoinbase() != (i == 0) {
+			return ErrBadCoinbase
+		}
+	}
+
+	return nil
+}
+
+// importLegacyBlock validates a legacy block and connects it on top of the imported chain. Its
+// transactions follow the rules of the first versions: their signatures were made over gob
+// encodings that cannot be rebuilt and coinbase outputs could be spent at once. Every other rule,
+// from the median time past to the amounts spent, is checked as for current blocks.
+func (chain *BlockChain) importLegacyBlock(block *Block) error {
+	if err := checkLegacyBlock(block); err != nil {
+		return &BlockError{block.Hash, err}
+	}
+	if !bytes.Equal(block.PrevHash, chain.LastHash) {
+		return errors.New("Block does not extend the imported chain")
+	}
+
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		parent, err := readHeader(txn, block.PrevHash)
+		if err != nil {
+			return err
+		}
+		if err := checkMedianTime(txn, &block.BlockHeader, parent); err != nil {
+			return &BlockError{block.Hash, err}
+		}
+		work, ok := chainWork(txn, block.PrevHash)
+		if !ok {
+			return ErrUnknownParent
+		}
+		work.Add(work, NewProof(&block.BlockHeader).Work())
+
+		if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+			return err
+		}
+		if err := writeHeader(txn, block.Hash, headerEntry{block.BlockHeader, block.Height}, work); err != nil {
+			return err
+		}
+		if err := chain.connectBlock(txn, block); err != nil {
+			return &BlockError{block.Hash, err}
+		}
+
+		return txn.Set([]byte("lh"), block.Hash)
+	})
+	if err != nil {
+		return err
+	}
+	chain.LastHash = block.Hash
+
+	return nil
+}
+
+// ImportBlockChain creates the blockchain of a node from a chain file written by ExportChain. The
+// checksum is verified before the database is created. It only catches damaged files, so every
+// block is then validated and connected as if a peer had sent it. Blocks imported before a failure
+// are kept.
+//
+// A chain migrated by migratedb starts with the legacy blocks of the first versions, which are
+// imported by importLegacyBlock.
+func ImportBlockChain(file, nodeId string) (*BlockChain, error) {
+	path := fmt.Sprintf(dbPath, nodeId)
+	if DBexists(path) {
+		return nil, errors.New("Blockchain already exists")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	size, err := verifyChainFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	r := bufio.NewReader(io.LimitReader(f, size))
+
+	// Reading the envelope and the number of blocks
+	envelope := make([]byte, len(encodingMagic)+2)
+	if _, err := io.ReadFull(r, envelope); err != nil {
+		return nil, ErrBadEncoding
+	}
+	if !bytes.Equal(envelope, append(append([]byte{}, encodingMagic...), encodingFormat, chainFileRecord)) {
+		return nil, ErrBadEncoding
+	}
+	count, err := binary.ReadUvarint(r)
+	if err != nil || count == 0 {
+		return nil, ErrBadEncoding
+	}
+
+	genesis, err := readChainFileBlock(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(genesis.PrevHash) != 0 || genesis.Height != 0 || !NewProof(&genesis.BlockHeader).Validate() {
+		return nil, &BlockError{genesis.Hash, errors.New("Chain file does not start with a genesis block")}
+	}
+	legacy := genesis.Version == legacyBlockVersion // Importing the legacy blocks of a migrated chain
+	if legacy {
+		err = checkLegacyBlock(genesis)
+	} else {
+		err = checkBlockSanity(genesis)
+	}
+	if err != nil {
+		return nil, &BlockError{genesis.Hash, err}
+	}
+
+	// Setting up badger database options
+	opts := badger.DefaultOptions
+	opts.Dir = path
+	opts.ValueDir = path
+
+	db, err := openDB(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(txn *badger.Txn) error {
+		return storeGenesis(txn, genesis)
+	})
+	Handle(err)
+
+	chain := &BlockChain{genesis.Hash, db}
+	UTXOSet := UTXOSet{chain}
+	UTXOSet.Reindex()
+
+	for height := 1; uint64(height) < count; height++ {
+		block, err := readChainFileBlock(r)
+		if err == nil && block.Height != height {
+			err = fmt.Errorf("%w: got %d, want %d", ErrBadHeight, block.Height, height)
+		}
+		if err == nil && block.Version == legacyBlockVersion {
+			if !legacy {
+				err = &BlockError{block.Hash, fmt.Errorf("%w: legacy block after current blocks", ErrBadVersion)}
+			} else {
+				err = chain.importLegacyBlock(block)
+			}
+		} else if err == nil {
+			legacy = false
+			_, err = chain.AddBlock(block)
+		}
+		if err == nil && !bytes.Equal(chain.LastHash, block.Hash) {
+			err = errors.New("Block does not extend the imported chain")
+		}
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("Importing block at height %d: %w", height, err)
+		}
+
+		if height%importProgressBlocks == 0 || uint64(height) == count-1 {
+			fmt.Printf("Imported %d of %d blocks\n", height+1, count)
+		}
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		db.Close()
+		return nil, fmt.Errorf("%w: trailing data after the last block", ErrBadEncoding)
+	}
+
+	return chain, nil
+}
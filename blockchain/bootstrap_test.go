@@ -0,0 +1,143 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeChainFile writes a chain file holding the given block records under a valid checksum.
+func writeChainFile(t *testing.T, file string, records ...[]byte) {
+	w := newRecordWriter(chainFileRecord)
+	w.writeVarInt(uint64(len(records)))
+	for _, record := range records {
+		w.writeVarBytes(record)
+	}
+	checksum := sha256.Sum256(w.Bytes())
+	assert.NoError(t, os.WriteFile(file, append(w.Bytes(), checksum[:]...), 0644))
+}
+
+func TestExportImportChain(t *testing.T) {
+	chain, w := newTestChain(t)
+	other := wallet.MakeWallet()
+
+	// The genesis coinbase is spendable at once
+	utxoSet := UTXOSet{chain}
+	tx := NewTransaction(w, string(other.Address()), 5, 1, 0, &utxoSet)
+	block := newTestBlock(tip(t, chain), CoinbaseTx(string(w.Address()), "", BlockSubsidy(1)+1), tx)
+	_, err := chain.AddBlock(block)
+	assert.NoError(t, err)
+	extendChain(t, chain, block, 3, string(other.Address()))
+
+	count, err := chain.ExportChain("tmp/chain.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, 5, count)
+
+	imported, err := ImportBlockChain("tmp/chain.dat", "imported")
+	assert.NoError(t, err)
+	defer imported.Database.Close()
+	assert.Equal(t, chain.LastHash, imported.LastHash)
+	assert.Equal(t, chain.GetBestHeight(), imported.GetBestHeight())
+	importedUTXO := UTXOSet{imported}
+	for _, pubKey := range [][]byte{w.PublicKey, other.PublicKey} {
+		pubKeyHash := wallet.PublicKeyHash(pubKey)
+		assert.Equal(t, unspentValue(utxoSet, pubKeyHash), unspentValue(importedUTXO, pubKeyHash), "UTXO set is rebuilt")
+	}
+
+	_, err = ImportBlockChain("tmp/chain.dat", "imported")
+	assert.Error(t, err, "Existing blockchain is not overwritten")
+
+	// Damaged and malformed files fail without creating a blockchain
+	data, err := os.ReadFile("tmp/chain.dat")
+	assert.NoError(t, err)
+	data[len(data)/2] ^= 1
+	assert.NoError(t, os.WriteFile("tmp/damaged.dat", data, 0644))
+	_, err = ImportBlockChain("tmp/damaged.dat", "damaged")
+	assert.Equal(t, ErrBadChecksum, err)
+
+	genesis, err := chain.GetBlockByHeight(0)
+	assert.NoError(t, err)
+	truncated := genesis.Serialize()
+	writeChainFile(t, "tmp/truncated.dat", truncated[:len(truncated)-1])
+	_, err = ImportBlockChain("tmp/truncated.dat", "truncated")
+	assert.True(t, errors.Is(err, ErrBadEncoding), "Truncated block is rejected")
+
+	garbage := append(newRecordWriter(blockRecord).Bytes(), 0xff, 0xff, 0xff)
+	writeChainFile(t, "tmp/garbage.dat", genesis.Serialize(), garbage)
+	_, err = ImportBlockChain("tmp/garbage.dat", "garbage")
+	assert.True(t, errors.Is(err, ErrBadEncoding), "Malformed block is rejected")
+}
+
+// newLegacyBlock builds a block in the layout migratedb gives the blocks of the first versions.
+func newLegacyBlock(parent *Block, timestamp int64, bits uint32, txs ...*Transaction) *Block {
+	header := BlockHeader{legacyBlockVersion, nil, nil, timestamp, bits, 0}
+	block := &Block{header, nil, txs, 0}
+	if parent != nil {
+		block.PrevHash = parent.Hash
+		block.Height = parent.Height + 1
+	}
+	block.MerkleRoot = block.HashTransactions()
+	for !NewProof(&block.BlockHeader).Validate() {
+		block.Nonce++
+	}
+	block.Hash = block.BlockHeader.Hash()
+
+	return block
+}
+
+func TestImportValidatesLegacyBlocks(t *testing.T) {
+	useTempDir(t)
+	w := wallet.MakeWallet()
+	legacyTx := func(id string, inputs []TxInput, values ...int) *Transaction {
+		tx := &Transaction{LegacyTxVersion, []byte(id), inputs, nil, 0}
+		for _, value := range values {
+			tx.Outputs = append(tx.Outputs, *NewTXOutput(value, string(w.Address())))
+		}
+		return tx
+	}
+	coinbase := func(id string) *Transaction {
+		return legacyTx(id, []TxInput{{[]byte{}, -1, nil, MaxSequence}}, InitialSubsidy)
+	}
+	spend := func(id string, from *Transaction, values ...int) *Transaction {
+		return legacyTx(id, []TxInput{{from.ID, 0, []byte("unverifiable signature"), MaxSequence}}, values...)
+	}
+
+	genesis := newLegacyBlock(nil, 1600000000, powLimitBits, coinbase("genesis"))
+	first := newLegacyBlock(genesis, 1600000010, powLimitBits, coinbase("first"))
+	valid := newLegacyBlock(first, 1600000020, powLimitBits, coinbase("second"), spend("pay", first.Transactions[0], 5, 15))
+
+	tests := []struct {
+		name  string
+		block *Block
+		err   error
+	}{
+		{"valid", valid, nil},
+		{"harder target", newLegacyBlock(first, 1600000020, powLimitBits-1, coinbase("second")), ErrBadDifficulty},
+		{"older than the median time", newLegacyBlock(first, 1599999999, powLimitBits, coinbase("second")), ErrBadTimestamp},
+		{"overspend", newLegacyBlock(first, 1600000020, powLimitBits, coinbase("second"), spend("pay", first.Transactions[0], 25)), ErrInsufficientFund},
+		{"missing input", newLegacyBlock(first, 1600000020, powLimitBits, coinbase("second"), spend("pay", coinbase("unknown"), 5)), ErrMissingInput},
+		{"double spend", newLegacyBlock(first, 1600000020, powLimitBits, coinbase("second"), spend("pay", genesis.Transactions[0], 5), spend("again", genesis.Transactions[0], 5)), ErrMissingInput},
+		{"coinbase overpay", newLegacyBlock(first, 1600000020, powLimitBits, legacyTx("second", coinbase("").Inputs, InitialSubsidy+1)), ErrBadCoinbaseValue},
+	}
+
+	for i, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file, node := fmt.Sprintf("tmp/legacy%d.dat", i), fmt.Sprintf("legacy%d", i)
+			writeChainFile(t, file, genesis.Serialize(), first.Serialize(), test.block.Serialize())
+			imported, err := ImportBlockChain(file, node)
+			if test.err == nil {
+				assert.NoError(t, err)
+				defer imported.Database.Close()
+				assert.Equal(t, valid.Hash, imported.LastHash)
+				assert.Equal(t, 3*InitialSubsidy, unspentValue(UTXOSet{imported}, wallet.PublicKeyHash(w.PublicKey)), "UTXO set follows the connected blocks")
+				return
+			}
+			assert.True(t, errors.Is(err, test.err), "got %v", err)
+		})
+	}
+}
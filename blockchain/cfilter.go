@@ -0,0 +1,412 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+// A compact block filter is a Golomb-coded set of the public key hashes paid to and the outpoints
+// spent by a block. A light client matches its own items against the filter locally and only
+// fetches the blocks that may concern it, without telling a full node which addresses it watches.
+//
+// Every item is hashed with SHA-256 keyed by the block hash and mapped to [0, N*M). The sorted
+// values are stored as Golomb-Rice coded differences: the quotient by 2^P in unary, then the
+// remainder in P bits. A filter is the item count N as a uvarint followed by the bit stream.
+//
+// The filter header of a block is SHA-256d(SHA-256d(filter) || filter header of the parent), with
+// 32 zero bytes as the parent of the genesis block, so one trusted header commits to every filter
+// before it.
+
+const (
+	filterP = 19     // Bits of the remainder of every coded value
+	filterM = 784931 // Inverse of the false positive rate
+)
+
+var (
+	filterPrefix       = []byte("cf-")  // Prefix for the compact filter of every connected block
+	filterHeaderPrefix = []byte("cfh-") // Prefix for the filter header of every connected block
+)
+
+// ErrBadFilter is returned when a compact filter cannot be decoded.
+var ErrBadFilter = errors.New("malformed compact filter")
+
+// BlockFilter is the compact filter of a block together with its place in the filter header chain.
+type BlockFilter struct {
+	BlockHash  []byte // Hash of the filtered block
+	Filter     []byte // Golomb-coded set of the block items
+	PrevHeader []byte // Filter header of the parent block
+	Header     []byte // Filter header of the block
+}
+
+// Verify checks that the filter header commits to the filter and the header of the parent.
+func (f *BlockFilter) Verify() bool {
+	return bytes.Equal(FilterHeader(f.Filter, f.PrevHeader), f.Header)
+}
+
+// Match reports whether any of the items may be in the block. False positives happen about once
+// in filterM queried items, but an item of the block is never missed.
+func (f *BlockFilter) Match(items [][]byte) (bool, error) {
+	return MatchFilter(f.Filter, f.BlockHash, items)
+}
+
+// FilterOutpoint returns the filter item of an outpoint: the transaction ID followed by the output
+// index as a little-endian uint32.
+func FilterOutpoint(txID []byte, out int) []byte {
+	item := make([]byte, len(txID)+4)
+	copy(item, txID)
+	binary.LittleEndian.PutUint32(item[len(txID):], uint32(out))
+
+	return item
+}
+
+// blockFilterItems returns the distinct public key hashes paid to and outpoints spent by a block.
+func blockFilterItems(block *Block) [][]byte {
+	var items [][]byte
+	seen := make(map[string]bool)
+
+	add := func(item []byte) {
+		if !seen[string(item)] {
+			seen[string(item)] = true
+			items = append(items, item)
+		}
+	}
+
+	for _, tx := range block.Transactions {
+		if !tx.IsCoinbase() {
+			for _, in := range tx.Inputs {
+				add(FilterOutpoint(in.ID, in.Out))
+			}
+		}
+		for _, out := range tx.Outputs {
+			if pubKeyHash := out.PubKeyHash(); pubKeyHash != nil {
+				add(pubKeyHash)
+			}
+		}
+	}
+
+	return items
+}
+
+// filterValues hashes items into the range of a filter of n items and sorts them.
+func filterValues(key []byte, items [][]byte, n uint64) []uint64 {
+	values := make([]uint64, 0, len(items))
+	for _, item := range items {
+		hash := sha256.Sum256(append(append([]byte{}, key...), item...))
+		value, _ := bits.Mul64(binary.BigEndian.Uint64(hash[:8]), n*filterM)
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	return values
+}
+
+// NewGCSFilter builds the Golomb-coded set of distinct items keyed by a block hash.
+func NewGCSFilter(key []byte, items [][]byte) []byte {
+	var header [binary.MaxVarintLen64]byte
+	filter := append([]byte{}, header[:binary.PutUvarint(header[:], uint64(len(items)))]...)
+
+	w := &bitWriter{}
+	last := uint64(0)
+	for _, value := range filterValues(key, items, uint64(len(items))) {
+		delta := value - last
+		last = value
+
+		for q := delta >> filterP; q > 0; q-- {
+			w.writeBit(1)
+		}
+		w.writeBit(0)
+		w.writeBits(delta, filterP)
+	}
+
+	return append(filter, w.data...)
+}
+
+// BuildBlockFilter builds the compact filter of a block.
+func BuildBlockFilter(block *Block) []byte {
+	return NewGCSFilter(block.Hash, blockFilterItems(block))
+}
+
+// MatchFilter reports whether any of the items may be in a filter keyed by a block hash.
+func MatchFilter(filter, key []byte, items [][]byte) (bool, error) {
+	n, read := binary.Uvarint(filter)
+	if read <= 0 {
+		return false, ErrBadFilter
+	}
+	if n == 0 || len(items) == 0 {
+		return false, nil
+	}
+
+	queries := filterValues(key, items, n)
+	r := &bitReader{data: filter[read:]}
+	value := uint64(0)
+	for i := uint64(0); i < n; i++ {
+		quotient := uint64(0)
+		for {
+			bit, ok := r.readBit()
+			if !ok {
+				return false, ErrBadFilter
+			}
+			if bit == 0 {
+				break
+			}
+			quotient++
+		}
+		remainder, ok := r.readBits(filterP)
+		if !ok {
+			return false, ErrBadFilter
+		}
+		value += quotient<<filterP | remainder
+
+		// Walking both sorted lists together
+		for len(queries) > 0 && queries[0] < value {
+			queries = queries[1:]
+		}
+		if len(queries) == 0 {
+			return false, nil
+		}
+		if queries[0] == value {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// FilterHeader returns the filter header of a block from its filter and the header of its parent.
+func FilterHeader(filter, prevHeader []byte) []byte {
+	first := sha256.Sum256(filter)
+	filterHash := sha256.Sum256(first[:])
+
+	first = sha256.Sum256(append(filterHash[:], prevHeader...))
+	header := sha256.Sum256(first[:])
+
+	return header[:]
+}
+
+// bitWriter appends bits to a byte slice, most significant bit first.
+type bitWriter struct {
+	data []byte
+	used uint // Bits used in the last byte
+}
+
+func (w *bitWriter) writeBit(bit byte) {
+	if w.used == 0 {
+		w.data = append(w.data, 0)
+	}
+	w.data[len(w.data)-1] |= bit << (7 - w.used)
+	w.used = (w.used + 1) % 8
+}
+
+func (w *bitWriter) writeBits(v uint64, n uint) {
+	for i := n; i > 0; i-- {
+		w.writeBit(byte(v>>(i-1)) & 1)
+	}
+}
+
+// bitReader reads the bits written by a bitWriter.
+type bitReader struct {
+	data []byte
+	pos  uint // Index of the next bit
+}
+
+func (r *bitReader) readBit() (byte, bool) {
+	if r.pos/8 >= uint(len(r.data)) {
+		return 0, false
+	}
+	bit := r.data[r.pos/8] >> (7 - r.pos%8) & 1
+	r.pos++
+
+	return bit, true
+}
+
+func (r *bitReader) readBits(n uint) (uint64, bool) {
+	v := uint64(0)
+	for i := uint(0); i < n; i++ {
+		bit, ok := r.readBit()
+		if !ok {
+			return 0, false
+		}
+		v = v<<1 | uint64(bit)
+	}
+
+	return v, true
+}
+
+// filterKey builds the database key holding the compact filter of a block.
+func filterKey(hash []byte) []byte {
+	return append(append([]byte{}, filterPrefix...), hash...)
+}
+
+// filterHeaderKey builds the database key holding the filter header of a block.
+func filterHeaderKey(hash []byte) []byte {
+	return append(append([]byte{}, filterHeaderPrefix...), hash...)
+}
+
+// readPrevFilterHeader returns the filter header of the parent of a block, zeros for the genesis block.
+func readPrevFilterHeader(txn *badger.Txn, prevHash []byte) ([]byte, error) {
+	if len(prevHash) == 0 {
+		return make([]byte, hashLength), nil
+	}
+	item, err := txn.Get(filterHeaderKey(prevHash))
+	if err == badger.ErrKeyNotFound {
+		return nil, errors.New("Filter header of the parent block is missing")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+// storeBlockFilter builds and stores the compact filter and filter header of a block whose parent
+// has its filter stored. Filters describe the block alone, so they are kept when it is disconnected.
+func storeBlockFilter(txn *badger.Txn, block *Block) error {
+	if _, err := txn.Get(filterHeaderKey(block.Hash)); err == nil {
+		return nil
+	}
+	prevHeader, err := readPrevFilterHeader(txn, block.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	filter := BuildBlockFilter(block)
+	if err := txn.Set(filterKey(block.Hash), filter); err != nil {
+		return err
+	}
+
+	return txn.Set(filterHeaderKey(block.Hash), FilterHeader(filter, prevHeader))
+}
+
+// readBlockFilter loads the compact filter of a block inside a database transaction.
+func readBlockFilter(txn *badger.Txn, hash []byte) (*BlockFilter, error) {
+	item, err := txn.Get(filterKey(hash))
+	if err == badger.ErrKeyNotFound {
+		return nil, errors.New("Block filter does not exist")
+	} else if err != nil {
+		return nil, err
+	}
+	filter, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	item, err = txn.Get(filterHeaderKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	header, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	entry, err := readHeader(txn, hash)
+	if err != nil {
+		return nil, err
+	}
+	prevHeader, err := readPrevFilterHeader(txn, entry.Header.PrevHash)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BlockFilter{append([]byte{}, hash...), filter, prevHeader, header}, nil
+}
+
+// GetBlockFilter returns the compact filter of a block.
+func (chain *BlockChain) GetBlockFilter(hash []byte) (*BlockFilter, error) {
+	var filter *BlockFilter
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		filter, err = readBlockFilter(txn, hash)
+		return err
+	})
+
+	return filter, err
+}
+
+// FindBlockFilters returns the filters of the best chain blocks from a height up to the block
+// with the stop hash, the tip, or max filters, whichever comes first.
+func (chain *BlockChain) FindBlockFilters(startHeight int, stopHash []byte, max int) ([]*BlockFilter, error) {
+	var filters []*BlockFilter
+
+	if startHeight < 0 {
+		return nil, fmt.Errorf("Invalid start height %d", startHeight)
+	}
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		tip, err := readHeader(txn, chain.LastHash)
+		if err != nil {
+			return err
+		}
+
+		for height := startHeight; height <= tip.Height && len(filters) < max; height++ {
+			hash, err := hashAtHeight(txn, height)
+			if err != nil {
+				return err
+			}
+			filter, err := readBlockFilter(txn, hash)
+			if err != nil {
+				return err
+			}
+			filters = append(filters, filter)
+
+			if bytes.Equal(hash, stopHash) {
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return filters, nil
+}
+
+// indexFilters builds the filters that databases created before compact filters existed lack,
+// walking back from the tip until a block with a filter is found. It returns the number of
+// built filters.
+func (chain *BlockChain) indexFilters() (int, error) {
+	var missing [][]byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		for hash := chain.LastHash; len(hash) > 0; {
+			if _, err := txn.Get(filterHeaderKey(hash)); err == nil {
+				return nil
+			}
+			missing = append(missing, hash)
+
+			entry, err := readHeader(txn, hash)
+			if err != nil {
+				return err
+			}
+			hash = entry.Header.PrevHash
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// Building the oldest first so every parent has its filter header
+	for i := len(missing) - 1; i >= 0; i-- {
+		err := chain.Database.Update(func(txn *badger.Txn) error {
+			block, err := readBlock(txn, missing[i])
+			if err != nil {
+				return err
+			}
+			return storeBlockFilter(txn, block)
+		})
+		if err != nil {
+			return len(missing) - 1 - i, err
+		}
+	}
+
+	return len(missing), nil
+}
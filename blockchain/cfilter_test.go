@@ -0,0 +1,104 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGCSFilter(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, hashLength)
+	var items, others [][]byte
+	for i := 0; i < 500; i++ {
+		items = append(items, []byte(fmt.Sprintf("item%d", i)))
+		others = append(others, []byte(fmt.Sprintf("other%d", i)))
+	}
+	filter := NewGCSFilter(key, items)
+
+	for _, item := range items {
+		match, err := MatchFilter(filter, key, [][]byte{item})
+		assert.NoError(t, err)
+		assert.True(t, match, "Items of the filter are never missed")
+	}
+
+	falsePositives := 0
+	for _, item := range others {
+		if match, _ := MatchFilter(filter, key, [][]byte{item}); match {
+			falsePositives++
+		}
+	}
+	assert.LessOrEqual(t, falsePositives, 2, "False positives are rare")
+
+	match, err := MatchFilter(NewGCSFilter(key, nil), key, items)
+	assert.NoError(t, err)
+	assert.False(t, match, "Empty filter matches nothing")
+
+	_, err = MatchFilter(filter[:len(filter)/2], key, others)
+	assert.Equal(t, ErrBadFilter, err, "Truncated filter is rejected")
+}
+
+func TestBlockFilter(t *testing.T) {
+	coinbase := CoinbaseTx("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", "data", 20)
+	spend := &Transaction{TxVersion, nil, []TxInput{{bytes.Repeat([]byte{9}, hashLength), 2, nil, MaxSequence}}, nil, 0}
+	spend.ID = spend.Hash()
+	header := BlockHeader{blockVersion, bytes.Repeat([]byte{1}, hashLength), nil, 1700000000, powLimitBits, 42}
+	block := &Block{header, nil, []*Transaction{coinbase, spend}, 1}
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.BlockHeader.Hash()
+
+	prevHeader := FilterHeader(NewGCSFilter(block.PrevHash, nil), make([]byte, hashLength))
+	filter := BuildBlockFilter(block)
+	f := &BlockFilter{block.Hash, filter, prevHeader, FilterHeader(filter, prevHeader)}
+	assert.True(t, f.Verify(), "Filter header commits to the filter")
+
+	match, err := f.Match([][]byte{coinbase.Outputs[0].PubKeyHash()})
+	assert.NoError(t, err)
+	assert.True(t, match, "Paid public key hash is matched")
+	match, err = f.Match([][]byte{FilterOutpoint(spend.Inputs[0].ID, 2)})
+	assert.NoError(t, err)
+	assert.True(t, match, "Spent outpoint is matched")
+
+	f.Filter = NewGCSFilter(block.Hash, nil)
+	assert.False(t, f.Verify(), "Replaced filter breaks the header")
+	f.Filter, f.PrevHeader = filter, make([]byte, hashLength)
+	assert.False(t, f.Verify(), "Filter header commits to the parent header")
+}
+
+func TestFindBlockFilters(t *testing.T) {
+	chain, w := newTestChain(t)
+	genesis := tip(t, chain)
+	last := extendChain(t, chain, genesis, 3, string(w.Address()))
+
+	filters, err := chain.FindBlockFilters(1, nil, 10)
+	assert.NoError(t, err)
+	assert.Len(t, filters, 3, "Filters stop at the tip")
+	assert.Equal(t, last.Hash, filters[2].BlockHash)
+	for _, filter := range filters {
+		assert.True(t, filter.Verify())
+	}
+	assert.Equal(t, filters[0].Header, filters[1].PrevHeader, "Filter headers are chained")
+
+	filters, err = chain.FindBlockFilters(0, filters[0].BlockHash, 10)
+	assert.NoError(t, err)
+	assert.Len(t, filters, 2, "Filters stop at the stop hash")
+	filters, err = chain.FindBlockFilters(0, nil, 2)
+	assert.NoError(t, err)
+	assert.Len(t, filters, 2, "Filters stop at the maximum")
+	filters, err = chain.FindBlockFilters(4, nil, 10)
+	assert.NoError(t, err)
+	assert.Empty(t, filters, "No filter past the tip")
+
+	_, err = chain.FindBlockFilters(-1, nil, 10)
+	assert.Error(t, err)
+
+	// A missing filter is reported instead of ending the request early
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete(filterKey(last.Hash))
+	})
+	assert.NoError(t, err)
+	_, err = chain.FindBlockFilters(0, nil, 10)
+	assert.Error(t, err)
+}
@@ -16,13 +16,19 @@ func (chain *BlockChain) Iterator() *BlockChainIterator {
 	return iter
 }
 
-// Next moves the iterator to the next block in the blockchain and returns it.
+// Next moves the iterator to the next block in the blockchain and returns it. It returns nil once
+// the blocks of a pruned blockchain have been deleted.
 func (iter *BlockChainIterator) Next() *Block {
 	var block *Block
 
 	// Accessing the block from the database using the current hash
 	err := iter.Database.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(iter.CurrentHash)
+		if err == badger.ErrKeyNotFound {
+			if height, _ := pruneHeight(txn); height > 0 {
+				return nil // The rest of the chain is pruned
+			}
+		}
 		Handle(err)
 		encodedBlock, err := item.Value() // Retrieving the encoded block data
 		block = Deserialize(encodedBlock) // Deserializing the block
@@ -30,9 +36,35 @@ func (iter *BlockChainIterator) Next() *Block {
 		return err
 	})
 	Handle(err)
+	if block == nil {
+		return nil
+	}
 
 	// Moving the iterator to the previous block
 	iter.CurrentHash = block.PrevHash
 
 	return block // Returning the deserialized block
 }
+
+// ForwardIterator is used to iterate over the best chain from the genesis block to the tip.
+type ForwardIterator struct {
+	Height int         // The height of the next block to return
+	Chain  *BlockChain // The blockchain being iterated
+}
+
+// ForwardIterator creates and returns an iterator to traverse the best chain starting from the genesis block.
+func (chain *BlockChain) ForwardIterator() *ForwardIterator {
+	return &ForwardIterator{0, chain}
+}
+
+// Next returns the next block of the best chain, or nil once the tip has been passed.
+func (iter *ForwardIterator) Next() *Block {
+	block, err := iter.Chain.GetBlockByHeight(iter.Height)
+	if err != nil {
+		return nil // No block at this height
+	}
+
+	iter.Height++ // Moving the iterator to the following height
+
+	return &block
+}
@@ -0,0 +1,116 @@
+package blockchain
+
+import (
+	"fmt"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	RetargetInterval = 10 // Number of blocks between difficulty adjustments
+	TargetSpacing    = 10 // Desired number of seconds between two blocks
+	maxAdjustment    = 4  // Maximum factor by which the target may change at once
+)
+
+var (
+	powLimit     = new(big.Int).Lsh(big.NewInt(1), 256-Difficulty) // Easiest target a block may use
+	powLimitBits = BigToCompact(powLimit)                          // Compact form of the easiest target
+)
+
+// CompactToBig expands a compact target representation into the full 256-bit target.
+// The highest byte holds the length of the target in bytes and the lower three bytes its mantissa.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	exponent := uint(compact >> 24)
+
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		return big.NewInt(int64(mantissa))
+	}
+
+	target := big.NewInt(int64(mantissa))
+	return target.Lsh(target, 8*(exponent-3))
+}
+
+// BigToCompact converts a target into its compact representation, losing the precision
+// beyond the three most significant bytes.
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+
+	if exponent <= 3 {
+		mantissa = uint32(target.Uint64()) << (8 * (3 - exponent))
+	} else {
+		shifted := new(big.Int).Rsh(target, 8*(exponent-3))
+		mantissa = uint32(shifted.Uint64())
+	}
+
+	// The sign bit of the mantissa must stay clear
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	return uint32(exponent<<24) | mantissa
+}
+
+// calcNextBits returns the compact target required for the block following prev. The target is
+// recalculated every RetargetInterval blocks from the time it took to mine the previous window.
+func calcNextBits(txn *badger.Txn, prev *headerEntry) (uint32, error) {
+	bits := prev.Header.Bits
+	if bits == 0 {
+		bits = powLimitBits // Headers from before the difficulty was recorded
+	}
+
+	height := prev.Height + 1
+	if height%RetargetInterval != 0 {
+		return bits, nil
+	}
+
+	// Walking back to the first block of the window
+	first := prev
+	for i := 0; i < RetargetInterval-1; i++ {
+		var err error
+		if first, err = readHeader(txn, first.Header.PrevHash); err != nil {
+			return 0, err
+		}
+	}
+
+	// Clamping the measured time so the difficulty changes gradually
+	expected := int64((RetargetInterval - 1) * TargetSpacing)
+	actual := prev.Header.Timestamp - first.Header.Timestamp
+	if actual < expected/maxAdjustment {
+		actual = expected / maxAdjustment
+	}
+	if actual > expected*maxAdjustment {
+		actual = expected * maxAdjustment
+	}
+
+	target := CompactToBig(bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	if target.Cmp(powLimit) > 0 {
+		target.Set(powLimit)
+	}
+
+	return BigToCompact(target), nil
+}
+
+// checkDifficulty verifies that a header carries the target expected after its parent.
+func checkDifficulty(txn *badger.Txn, header *BlockHeader, parent *headerEntry) error {
+	expected, err := calcNextBits(txn, parent)
+	if err != nil {
+		return err
+	}
+	if header.Bits != expected {
+		return fmt.Errorf("%w: got %08x, want %08x", ErrBadDifficulty, header.Bits, expected)
+	}
+
+	return nil
+}
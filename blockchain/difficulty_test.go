@@ -0,0 +1,52 @@
+package blockchain
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompactTarget(t *testing.T) {
+	assert.Equal(t, uint32(0x1f100000), powLimitBits, "Limit target has the expected compact form")
+	assert.Equal(t, 0, powLimit.Cmp(CompactToBig(powLimitBits)), "Limit target survives the round trip")
+
+	target, _ := new(big.Int).SetString("00000000ffff0000000000000000000000000000000000000000000000000000", 16)
+	assert.Equal(t, uint32(0x1d00ffff), BigToCompact(target), "Target is encoded compactly")
+	assert.Equal(t, 0, target.Cmp(CompactToBig(0x1d00ffff)), "Compact form expands to the target")
+
+	// A mantissa with the sign bit set moves to the next exponent
+	assert.Equal(t, uint32(0x02008000), BigToCompact(big.NewInt(0x80)), "Sign bit stays clear")
+	assert.Equal(t, int64(0x80), CompactToBig(0x02008000).Int64(), "Small targets expand correctly")
+}
+
+func TestNextBitsWithoutRecordedDifficulty(t *testing.T) {
+	chain, _ := newTestChain(t)
+
+	// Headers from before the difficulty was recorded carry no bits
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		prev, err := readHeader(txn, chain.LastHash)
+		if err != nil {
+			return err
+		}
+		for height := 1; height < RetargetInterval; height++ {
+			header := BlockHeader{blockVersion, prev.Header.Hash(), nil, prev.Header.Timestamp + TargetSpacing, 0, 0}
+
+			bits, err := calcNextBits(txn, prev)
+			assert.NoError(t, err)
+			assert.Equal(t, powLimitBits, bits, "Missing bits are the limit")
+
+			prev = &headerEntry{header, height}
+			if err := writeHeader(txn, header.Hash(), *prev, big.NewInt(int64(height))); err != nil {
+				return err
+			}
+		}
+
+		bits, err := calcNextBits(txn, prev)
+		assert.NoError(t, err)
+		assert.Equal(t, powLimitBits, bits, "Missing bits are retargeted from the limit")
+		return nil
+	})
+	assert.NoError(t, err)
+}
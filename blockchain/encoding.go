@@ -0,0 +1,271 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Blocks, transactions and the records of the database are stored, sent to peers and hashed in a
+// binary encoding that does not depend on Go. Integers are little-endian with a fixed width, counts and
+// lengths are unsigned varints (LEB128) and byte strings are prefixed by their length. Every record
+// starts with an envelope:
+//
+//	magic    4 bytes  b1 63 68 6e
+//	format   1 byte   version of the encoding, currently 1
+//	kind     1 byte   1 block, 2 transaction, 3 unspent outputs, 4 transaction proof, 5 chain file,
+//	                  6 block index entry, 7 undo record, 8 transaction location, 9 address event
+//
+// A transaction follows with:
+//
+//	version  uint32   1, or 0 for transactions recorded in the gob encoding
+//	id       bytes    only for version 0, whose IDs cannot be derived again
+//	inputs   varint count, then per input:
+//	           txid bytes, output index uint32 (0xffffffff for the coinbase),
+//	           unlocking script bytes, sequence uint32
+//	outputs  varint count, then per output: value int64, locking script bytes
+//	lockTime uint32
+//
+// The ID of a version 1 transaction is the SHA-256 hash of its record with the ID and the unlocking
+// scripts of the inputs left empty; a coinbase keeps its unlocking script.
+//
+// A block follows with its 88 byte header as it is hashed (see BlockHeader.Serialize), its height
+// as a varint and a varint count of transactions, each as a length-prefixed transaction without
+// envelope. The hash of the block is the hash of the header and is not stored.
+//
+// Unspent outputs follow with the height of their block as a varint, a coinbase flag byte and a
+// varint count of outputs, each with its index in the transaction as a varint, its value as int64
+// and its locking script bytes.
+//
+// A transaction proof follows with the 88 byte header of the block, the length-prefixed transaction
+// and a varint count of Merkle path steps from the leaf up, each with the 32 byte sibling hash and a
+// byte set to 1 if the sibling is on the right.
+//
+// A chain file written by exportchain follows with a varint count of blocks and the blocks of the
+// best chain from the genesis block, each as a length-prefixed block record. It ends with the
+// SHA-256 hash of everything before it.
+//
+// A block index entry follows with the 88 byte header and the height of the block as a varint.
+//
+// An undo record follows with a varint count of the outputs spent by the block, each with the
+// transaction ID bytes, the output index as a varint, the value as int64, the locking script bytes,
+// the height of the block that created it as a varint and a coinbase flag byte.
+//
+// A transaction location follows with the block hash bytes and the position of the transaction in
+// the block as a varint.
+//
+// An address event follows with the public key hash, transaction ID and block hash bytes, the
+// height and the output or input index as varints, a spent flag byte and the value as int64.
+//
+// Records without the magic were written by earlier versions in gob and are still decoded;
+// BlockChain.MigrateEncoding rewrites them.
+//
+// The messages nodes exchange are gob encoded structs whose fields carry blocks, transactions,
+// headers and proofs in the binary encoding; only this envelope of the messages is specific to Go.
+
+const encodingFormat = 1 // Version of the binary encoding written by this node
+
+var encodingMagic = []byte{0xb1, 'c', 'h', 'n'} // Never the start of a gob stream
+
+// Kinds of records in the binary encoding.
+const (
+	blockRecord     byte = 1
+	txRecord        byte = 2
+	outputsRecord   byte = 3
+	txProofRecord   byte = 4
+	chainFileRecord byte = 5
+	headerRecord    byte = 6
+	undoRecord      byte = 7
+	txLocRecord     byte = 8
+	addrEventRecord byte = 9
+)
+
+// ErrBadEncoding is returned when a record is not a valid binary encoding.
+var ErrBadEncoding = errors.New("malformed binary encoding")
+
+// isBinaryEncoding checks whether data is a record of the binary encoding rather than gob.
+func isBinaryEncoding(data []byte) bool {
+	return bytes.HasPrefix(data, encodingMagic)
+}
+
+// binaryWriter builds the canonical binary encoding of chain data. Integers are little-endian with
+// a fixed width, counts and lengths are unsigned varints and byte strings are prefixed by their
+// length.
+type binaryWriter struct {
+	buf bytes.Buffer
+}
+
+// newRecordWriter returns a writer that has already written the envelope of a record.
+func newRecordWriter(kind byte) *binaryWriter {
+	w := &binaryWriter{}
+	w.buf.Write(encodingMagic)
+	w.writeByte(encodingFormat)
+	w.writeByte(kind)
+
+	return w
+}
+
+// writeByte appends a single byte.
+func (w *binaryWriter) writeByte(v byte) {
+	w.buf.WriteByte(v)
+}
+
+// writeUint32 appends a 4 byte little-endian integer.
+func (w *binaryWriter) writeUint32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	w.buf.Write(b[:])
+}
+
+// writeInt64 appends an 8 byte little-endian integer.
+func (w *binaryWriter) writeInt64(v int64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	w.buf.Write(b[:])
+}
+
+// writeVarInt appends an unsigned varint.
+func (w *binaryWriter) writeVarInt(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	w.buf.Write(b[:n])
+}
+
+// writeVarBytes appends a byte string prefixed by its length.
+func (w *binaryWriter) writeVarBytes(data []byte) {
+	w.writeVarInt(uint64(len(data)))
+	w.buf.Write(data)
+}
+
+// Bytes returns the encoding written so far.
+func (w *binaryWriter) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// binaryReader decodes the binary encoding written by binaryWriter. The first error is kept and
+// every later read returns zero values, so it only needs to be checked once at the end.
+type binaryReader struct {
+	data []byte
+	err  error
+}
+
+// newRecordReader returns a reader positioned after the envelope of a record of the given kind.
+func newRecordReader(data []byte, kind byte) *binaryReader {
+	r := &binaryReader{data: data}
+	if !isBinaryEncoding(data) {
+		r.fail("missing magic")
+		return r
+	}
+	r.readBytes(len(encodingMagic))
+	if format := r.readByte(); r.err == nil && format != encodingFormat {
+		r.fail(fmt.Sprintf("unknown format version %d", format))
+	}
+	if k := r.readByte(); r.err == nil && k != kind {
+		r.fail(fmt.Sprintf("record kind %d, expected %d", k, kind))
+	}
+
+	return r
+}
+
+// fail records the first decoding error.
+func (r *binaryReader) fail(reason string) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%w: %s", ErrBadEncoding, reason)
+	}
+}
+
+// readBytes consumes n bytes.
+func (r *binaryReader) readBytes(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.fail("unexpected end of data")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+
+	return b
+}
+
+// readByte consumes a single byte.
+func (r *binaryReader) readByte() byte {
+	b := r.readBytes(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+// readUint32 consumes a 4 byte little-endian integer.
+func (r *binaryReader) readUint32() uint32 {
+	b := r.readBytes(4)
+	if b == nil {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint32(b)
+}
+
+// readInt64 consumes an 8 byte little-endian integer.
+func (r *binaryReader) readInt64() int64 {
+	b := r.readBytes(8)
+	if b == nil {
+		return 0
+	}
+
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+// readVarInt consumes an unsigned varint.
+func (r *binaryReader) readVarInt() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail("bad varint")
+		return 0
+	}
+	r.data = r.data[n:]
+
+	return v
+}
+
+// readCount consumes the number of elements of a list, each taking at least one byte.
+func (r *binaryReader) readCount() int {
+	n := r.readVarInt()
+	if n > uint64(len(r.data)) {
+		r.fail("count exceeds the data")
+		return 0
+	}
+
+	return int(n)
+}
+
+// readVarBytes consumes a byte string prefixed by its length and returns a copy of it, or nil if it
+// is empty.
+func (r *binaryReader) readVarBytes() []byte {
+	n := r.readVarInt()
+	if n > uint64(len(r.data)) {
+		r.fail("length exceeds the data")
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+
+	return append([]byte{}, r.readBytes(int(n))...)
+}
+
+// finish returns the first decoding error, or an error if data is left over.
+func (r *binaryReader) finish() error {
+	if r.err == nil && len(r.data) > 0 {
+		r.fail(fmt.Sprintf("%d trailing bytes", len(r.data)))
+	}
+
+	return r.err
+}
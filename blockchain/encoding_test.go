@@ -0,0 +1,101 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionEncoding(t *testing.T) {
+	tx := Transaction{TxVersion, nil, []TxInput{{[]byte{1, 2, 3}, 1, []byte{OP_1}, MaxSequence}}, []TxOutput{{9, []byte{OP_1}}}, 7}
+	tx.ID = tx.Hash()
+
+	data := tx.Serialize()
+	assert.Equal(t, "b163686e0102010000000103010203010000000151ffffffff010900000000000000015107000000", hex.EncodeToString(data), "Encoding follows the documented layout")
+	assert.Equal(t, "dd29985296894168d2289a9c637c9fecff6d78eec363cd736ef5f28b9d129426", hex.EncodeToString(tx.ID), "ID hashes the encoding without unlocking scripts")
+	decoded := DeserializeTransaction(data)
+	assert.Equal(t, tx.ID, decoded.ID, "ID is derived from the encoding")
+	assert.Equal(t, data, decoded.Serialize(), "Transaction survives the round trip")
+
+	// Transactions stored in gob keep their recorded ID
+	var legacy bytes.Buffer
+	assert.NoError(t, gob.NewEncoder(&legacy).Encode(Transaction{LegacyTxVersion, []byte("recorded"), tx.Inputs, tx.Outputs, 0}))
+	decoded = DeserializeTransaction(legacy.Bytes())
+	assert.Equal(t, []byte("recorded"), decoded.Hash(), "Legacy ID is kept")
+	assert.Equal(t, decoded, DeserializeTransaction(decoded.Serialize()), "Legacy transaction is converted")
+
+	assert.Panics(t, func() { DeserializeTransaction(data[:len(data)-1]) }, "Truncated record is rejected")
+	assert.Panics(t, func() { DeserializeTransaction(append(data, 0)) }, "Trailing bytes are rejected")
+	assert.Panics(t, func() { Deserialize(data) }, "Record kind is checked")
+
+	// Transactions from peers must be in the binary encoding
+	received, err := DeserializeTx(data)
+	assert.NoError(t, err)
+	assert.Equal(t, tx.ID, received.ID)
+	for name, bad := range map[string][]byte{"gob": legacy.Bytes(), "truncated": data[:len(data)-1], "trailing bytes": append(data, 0)} {
+		_, err := DeserializeTx(bad)
+		assert.True(t, errors.Is(err, ErrBadEncoding), name)
+	}
+}
+
+func TestBlockEncoding(t *testing.T) {
+	tx := CoinbaseTx("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", "data", 20)
+	header := BlockHeader{blockVersion, bytes.Repeat([]byte{1}, hashLength), nil, 1700000000, powLimitBits, 42}
+	block := &Block{header, nil, []*Transaction{tx}, 5}
+	block.MerkleRoot = block.HashTransactions()
+	block.Hash = block.BlockHeader.Hash()
+
+	decoded := Deserialize(block.Serialize())
+	assert.Equal(t, block.Hash, decoded.Hash, "Hash is derived from the header")
+	assert.Equal(t, 5, decoded.Height)
+	assert.Equal(t, tx.ID, decoded.Transactions[0].ID)
+	assert.Equal(t, block.Serialize(), decoded.Serialize(), "Block survives the round trip")
+
+	// Blocks from peers must be in the binary encoding
+	var legacy bytes.Buffer
+	assert.NoError(t, gob.NewEncoder(&legacy).Encode(block))
+	_, err := DeserializeBlock(legacy.Bytes())
+	assert.True(t, errors.Is(err, ErrBadEncoding), "Gob block is rejected")
+	_, err = DeserializeBlock(block.Serialize()[:40])
+	assert.True(t, errors.Is(err, ErrBadEncoding), "Truncated block is rejected")
+
+	outs := TxOutputs{tx.Outputs, []int{3}, 5, true}
+	assert.Equal(t, outs, DeserializeOutputs(outs.Serialize()), "Outputs survive the round trip")
+}
+
+func TestIndexRecordEncoding(t *testing.T) {
+	header := BlockHeader{blockVersion, bytes.Repeat([]byte{1}, hashLength), bytes.Repeat([]byte{2}, hashLength), 1700000000, powLimitBits, 42}
+	entry := headerEntry{header, 7}
+	decodedEntry, err := deserializeHeaderEntry(entry.serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, entry, *decodedEntry, "Block index entry survives the round trip")
+	_, err = deserializeHeaderEntry(entry.serialize()[:20])
+	assert.True(t, errors.Is(err, ErrBadEncoding), "Truncated block index entry is rejected")
+
+	undo := BlockUndo{[]UTXOEntry{{[]byte{1}, 2, TxOutput{3, []byte{OP_1}}, 4, true}, {[]byte{5}, 0, TxOutput{6, nil}, 0, false}}}
+	assert.Equal(t, undo, DeserializeUndo(undo.Serialize()), "Undo record survives the round trip")
+
+	loc := TxLocation{[]byte{1, 2}, 3}
+	assert.Equal(t, loc, DeserializeTxLocation(loc.Serialize()), "Transaction location survives the round trip")
+
+	event := AddressEvent{[]byte{1}, []byte{2}, []byte{3}, 4, 5, true, 6}
+	decodedEvent, err := DeserializeAddressEvent(event.Serialize())
+	assert.NoError(t, err)
+	assert.Equal(t, event, decodedEvent, "Address event survives the round trip")
+	_, err = DeserializeAddressEvent(event.Serialize()[:10])
+	assert.True(t, errors.Is(err, ErrBadEncoding), "Truncated address event is rejected")
+
+	// Records stored in gob by earlier versions are still read
+	var legacy bytes.Buffer
+	assert.NoError(t, gob.NewEncoder(&legacy).Encode(entry))
+	decodedEntry, err = deserializeHeaderEntry(legacy.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, entry, *decodedEntry)
+	legacy.Reset()
+	assert.NoError(t, gob.NewEncoder(&legacy).Encode(undo))
+	assert.Equal(t, undo, DeserializeUndo(legacy.Bytes()))
+}
@@ -0,0 +1,359 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	blockVersion          = 3                            // Version of the block format produced by this node
+	legacyBlockVersion    = 1                            // Version given to the blocks of the first versions by migratedb
+	minBlockVersion       = 2                            // Version 1 blocks hold transactions whose gob encodings cannot be checked
+	hardenedMerkleVersion = 3                            // First block version committing to a hardened Merkle tree
+	hashLength            = 32                           // Length of block and transaction hashes in bytes
+	HeaderLength          = 4 + 2*hashLength + 8 + 4 + 8 // Length of a serialized block header in bytes
+)
+
+var (
+	headerPrefix  = []byte("hdr-") // Prefix for the block index entry of every known header
+	bestHeaderKey = []byte("bh")   // Key holding the hash of the header with the most work
+)
+
+// BlockHeader holds the fields of a block that are covered by its proof of work.
+type BlockHeader struct {
+	Version    int32  // Version of the block format
+	PrevHash   []byte // Hash of the previous block in the chain
+	MerkleRoot []byte // Root of the Merkle tree of the block transactions
+	Timestamp  int64  // Timestamp of block creation
+	Bits       uint32 // Compact representation of the proof-of-work target
+	Nonce      int    // Nonce used for mining (Proof of Work)
+}
+
+// headerEntry is the block index record kept for every known header.
+type headerEntry struct {
+	Header BlockHeader // The header itself
+	Height int         // Height of the block in the blockchain
+}
+
+// serialize encodes the block index entry in the binary encoding.
+func (entry headerEntry) serialize() []byte {
+	w := newRecordWriter(headerRecord)
+	w.buf.Write(entry.Header.Serialize())
+	w.writeVarInt(uint64(entry.Height))
+
+	return w.Bytes()
+}
+
+// deserializeHeaderEntry decodes a block index entry. Entries written in gob by earlier versions
+// are still read.
+func deserializeHeaderEntry(data []byte) (*headerEntry, error) {
+	var entry headerEntry
+
+	if !isBinaryEncoding(data) {
+		decoder := gob.NewDecoder(bytes.NewReader(data))
+		err := decoder.Decode(&entry)
+		return &entry, err
+	}
+
+	r := newRecordReader(data, headerRecord)
+	header, err := DeserializeHeader(r.readBytes(HeaderLength))
+	if r.err == nil && err != nil {
+		return nil, err
+	}
+	entry.Height = int(r.readVarInt())
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+	entry.Header = *header
+
+	return &entry, nil
+}
+
+// Serialize encodes the header into its fixed-size binary form, which is what gets hashed.
+func (h *BlockHeader) Serialize() []byte {
+	var buff bytes.Buffer
+
+	err := binary.Write(&buff, binary.BigEndian, h.Version)
+	Handle(err)
+	buff.Write(padHash(h.PrevHash))   // The genesis block has an all-zero previous hash
+	buff.Write(padHash(h.MerkleRoot)) // Merkle root of the transactions
+	err = binary.Write(&buff, binary.BigEndian, h.Timestamp)
+	Handle(err)
+	err = binary.Write(&buff, binary.BigEndian, h.Bits)
+	Handle(err)
+	err = binary.Write(&buff, binary.BigEndian, int64(h.Nonce))
+	Handle(err)
+
+	return buff.Bytes()
+}
+
+// DeserializeHeader decodes a header from its fixed-size binary form.
+func DeserializeHeader(data []byte) (*BlockHeader, error) {
+	if len(data) != HeaderLength {
+		return nil, fmt.Errorf("header must be %d bytes, got %d", HeaderLength, len(data))
+	}
+
+	header := &BlockHeader{}
+	header.Version = int32(binary.BigEndian.Uint32(data[0:4]))
+	header.PrevHash = append([]byte{}, data[4:4+hashLength]...)
+	header.MerkleRoot = append([]byte{}, data[4+hashLength:4+2*hashLength]...)
+	rest := data[4+2*hashLength:]
+	header.Timestamp = int64(binary.BigEndian.Uint64(rest[0:8]))
+	header.Bits = binary.BigEndian.Uint32(rest[8:12])
+	header.Nonce = int(binary.BigEndian.Uint64(rest[12:20]))
+
+	// An all-zero previous hash marks the genesis block
+	if bytes.Equal(header.PrevHash, make([]byte, hashLength)) {
+		header.PrevHash = []byte{}
+	}
+
+	return header, nil
+}
+
+// Hash returns the hash of the serialized header, which identifies the block.
+func (h *BlockHeader) Hash() []byte {
+	hash := sha256.Sum256(h.Serialize())
+
+	return hash[:]
+}
+
+// padHash returns a hash stretched to the full hash length.
+func padHash(hash []byte) []byte {
+	padded := make([]byte, hashLength)
+	copy(padded, hash)
+
+	return padded
+}
+
+// headerKey builds the database key holding the block index entry of a header.
+func headerKey(hash []byte) []byte {
+	return append(append([]byte{}, headerPrefix...), hash...)
+}
+
+// readHeader loads the block index entry of a header inside a database transaction.
+func readHeader(txn *badger.Txn, hash []byte) (*headerEntry, error) {
+	item, err := txn.Get(headerKey(hash))
+	if err != nil {
+		return nil, err
+	}
+	entryData, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	return deserializeHeaderEntry(entryData)
+}
+
+// writeHeader stores the block index entry of a header and its cumulative work.
+func writeHeader(txn *badger.Txn, hash []byte, entry headerEntry, work *big.Int) error {
+	if err := txn.Set(headerKey(hash), entry.serialize()); err != nil {
+		return err
+	}
+	if err := txn.Set(workKey(hash), work.Bytes()); err != nil {
+		return err
+	}
+
+	// Remembering the header with the most work seen so far
+	if item, err := txn.Get(bestHeaderKey); err == nil {
+		bestHash, err := item.Value()
+		if err != nil {
+			return err
+		}
+		if bestWork, ok := chainWork(txn, bestHash); ok && bestWork.Cmp(work) >= 0 {
+			return nil
+		}
+	}
+
+	return txn.Set(bestHeaderKey, hash)
+}
+
+// addHeader validates a header against its parent and adds it to the block index.
+// Headers that are already indexed are returned as they are.
+func addHeader(txn *badger.Txn, header *BlockHeader) (*headerEntry, error) {
+	hash := header.Hash()
+	if entry, err := readHeader(txn, hash); err == nil {
+		return entry, nil
+	}
+
+	if hasInvalidAncestor(txn, header.PrevHash) {
+		return nil, ErrInvalidAncestor
+	}
+	if err := checkHeaderSanity(header); err != nil {
+		return nil, err
+	}
+
+	parent, err := readHeader(txn, header.PrevHash)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrUnknownParent
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := checkHeaderContext(txn, header, parent); err != nil {
+		return nil, err
+	}
+
+	parentWork, ok := chainWork(txn, header.PrevHash)
+	if !ok {
+		return nil, errors.New("Work of the parent header is unknown")
+	}
+	work := new(big.Int).Add(parentWork, NewProof(header).Work())
+
+	entry := headerEntry{*header, parent.Height + 1}
+	if err := writeHeader(txn, hash, entry, work); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// AddHeaders validates headers received ahead of their blocks and adds them to the block index.
+// The headers must be ordered so that every parent comes before its children.
+func (chain *BlockChain) AddHeaders(headers []*BlockHeader) error {
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		for _, header := range headers {
+			if len(header.PrevHash) == 0 {
+				continue // The genesis header is always known
+			}
+			if _, err := addHeader(txn, header); err != nil {
+				return &BlockError{header.Hash(), err}
+			}
+		}
+		return nil
+	})
+}
+
+// BlockLocator returns hashes of the best header chain, dense near the tip and
+// exponentially sparser towards the genesis block, for a peer to find the fork point.
+func (chain *BlockChain) BlockLocator() [][]byte {
+	var locator [][]byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(bestHeaderKey)
+		if err != nil {
+			return err
+		}
+		hash, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		step := 1
+		for {
+			locator = append(locator, hash)
+
+			// Stepping back, doubling the distance after the first ten hashes
+			if len(locator) > 10 {
+				step *= 2
+			}
+			for i := 0; i < step; i++ {
+				entry, err := readHeader(txn, hash)
+				if err != nil {
+					return err
+				}
+				if len(entry.Header.PrevHash) == 0 {
+					// Always ending with the genesis block
+					if i > 0 {
+						locator = append(locator, hash)
+					}
+					return nil
+				}
+				hash = entry.Header.PrevHash
+			}
+		}
+	})
+	Handle(err)
+
+	return locator
+}
+
+// FindHeaders returns up to max headers of the best chain following the first
+// locator hash that is part of it, oldest first.
+func (chain *BlockChain) FindHeaders(locator [][]byte, max int) []*BlockHeader {
+	var headers []*BlockHeader
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		// Finding the first locator hash on the best chain, defaulting to the genesis block
+		height := 0
+		for _, hash := range locator {
+			entry, err := readHeader(txn, hash)
+			if err != nil {
+				continue // Unknown to this node
+			}
+			if indexed, err := hashAtHeight(txn, entry.Height); err == nil && bytes.Equal(indexed, hash) {
+				height = entry.Height + 1
+				break
+			}
+		}
+
+		for ; len(headers) < max; height++ {
+			hash, err := hashAtHeight(txn, height)
+			if err != nil {
+				break // Past the tip
+			}
+			entry, err := readHeader(txn, hash)
+			if err != nil {
+				return err
+			}
+			header := entry.Header
+			headers = append(headers, &header)
+		}
+		return nil
+	})
+	Handle(err)
+
+	return headers
+}
+
+// MissingBlocks returns the hashes of blocks on the best header chain whose bodies
+// have not been received yet, oldest first.
+func (chain *BlockChain) MissingBlocks() [][]byte {
+	var missing [][]byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(bestHeaderKey)
+		if err != nil {
+			return err
+		}
+		hash, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		// Walking back until a block whose body is stored
+		for {
+			if _, err := txn.Get(hash); err == nil {
+				break
+			}
+			missing = append(missing, hash)
+
+			entry, err := readHeader(txn, hash)
+			if err != nil {
+				return err
+			}
+			hash = entry.Header.PrevHash
+		}
+		return nil
+	})
+	Handle(err)
+
+	for i, j := 0, len(missing)-1; i < j; i, j = i+1, j-1 {
+		missing[i], missing[j] = missing[j], missing[i]
+	}
+
+	return missing
+}
+
+// indexGenesis adds the genesis block to the block index.
+func indexGenesis(txn *badger.Txn, genesis *Block) error {
+	work := NewProof(&genesis.BlockHeader).Work()
+
+	return writeHeader(txn, genesis.Hash, headerEntry{genesis.BlockHeader, 0}, work)
+}
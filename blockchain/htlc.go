@@ -0,0 +1,146 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+)
+
+const htlcSecretSize = 32 // Size of the secret of a hash time-locked contract
+
+// HTLC is a hash time-locked contract: the recipient can spend the output by revealing the secret
+// hashing to SecretHash, and the refund key can take it back once LockTime has passed.
+type HTLC struct {
+	SecretHash []byte // SHA-256 hash of the secret
+	Recipient  []byte // Public key hash of the recipient
+	Refund     []byte // Public key hash of the sender, refunded after the lock time
+	LockTime   uint32 // Block height or unix time from which the refund is possible
+}
+
+// HTLCLockingScript returns the script of a hash time-locked contract. It is paid to through its
+// pay-to-script-hash address and revealed by the spender:
+//
+//	OP_IF
+//	    OP_SIZE 32 OP_EQUALVERIFY OP_SHA256 <secretHash> OP_EQUALVERIFY OP_DUP OP_HASH160 <recipient>
+//	OP_ELSE
+//	    <lockTime> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <refund>
+//	OP_ENDIF
+//	OP_EQUALVERIFY OP_CHECKSIG
+func HTLCLockingScript(htlc HTLC) []byte {
+	return NewScriptBuilder().
+		AddOp(OP_IF).
+		AddOp(OP_SIZE).AddInt(htlcSecretSize).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_SHA256).AddData(htlc.SecretHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(htlc.Recipient).
+		AddOp(OP_ELSE).
+		AddInt(int64(htlc.LockTime)).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(htlc.Refund).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).
+		Script()
+}
+
+// ExtractHTLC returns the terms of a hash time-locked contract script.
+func ExtractHTLC(script []byte) (HTLC, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 20 {
+		return HTLC{}, false
+	}
+
+	lockTime, ok := smallInt(ops[11])
+	if !ok {
+		n, err := decodeNum(ops[11].Data, maxLockNumSize)
+		if err != nil || n < 0 || n > MaxSequence {
+			return HTLC{}, false
+		}
+		lockTime = int(n)
+	}
+	htlc := HTLC{ops[5].Data, ops[9].Data, ops[16].Data, uint32(lockTime)}
+
+	// Only the exact script built from the terms is accepted
+	if len(htlc.SecretHash) != sha256.Size || len(htlc.Recipient) != 20 || len(htlc.Refund) != 20 ||
+		!bytes.Equal(HTLCLockingScript(htlc), script) {
+		return HTLC{}, false
+	}
+
+	return htlc, true
+}
+
+// HTLCAddress returns the pay-to-script-hash address of a hash time-locked contract.
+func HTLCAddress(contract []byte) []byte {
+	return wallet.ScriptHashAddress(contract)
+}
+
+// FindContractOutput returns the index of the output of a transaction paying to a contract through
+// its pay-to-script-hash address.
+func FindContractOutput(tx *Transaction, contract []byte) (int, bool) {
+	locking := PayToScriptHashScript(wallet.PublicKeyHash(contract))
+	for i, out := range tx.Outputs {
+		if bytes.Equal(out.LockingScript, locking) {
+			return i, true
+		}
+	}
+
+	return 0, false
+}
+
+// ExtractHTLCSecret returns the secret revealed by an input redeeming a hash time-locked contract.
+func ExtractHTLCSecret(in TxInput, secretHash []byte) ([]byte, bool) {
+	ops, err := parseScript(in.UnlockingScript)
+	if err != nil {
+		return nil, false
+	}
+	for _, op := range ops {
+		hash := sha256.Sum256(op.Data)
+		if len(op.Data) == htlcSecretSize && bytes.Equal(hash[:], secretHash) {
+			return op.Data, true
+		}
+	}
+
+	return nil, false
+}
+
+// NewHTLCTransaction creates a transaction spending the output of a contract transaction to the
+// wallet. Given a secret it redeems the contract, without one it claims the refund, which can only
+// be mined once the lock time of the contract has passed.
+func NewHTLCTransaction(w *wallet.Wallet, contract []byte, contractTx *Transaction, secret []byte, fee int) (*Transaction, error) {
+	htlc, ok := ExtractHTLC(contract)
+	if !ok {
+		return nil, errors.New("not a hash time-locked contract")
+	}
+	out, ok := FindContractOutput(contractTx, contract)
+	if !ok {
+		return nil, errors.New("transaction does not pay to the contract")
+	}
+	value := contractTx.Outputs[out].Value
+	if value <= fee {
+		return nil, fmt.Errorf("contract output of %d does not cover the fee", value)
+	}
+
+	// The signature and public key are filled in by signing
+	unlocking := NewScriptBuilder().AddOp(OP_0).AddOp(OP_0)
+	lockTime, sequence := uint32(0), uint32(MaxSequence)
+	if secret != nil {
+		hash := sha256.Sum256(secret)
+		if !bytes.Equal(hash[:], htlc.SecretHash) {
+			return nil, errors.New("secret does not match the contract")
+		}
+		unlocking.AddData(secret).AddOp(OP_1)
+	} else {
+		unlocking.AddOp(OP_0)
+		lockTime, sequence = htlc.LockTime, MaxSequence-1 // Enabling the lock time checked by the contract
+	}
+	unlocking.AddData(contract) // Revealing the contract
+
+	input := TxInput{contractTx.ID, out, unlocking.Script(), sequence}
+	output := NewTXOutput(value-fee, string(w.Address()))
+
+	tx := Transaction{TxVersion, nil, []TxInput{input}, []TxOutput{*output}, lockTime}
+	tx.ID = tx.Hash()
+	tx.Sign(w.PrivateKey, map[string]Transaction{fmt.Sprintf("%x", contractTx.ID): *contractTx})
+
+	return &tx, nil
+}
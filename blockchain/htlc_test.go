@@ -0,0 +1,64 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTLCScript(t *testing.T) {
+	secret := bytes.Repeat([]byte{7}, htlcSecretSize)
+	secretHash := sha256.Sum256(secret)
+	htlc := HTLC{secretHash[:], wallet.PublicKeyHash([]byte("key")), wallet.PublicKeyHash([]byte("key")), 150}
+	contract := HTLCLockingScript(htlc)
+	locking := PayToScriptHashScript(wallet.PublicKeyHash(contract))
+
+	redeem := func(secret []byte) []byte {
+		return NewScriptBuilder().AddData([]byte("sig")).AddData([]byte("key")).AddData(secret).AddOp(OP_1).AddData(contract).Script()
+	}
+	refund := NewScriptBuilder().AddData([]byte("sig")).AddData([]byte("key")).AddOp(OP_0).AddData(contract).Script()
+
+	before, after := fakeChecker{149, 0}, fakeChecker{150, 0}
+	assert.NoError(t, VerifyScript(redeem(secret), locking, before), "Secret redeems before the lock time")
+	assert.Error(t, VerifyScript(redeem(bytes.Repeat([]byte{8}, htlcSecretSize)), locking, before), "Wrong secret fails")
+	assert.Error(t, VerifyScript(refund, locking, before), "Refund fails before the lock time")
+	assert.NoError(t, VerifyScript(refund, locking, after), "Refund succeeds from the lock time")
+
+	// A secret of another size is refused even if it hashes to the secret hash
+	short := secret[:16]
+	shortHash := sha256.Sum256(short)
+	htlc.SecretHash = shortHash[:]
+	contract = HTLCLockingScript(htlc)
+	locking = PayToScriptHashScript(wallet.PublicKeyHash(contract))
+	assert.Error(t, VerifyScript(redeem(short), locking, before), "Short secret fails")
+}
+
+func TestExtractHTLC(t *testing.T) {
+	secretHash := sha256.Sum256([]byte("secret"))
+	htlc := HTLC{secretHash[:], bytes.Repeat([]byte{1}, 20), bytes.Repeat([]byte{2}, 20), 1700000000}
+	contract := HTLCLockingScript(htlc)
+
+	extracted, ok := ExtractHTLC(contract)
+	assert.True(t, ok)
+	assert.Equal(t, htlc, extracted, "Terms survive the round trip")
+
+	// Scripts differing from the template in a single place are not contracts
+	swapped := append([]byte{}, contract...)
+	swapped[0] = OP_NOTIF
+	assert.Equal(t, byte(OP_IF), contract[0])
+	nearMisses := map[string][]byte{
+		"swapped branches":   swapped,
+		"verifying checksig": append(append([]byte{}, contract[:len(contract)-1]...), OP_CHECKSIGVERIFY),
+		"trailing operation": append(append([]byte{}, contract...), OP_NOP),
+		"truncated":          contract[:len(contract)-1],
+		"short recipient":    HTLCLockingScript(HTLC{secretHash[:], bytes.Repeat([]byte{1}, 19), htlc.Refund, htlc.LockTime}),
+		"short secret hash":  HTLCLockingScript(HTLC{secretHash[:20], htlc.Recipient, htlc.Refund, htlc.LockTime}),
+	}
+	for name, script := range nearMisses {
+		_, ok := ExtractHTLC(script)
+		assert.False(t, ok, name)
+	}
+}
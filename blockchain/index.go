@@ -0,0 +1,119 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/dgraph-io/badger"
+)
+
+var heightPrefix = []byte("hgt-") // Prefix for the hash of the best chain block at each height
+
+// heightKey builds the database key holding the hash of the best chain block at a height.
+func heightKey(height int) []byte {
+	key := make([]byte, len(heightPrefix)+8)
+	copy(key, heightPrefix)
+	binary.BigEndian.PutUint64(key[len(heightPrefix):], uint64(height))
+
+	return key
+}
+
+// connectBlock applies a block to the UTXO set and the indexes as the new tip of the best chain.
+func (chain *BlockChain) connectBlock(txn *badger.Txn, block *Block) error {
+	UTXOSet := UTXOSet{Blockchain: chain}
+	if err := UTXOSet.connect(txn, block); err != nil {
+		return err
+	}
+	if txIndexEnabled(txn) {
+		if err := indexTransactions(txn, block); err != nil {
+			return err
+		}
+	}
+	if addrIndexEnabled(txn) {
+		if err := indexAddresses(txn, block); err != nil {
+			return err
+		}
+	}
+	if err := storeBlockFilter(txn, block); err != nil {
+		return err
+	}
+
+	return txn.Set(heightKey(block.Height), block.Hash)
+}
+
+// disconnectBlock removes the tip of the best chain from the UTXO set and the indexes.
+func (chain *BlockChain) disconnectBlock(txn *badger.Txn, block *Block) error {
+	if addrIndexEnabled(txn) {
+		if err := unindexAddresses(txn, block); err != nil {
+			return err
+		}
+	}
+	UTXOSet := UTXOSet{Blockchain: chain}
+	if err := UTXOSet.disconnect(txn, block); err != nil {
+		return err
+	}
+	if txIndexEnabled(txn) {
+		if err := unindexTransactions(txn, block); err != nil {
+			return err
+		}
+	}
+
+	return txn.Delete(heightKey(block.Height))
+}
+
+// indexHeights fills in the height index for the best chain, walking back from the tip
+// until a block that is already indexed is found.
+func indexHeights(txn *badger.Txn, lastHash []byte) error {
+	for hash := lastHash; len(hash) > 0; {
+		entry, err := readHeader(txn, hash)
+		if err != nil {
+			return err
+		}
+
+		if indexed, err := hashAtHeight(txn, entry.Height); err == nil && string(indexed) == string(hash) {
+			return nil
+		}
+		if err := txn.Set(heightKey(entry.Height), hash); err != nil {
+			return err
+		}
+
+		hash = entry.Header.PrevHash
+	}
+
+	return nil
+}
+
+// hashAtHeight returns the hash of the best chain block at a height inside a database transaction.
+func hashAtHeight(txn *badger.Txn, height int) ([]byte, error) {
+	item, err := txn.Get(heightKey(height))
+	if err == badger.ErrKeyNotFound {
+		return nil, errors.New("No block at this height")
+	} else if err != nil {
+		return nil, err
+	}
+
+	return item.ValueCopy(nil)
+}
+
+// GetBlockHashByHeight returns the hash of the best chain block at a height.
+func (chain *BlockChain) GetBlockHashByHeight(height int) ([]byte, error) {
+	var hash []byte
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		hash, err = hashAtHeight(txn, height)
+		return err
+	})
+
+	return hash, err
+}
+
+// GetBlockByHeight returns the best chain block at a height.
+func (chain *BlockChain) GetBlockByHeight(height int) (Block, error) {
+	hash, err := chain.GetBlockHashByHeight(height)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return chain.GetBlock(hash)
+}
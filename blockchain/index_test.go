@@ -0,0 +1,69 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+)
+
+// bestChainHashes returns the hashes of the height index from the genesis block up to a height.
+func bestChainHashes(t *testing.T, chain *BlockChain, height int) [][]byte {
+	var hashes [][]byte
+	for h := 0; h <= height; h++ {
+		hash, err := chain.GetBlockHashByHeight(h)
+		assert.NoError(t, err)
+		hashes = append(hashes, hash)
+	}
+
+	return hashes
+}
+
+func TestHeightIndex(t *testing.T) {
+	chain, w := newTestChain(t)
+	genesis := tip(t, chain)
+	first := extendChain(t, chain, genesis, 1, string(w.Address()))
+	last := extendChain(t, chain, first, 2, string(w.Address()))
+
+	hashes := bestChainHashes(t, chain, 3)
+	assert.Equal(t, genesis.Hash, hashes[0])
+	assert.Equal(t, first.Hash, hashes[1])
+	assert.Equal(t, last.Hash, hashes[3])
+	assert.Equal(t, last.PrevHash, hashes[2])
+
+	block, err := chain.GetBlockByHeight(3)
+	assert.NoError(t, err)
+	assert.Equal(t, last.Hash, block.Hash)
+	assert.Equal(t, 3, block.Height)
+	_, err = chain.GetBlockHashByHeight(4)
+	assert.Error(t, err, "No block above the tip")
+	_, err = chain.GetBlockByHeight(4)
+	assert.Error(t, err)
+
+	// A heavier branch replaces the heights above the fork point
+	branch := extendChain(t, chain, first, 3, string(wallet.MakeWallet().Address()))
+	assert.Equal(t, branch.Hash, chain.LastHash)
+	branchHashes := bestChainHashes(t, chain, 4)
+	assert.Equal(t, hashes[:2], branchHashes[:2], "Heights up to the fork point are kept")
+	assert.NotEqual(t, hashes[2], branchHashes[2])
+	assert.Equal(t, branch.Hash, branchHashes[4])
+
+	// Databases created before the index existed get it filled in from the tip
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		for h := 1; h <= 4; h++ {
+			if err := txn.Delete(heightKey(h)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	_, err = chain.GetBlockHashByHeight(1)
+	assert.Error(t, err)
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return indexHeights(txn, chain.LastHash)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, branchHashes, bestChainHashes(t, chain, 4))
+}
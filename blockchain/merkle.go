@@ -2,9 +2,20 @@ package blockchain
 
 import (
 	"crypto/sha256"
+	"errors"
 	"log"
 )
 
+// Prefixes separating the hashes of leaves from those of inner nodes in the hardened tree, so a
+// pair of hashes can never pass for a leaf.
+const (
+	merkleLeafPrefix = 0x00
+	merkleNodePrefix = 0x01
+)
+
+// ErrDuplicateLeaf is returned when the data of a hardened Merkle tree holds the same leaf twice.
+var ErrDuplicateLeaf = errors.New("merkle tree data contains a leaf twice")
+
 // MerkleTree represents a Merkle tree for efficient and secure verification of large data structures.
 type MerkleTree struct {
 	RootNode *MerkleNode // The root node of the Merkle tree
@@ -17,6 +28,13 @@ type MerkleNode struct {
 	Data  []byte      // Data hash stored in the node
 }
 
+// MerkleProof is the path from a leaf of a Merkle tree to its root: the sibling hash at every level
+// and whether the sibling is on the right.
+type MerkleProof struct {
+	Siblings [][]byte // Hashes of the sibling nodes, from the leaf level up
+	Right    []bool   // Whether each sibling is the right child of its parent
+}
+
 // NewMerkleNode creates a new Merkle tree node from left and right child nodes and the node's data.
 func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	node := MerkleNode{}
@@ -37,6 +55,20 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &node
 }
 
+// newHardenedNode creates a node of the hardened tree, hashing a leaf as SHA-256(0x00 || data) and
+// an inner node as SHA-256(0x01 || left || right).
+func newHardenedNode(left, right *MerkleNode, data []byte) *MerkleNode {
+	var preimage []byte
+	if left == nil && right == nil {
+		preimage = append([]byte{merkleLeafPrefix}, data...)
+	} else {
+		preimage = append(append([]byte{merkleNodePrefix}, left.Data...), right.Data...)
+	}
+	hash := sha256.Sum256(preimage)
+
+	return &MerkleNode{left, right, hash[:]}
+}
+
 // NewMerkleTree creates a new Merkle tree using a slice of data.
 func NewMerkleTree(data [][]byte) *MerkleTree {
 	var nodes []MerkleNode
@@ -73,3 +105,131 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 
 	return &tree
 }
+
+// NewHardenedMerkleTree creates a Merkle tree whose leaves and inner nodes are hashed with distinct
+// prefixes. The last node of an odd level moves up unchanged instead of being paired with itself,
+// so no two lists of data share a root, and data holding the same leaf twice is rejected.
+func NewHardenedMerkleTree(data [][]byte) (*MerkleTree, error) {
+	if len(data) == 0 {
+		return nil, errors.New("No Merkle nodes present")
+	}
+
+	seen := make(map[string]bool)
+	var nodes []*MerkleNode
+	for _, dat := range data {
+		if seen[string(dat)] {
+			return nil, ErrDuplicateLeaf
+		}
+		seen[string(dat)] = true
+		nodes = append(nodes, newHardenedNode(nil, nil, dat))
+	}
+
+	for len(nodes) > 1 {
+		var level []*MerkleNode
+		for i := 0; i+1 < len(nodes); i += 2 {
+			level = append(level, newHardenedNode(nodes[i], nodes[i+1], nil))
+		}
+		if len(nodes)%2 != 0 {
+			level = append(level, nodes[len(nodes)-1]) // The odd node has no sibling at this level
+		}
+
+		nodes = level
+	}
+
+	return &MerkleTree{nodes[0]}, nil
+}
+
+// NewMerkleProof builds the proof that the data at the given index is a leaf of the Merkle tree of
+// the data, following the same layout as NewMerkleTree.
+func NewMerkleProof(data [][]byte, index int) MerkleProof {
+	var proof MerkleProof
+	var level [][]byte
+
+	for _, dat := range data {
+		level = append(level, NewMerkleNode(nil, nil, dat).Data)
+	}
+
+	for len(level) > 1 {
+		// Duplicate the last node if the number of nodes is odd
+		if len(level)%2 != 0 {
+			level = append(level, level[len(level)-1])
+		}
+
+		// Recording the sibling of the node on the path
+		sibling := index ^ 1
+		proof.Siblings = append(proof.Siblings, level[sibling])
+		proof.Right = append(proof.Right, sibling > index)
+
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			next = append(next, NewMerkleNode(&MerkleNode{Data: level[i]}, &MerkleNode{Data: level[i+1]}, nil).Data)
+		}
+
+		level = next
+		index /= 2
+	}
+
+	return proof
+}
+
+// NewHardenedMerkleProof builds the proof that the data at the given index is a leaf of the hardened
+// Merkle tree of the data. Levels where the node has no sibling add no step to the path.
+func NewHardenedMerkleProof(data [][]byte, index int) MerkleProof {
+	var proof MerkleProof
+	var level []*MerkleNode
+
+	for _, dat := range data {
+		level = append(level, newHardenedNode(nil, nil, dat))
+	}
+
+	for len(level) > 1 {
+		if sibling := index ^ 1; sibling < len(level) {
+			proof.Siblings = append(proof.Siblings, level[sibling].Data)
+			proof.Right = append(proof.Right, sibling > index)
+		}
+
+		var next []*MerkleNode
+		for i := 0; i+1 < len(level); i += 2 {
+			next = append(next, newHardenedNode(level[i], level[i+1], nil))
+		}
+		if len(level)%2 != 0 {
+			next = append(next, level[len(level)-1])
+		}
+
+		level = next
+		index /= 2
+	}
+
+	return proof
+}
+
+// Root returns the root of the Merkle tree the proof leads to from the given leaf data.
+func (proof MerkleProof) Root(data []byte) []byte {
+	node := NewMerkleNode(nil, nil, data)
+
+	for i, sibling := range proof.Siblings {
+		if proof.Right[i] {
+			node = NewMerkleNode(node, &MerkleNode{Data: sibling}, nil)
+		} else {
+			node = NewMerkleNode(&MerkleNode{Data: sibling}, node, nil)
+		}
+	}
+
+	return node.Data
+}
+
+// HardenedRoot returns the root of the hardened Merkle tree the proof leads to from the given leaf
+// data.
+func (proof MerkleProof) HardenedRoot(data []byte) []byte {
+	node := newHardenedNode(nil, nil, data)
+
+	for i, sibling := range proof.Siblings {
+		if proof.Right[i] {
+			node = newHardenedNode(node, &MerkleNode{Data: sibling}, nil)
+		} else {
+			node = newHardenedNode(&MerkleNode{Data: sibling}, node, nil)
+		}
+	}
+
+	return node.Data
+}
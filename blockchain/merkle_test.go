@@ -1,6 +1,8 @@
 package blockchain
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"testing"
 
@@ -49,3 +51,102 @@ func TestNewMerkleNode(t *testing.T) {
 	assert.Equal(t, root, fmt.Sprintf("%x", tree.RootNode.Data), "Корень узла Меркла равен")
 
 }
+
+func TestMerkleProof(t *testing.T) {
+	for count := 1; count <= 7; count++ {
+		var data [][]byte
+		for i := 0; i < count; i++ {
+			data = append(data, []byte(fmt.Sprintf("node%d", i)))
+		}
+		root := NewMerkleTree(data).RootNode.Data
+
+		for i := range data {
+			proof := NewMerkleProof(data, i)
+			assert.Equal(t, root, proof.Root(data[i]), "Proof leads to the root")
+			assert.NotEqual(t, root, proof.Root([]byte("other")), "Proof fails for other data")
+		}
+	}
+}
+
+func TestTransactionProof(t *testing.T) {
+	var txs []*Transaction
+	for i := 0; i < 3; i++ {
+		txs = append(txs, CoinbaseTx("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", fmt.Sprintf("tx%d", i), 20))
+	}
+	block := &Block{BlockHeader{blockVersion, nil, nil, 0, powLimitBits, 0}, nil, txs, 1}
+	block.MerkleRoot = block.HashTransactions()
+
+	for i, tx := range txs {
+		proof, err := block.TransactionProof(tx.ID)
+		assert.NoError(t, err)
+
+		decoded, err := DeserializeTxProof(proof.Serialize())
+		assert.NoError(t, err)
+		assert.True(t, VerifyTransactionProof(&decoded.Header, decoded.Transaction, decoded.Proof), "Decoded proof verifies with the header")
+		assert.False(t, VerifyTransactionProof(&decoded.Header, txs[(i+1)%len(txs)], decoded.Proof), "Proof fails for another transaction")
+	}
+
+	_, err := block.TransactionProof([]byte("missing"))
+	assert.Error(t, err, "Transaction outside the block has no proof")
+}
+
+func TestHardenedMerkleTree(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		var data [][]byte
+		for i := 0; i < count; i++ {
+			data = append(data, []byte(fmt.Sprintf("node%d", i)))
+		}
+		tree, err := NewHardenedMerkleTree(data)
+		assert.NoError(t, err)
+
+		for i := range data {
+			proof := NewHardenedMerkleProof(data, i)
+			assert.Equal(t, tree.RootNode.Data, proof.HardenedRoot(data[i]), "Proof leads to the root")
+			assert.NotEqual(t, tree.RootNode.Data, proof.Root(data[i]), "Proof is hashed with prefixes")
+		}
+	}
+
+	a, b, c := []byte("a"), []byte("b"), []byte("c")
+
+	// Duplicating the last leaf of an odd level keeps the root of the plain tree
+	assert.Equal(t, NewMerkleTree([][]byte{a, b, c}).RootNode.Data, NewMerkleTree([][]byte{a, b, c, c}).RootNode.Data)
+	_, err := NewHardenedMerkleTree([][]byte{a, b, c, c})
+	assert.True(t, errors.Is(err, ErrDuplicateLeaf), "Duplicate leaf is rejected")
+	odd, _ := NewHardenedMerkleTree([][]byte{a, b, c})
+	even, _ := NewHardenedMerkleTree([][]byte{a, b, c, []byte("d")})
+	assert.NotEqual(t, odd.RootNode.Data, even.RootNode.Data)
+
+	// A leaf made of two child hashes passes for their parent in the plain tree
+	pair := NewMerkleTree([][]byte{a, b}).RootNode
+	forged := append(append([]byte{}, pair.Left.Data...), pair.Right.Data...)
+	assert.Equal(t, pair.Data, NewMerkleTree([][]byte{forged}).RootNode.Data)
+	hardenedPair, _ := NewHardenedMerkleTree([][]byte{a, b})
+	hardenedForged, _ := NewHardenedMerkleTree([][]byte{append(append([]byte{}, hardenedPair.RootNode.Left.Data...), hardenedPair.RootNode.Right.Data...)})
+	assert.NotEqual(t, hardenedPair.RootNode.Data, hardenedForged.RootNode.Data, "Leaves cannot pass for inner nodes")
+}
+
+func TestMutatedBlock(t *testing.T) {
+	var txs []*Transaction
+	for i := 0; i < 3; i++ {
+		txs = append(txs, CoinbaseTx("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", fmt.Sprintf("tx%d", i), 20))
+	}
+
+	for _, version := range []int32{2, blockVersion} {
+		block := &Block{BlockHeader{version, bytes.Repeat([]byte{1}, hashLength), nil, 1700000000, powLimitBits, 0}, nil, txs, 1}
+		block.MerkleRoot = block.HashTransactions()
+		nonce, hash := NewProof(&block.BlockHeader).Run()
+		block.Nonce, block.Hash = nonce, hash[:]
+
+		mutated := *block
+		mutated.Transactions = append(txs[:3:3], txs[2])
+		if version < hardenedMerkleVersion {
+			assert.Equal(t, block.MerkleRoot, mutated.HashTransactions(), "Version 2 root misses the duplicate")
+		} else {
+			assert.Nil(t, mutated.HashTransactions(), "Hardened tree has no root with the duplicate")
+		}
+
+		err := checkBlockSanity(&mutated)
+		assert.True(t, errors.Is(err, ErrDuplicateTx), "Duplicate transaction is rejected")
+		assert.True(t, isMutated(err), "Mutated block is not remembered as invalid")
+	}
+}
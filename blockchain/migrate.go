@@ -0,0 +1,355 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"math/big"
+	"runtime"
+
+	"github.com/dgraph-io/badger"
+)
+
+const migrateBatchSize = 1000 // Number of records rewritten per database transaction
+
+// ErrNeedsMigration is returned when a database created by an earlier version is opened before
+// migratedb has rebuilt its block index.
+var ErrNeedsMigration = errors.New("blockchain was created by an earlier version, run migratedb first")
+
+// legacyBlock is a block as the first versions stored it in gob, before blocks had a header.
+type legacyBlock struct {
+	Timestamp    int64                // Timestamp of block creation
+	Hash         []byte               // Hash of the gob encoded transactions and the nonce
+	Transactions []*legacyTransaction // Transactions included in the block
+	PrevHash     []byte               // Hash of the previous block in the chain
+	Nonce        int                  // Nonce used for mining
+	Height       int                  // Height of the block in the blockchain
+}
+
+// legacyTransaction is a transaction as the first versions stored it in gob.
+type legacyTransaction struct {
+	ID      []byte           // ID hashed from the gob encoding of the transaction
+	Inputs  []legacyTxInput  // Inputs to the transaction
+	Outputs []legacyTxOutput // Outputs from the transaction
+}
+
+// legacyTxInput is an input as the first versions stored it in gob.
+type legacyTxInput struct {
+	ID        []byte // The ID of the transaction the output is in
+	Out       int    // The index of the output in the transaction
+	Signature []byte // Signature of the spending transaction
+	PubKey    []byte // Public key of the spender, or the data of a coinbase
+}
+
+// legacyTxOutput is an output as the first versions stored it in gob.
+type legacyTxOutput struct {
+	Value      int    // The value of coins in the output
+	PubKeyHash []byte // Hash of the public key the output is locked to
+}
+
+// convert returns the transaction with the scripts the same input and output have today. It
+// keeps its recorded ID as a legacy transaction.
+func (tx *legacyTransaction) convert() *Transaction {
+	converted := &Transaction{LegacyTxVersion, tx.ID, nil, nil, 0}
+
+	for _, in := range tx.Inputs {
+		script := NewScriptBuilder()
+		if len(in.ID) == 0 && in.Out == -1 {
+			script.AddData(in.PubKey) // The data of the coinbase
+		} else {
+			script.AddData(in.Signature).AddData(in.PubKey)
+		}
+		converted.Inputs = append(converted.Inputs, TxInput{in.ID, in.Out, script.Script(), MaxSequence})
+	}
+	for _, out := range tx.Outputs {
+		converted.Outputs = append(converted.Outputs, TxOutput{out.Value, PayToPubKeyHashScript(out.PubKeyHash)})
+	}
+
+	return converted
+}
+
+// readStoredBlock decodes a block stored under its hash in any layout this node has used. The
+// second result is false if the header does not hash to the key and has to be rebuilt, which is
+// always the case for the blocks of the first versions.
+func readStoredBlock(key, value []byte) (*Block, bool) {
+	if isBinaryEncoding(value) {
+		return Deserialize(value), true
+	}
+
+	// Blocks that already had a header were stored in gob as they are today
+	if block := Deserialize(value); bytes.Equal(block.BlockHeader.Hash(), key) {
+		return block, true
+	}
+
+	var legacy legacyBlock
+	err := gob.NewDecoder(bytes.NewReader(value)).Decode(&legacy)
+	Handle(err)
+
+	header := BlockHeader{legacyBlockVersion, legacy.PrevHash, nil, legacy.Timestamp, powLimitBits, legacy.Nonce}
+	block := &Block{header, key, nil, legacy.Height}
+	for _, tx := range legacy.Transactions {
+		block.Transactions = append(block.Transactions, tx.convert())
+	}
+
+	return block, false
+}
+
+// isStoredGobBlock reports whether a record is a block stored in gob under its hash.
+func isStoredGobBlock(key, value []byte) bool {
+	if len(key) != hashLength || len(value) == 0 || isBinaryEncoding(value) {
+		return false
+	}
+
+	var legacy legacyBlock
+	err := gob.NewDecoder(bytes.NewReader(value)).Decode(&legacy)
+
+	return err == nil && bytes.Equal(legacy.Hash, key)
+}
+
+// requireMigrated fails with ErrNeedsMigration if the tip of the best chain is missing from the
+// block index, which earlier versions did not keep.
+func requireMigrated(txn *badger.Txn, lastHash []byte) error {
+	if _, err := readHeader(txn, lastHash); err == badger.ErrKeyNotFound {
+		return ErrNeedsMigration
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// MigrateBlockChain opens the blockchain of a node created by an earlier version and migrates it
+// to the current layout. It returns the number of rewritten records.
+func MigrateBlockChain(nodeId string) int {
+	path := fmt.Sprintf(dbPath, nodeId)
+	if DBexists(path) == false {
+		fmt.Println("No existing blockchain found, create one!")
+		runtime.Goexit() // Exiting if no blockchain found
+	}
+
+	// Setting up badger database options
+	opts := badger.DefaultOptions
+	opts.Dir = path
+	opts.ValueDir = path
+
+	db, err := openDB(path, opts)
+	Handle(err)
+	defer db.Close()
+
+	chain := BlockChain{nil, db}
+
+	return chain.MigrateEncoding()
+}
+
+// MigrateEncoding rewrites the blocks, unspent outputs, block index entries, undo records and index
+// entries that earlier versions stored in gob in the binary encoding and rebuilds the block index
+// and the height index of the best chain.
+//
+// The blocks of the first versions had no header and were identified by a hash of gob encodings
+// that cannot be reproduced. They get a version 1 header committing to their converted
+// transactions and a new proof of work, so the best chain gets new hashes from the first such
+// block on. Transactions keep the IDs they were recorded with, so the unspent outputs and the
+// wallets stay valid. The UTXO set is rebuilt from the blocks, as the first versions did not
+// record the position of the outputs. It returns the number of rewritten records and can be run
+// again safely.
+func (chain *BlockChain) MigrateEncoding() int {
+	// Collecting the best chain from the tip back to the genesis block
+	var keys [][]byte
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
+		hash, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		for {
+			item, err := txn.Get(hash)
+			if err != nil {
+				return err
+			}
+			value, err := item.Value()
+			if err != nil {
+				return err
+			}
+			block, _ := readStoredBlock(hash, value)
+			keys = append(keys, hash)
+
+			if len(block.PrevHash) == 0 {
+				return nil
+			}
+			hash = block.PrevHash
+		}
+	})
+	Handle(err)
+
+	count := 0
+	rekeyed := false
+	prevHash := []byte{}
+	work := new(big.Int)
+
+	// Rewriting the blocks from the genesis block on, as new hashes change the children
+	for start := len(keys) - 1; start >= 0; start -= migrateBatchSize {
+		err := chain.Database.Update(func(txn *badger.Txn) error {
+			for i := start; i >= 0 && i > start-migrateBatchSize; i-- {
+				key := keys[i]
+				item, err := txn.Get(key)
+				if err != nil {
+					return err
+				}
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+
+				block, headerOK := readStoredBlock(key, value)
+				block.Height = len(keys) - 1 - i
+				if !headerOK || rekeyed {
+					block.PrevHash = prevHash
+					if block.Bits == 0 {
+						block.Bits = powLimitBits // Headers from before the difficulty was recorded
+					}
+					if block.Version == legacyBlockVersion {
+						block.MerkleRoot = block.HashTransactions()
+					}
+					block.Nonce = 0
+					for !NewProof(&block.BlockHeader).Validate() {
+						block.Nonce++
+					}
+					block.Hash = block.BlockHeader.Hash()
+					rekeyed = true
+				}
+
+				if !bytes.Equal(block.Hash, key) {
+					if err := txn.Delete(key); err != nil {
+						return err
+					}
+					if err := txn.Delete(undoKey(key)); err != nil {
+						return err
+					}
+				}
+				if !bytes.Equal(block.Hash, key) || !isBinaryEncoding(value) {
+					if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+						return err
+					}
+					count++
+				}
+
+				// Indexing the header, its height and its compact filter
+				work.Add(work, NewProof(&block.BlockHeader).Work())
+				if err := writeHeader(txn, block.Hash, headerEntry{block.BlockHeader, block.Height}, work); err != nil {
+					return err
+				}
+				if err := txn.Set(heightKey(block.Height), block.Hash); err != nil {
+					return err
+				}
+				if err := storeBlockFilter(txn, block); err != nil {
+					return err
+				}
+				prevHash = block.Hash
+			}
+
+			// Headers of the old hashes may still be known, but no longer lead to a block
+			if rekeyed {
+				if err := txn.Set(bestHeaderKey, prevHash); err != nil {
+					return err
+				}
+			}
+
+			return txn.Set([]byte("lh"), prevHash)
+		})
+		Handle(err)
+	}
+	chain.LastHash = prevHash
+
+	// Rewriting the other records still stored in gob and dropping the gob blocks off the best chain
+	legacyOutputs := 0
+	batch := make(map[string][]byte) // Records to rewrite, nil for records to delete
+
+	writeBatch := func() {
+		err := chain.Database.Update(func(txn *badger.Txn) error {
+			for key, value := range batch {
+				if value == nil {
+					if err := txn.Delete([]byte(key)); err != nil {
+						return err
+					}
+				} else if err := txn.Set([]byte(key), value); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		Handle(err)
+		count += len(batch)
+		batch = make(map[string][]byte)
+	}
+
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			value, err := item.Value()
+			if err != nil {
+				return err
+			}
+			if len(value) == 0 || isBinaryEncoding(value) {
+				continue
+			}
+
+			key := item.KeyCopy(nil)
+			switch {
+			case bytes.HasPrefix(key, utxoPrefix):
+				legacyOutputs++
+			case bytes.HasPrefix(key, headerPrefix):
+				entry, err := deserializeHeaderEntry(value)
+				if err != nil {
+					return err
+				}
+				batch[string(key)] = entry.serialize()
+			case bytes.HasPrefix(key, undoPrefix):
+				batch[string(key)] = DeserializeUndo(value).Serialize()
+			case bytes.HasPrefix(key, txIndexPrefix):
+				batch[string(key)] = DeserializeTxLocation(value).Serialize()
+			case bytes.HasPrefix(key, addrIndexPrefix):
+				event, err := DeserializeAddressEvent(value)
+				if err != nil {
+					return err
+				}
+				batch[string(key)] = event.Serialize()
+			case isStoredGobBlock(key, value):
+				batch[string(key)] = nil
+			}
+
+			if len(batch) == migrateBatchSize {
+				writeBatch()
+			}
+		}
+
+		return nil
+	})
+	Handle(err)
+	if len(batch) > 0 {
+		writeBatch()
+	}
+
+	if legacyOutputs > 0 {
+		UTXOSet := UTXOSet{chain}
+		UTXOSet.Reindex()
+		count += legacyOutputs
+	}
+
+	// The indexes point to blocks by their hash
+	if rekeyed && chain.TxIndexEnabled() {
+		chain.ReindexTransactions()
+	}
+	if rekeyed && chain.AddrIndexEnabled() {
+		chain.ReindexAddresses()
+	}
+
+	return count
+}
@@ -0,0 +1,153 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+)
+
+// legacyHash hashes the gob encoding of a record, the way the first versions derived IDs and hashes.
+func legacyHash(t *testing.T, record interface{}) []byte {
+	var buff bytes.Buffer
+	assert.NoError(t, gob.NewEncoder(&buff).Encode(record))
+	hash := sha256.Sum256(buff.Bytes())
+
+	return hash[:]
+}
+
+func TestMigrateLegacyDatabase(t *testing.T) {
+	useTempDir(t)
+	a, b := wallet.MakeWallet(), wallet.MakeWallet()
+	aHash, bHash := wallet.PublicKeyHash(a.PublicKey), wallet.PublicKeyHash(b.PublicKey)
+	signature := bytes.Repeat([]byte{3}, 64)
+
+	// Building a chain in the layout of the first versions: the genesis block pays a, a pays 5 of
+	// it to b in block 1 and b pays 3 of those back in block 2
+	newTx := func(inputs []legacyTxInput, outputs []legacyTxOutput) *legacyTransaction {
+		tx := &legacyTransaction{[]byte{}, inputs, outputs}
+		tx.ID = legacyHash(t, tx)
+		return tx
+	}
+	coinbase := func(data string, to []byte) *legacyTransaction {
+		return newTx([]legacyTxInput{{[]byte{}, -1, nil, []byte(data)}}, []legacyTxOutput{{20, to}})
+	}
+	genesisTx := coinbase(genesisData, aHash)
+	payB := newTx([]legacyTxInput{{genesisTx.ID, 0, signature, a.PublicKey}}, []legacyTxOutput{{5, bHash}, {15, aHash}})
+	payA := newTx([]legacyTxInput{{payB.ID, 0, signature, b.PublicKey}}, []legacyTxOutput{{3, aHash}, {2, bHash}})
+
+	var blocks []*legacyBlock
+	prevHash := []byte{}
+	for height, txs := range [][]*legacyTransaction{{genesisTx}, {coinbase("one", aHash), payB}, {coinbase("two", aHash), payA}} {
+		block := &legacyBlock{time.Now().Unix() - int64(300-100*height), []byte{}, txs, prevHash, height, height}
+		block.Hash = legacyHash(t, block)
+		blocks = append(blocks, block)
+		prevHash = block.Hash
+	}
+
+	// The first versions kept the unspent outputs of a transaction without their positions
+	type legacyTxOutputs struct {
+		Outputs []legacyTxOutput
+	}
+	utxos := map[string]legacyTxOutputs{
+		string(blocks[1].Transactions[0].ID): {[]legacyTxOutput{{20, aHash}}},
+		string(blocks[2].Transactions[0].ID): {[]legacyTxOutput{{20, aHash}}},
+		string(payB.ID):                      {[]legacyTxOutput{{15, aHash}}},
+		string(payA.ID):                      {[]legacyTxOutput{{3, aHash}, {2, bHash}}},
+	}
+
+	path := fmt.Sprintf(dbPath, "legacy")
+	opts := badger.DefaultOptions
+	opts.Dir = path
+	opts.ValueDir = path
+	db, err := openDB(path, opts)
+	assert.NoError(t, err)
+	err = db.Update(func(txn *badger.Txn) error {
+		for _, block := range blocks {
+			var buff bytes.Buffer
+			assert.NoError(t, gob.NewEncoder(&buff).Encode(block))
+			assert.NoError(t, txn.Set(block.Hash, buff.Bytes()))
+		}
+		for id, outs := range utxos {
+			var buff bytes.Buffer
+			assert.NoError(t, gob.NewEncoder(&buff).Encode(outs))
+			assert.NoError(t, txn.Set(append(utxoPrefix, id...), buff.Bytes()))
+		}
+		// An undo record of a version that already kept them
+		var buff bytes.Buffer
+		assert.NoError(t, gob.NewEncoder(&buff).Encode(BlockUndo{[]UTXOEntry{{payB.ID, 0, TxOutput{5, nil}, 1, false}}}))
+		assert.NoError(t, txn.Set(undoKey(bytes.Repeat([]byte{9}, hashLength)), buff.Bytes()))
+
+		return txn.Set([]byte("lh"), prevHash)
+	})
+	assert.NoError(t, err)
+	err = db.View(func(txn *badger.Txn) error {
+		return requireMigrated(txn, prevHash)
+	})
+	assert.Equal(t, ErrNeedsMigration, err, "Legacy database has to be migrated before it is opened")
+	assert.NoError(t, db.Close())
+
+	assert.Equal(t, len(blocks)+len(utxos)+1, MigrateBlockChain("legacy"), "Every gob record is rewritten")
+	assert.Equal(t, 0, MigrateBlockChain("legacy"), "Migration can be run again")
+
+	chain := ContinueBlockChain("legacy")
+	defer chain.Database.Close()
+	assert.Equal(t, 2, chain.GetBestHeight())
+	err = chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(undoKey(bytes.Repeat([]byte{9}, hashLength)))
+		assert.NoError(t, err)
+		value, err := item.Value()
+		assert.True(t, isBinaryEncoding(value), "Undo record is in the binary encoding")
+		return err
+	})
+	assert.NoError(t, err)
+
+	for height, legacy := range blocks {
+		block, err := chain.GetBlockByHeight(height)
+		assert.NoError(t, err)
+		assert.Equal(t, int32(legacyBlockVersion), block.Version)
+		assert.True(t, NewProof(&block.BlockHeader).Validate(), "Migrated header has a proof of work")
+		assert.Equal(t, block.MerkleRoot, block.HashTransactions(), "Migrated header commits to the transactions")
+		for i, tx := range block.Transactions {
+			assert.Equal(t, legacy.Transactions[i].ID, tx.ID, "Transaction keeps its recorded ID")
+		}
+		assert.Equal(t, PayToPubKeyHashScript(legacy.Transactions[0].Outputs[0].PubKeyHash), block.Transactions[0].Outputs[0].LockingScript)
+	}
+
+	// The positions of the outputs are recovered from the blocks
+	UTXOSet := UTXOSet{chain}
+	entry, err := UTXOSet.FindOutput(payB.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 15, entry.Output.Value)
+	entry, err = UTXOSet.FindOutput(payA.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, entry.Output.Value)
+	assert.Equal(t, 20+20+15+3, unspentValue(UTXOSet, aHash))
+	assert.Equal(t, 2, unspentValue(UTXOSet, bHash))
+
+	// Migrated outputs can be spent with the keys of the wallet
+	tx := NewTransaction(b, string(a.Address()), 1, 1, 0, &UTXOSet)
+	block := chain.MineBlock([]*Transaction{CoinbaseTx(string(a.Address()), "", BlockSubsidy(3)+1), tx})
+	assert.Equal(t, 3, block.Height)
+	assert.Equal(t, block.Hash, chain.LastHash)
+	assert.Equal(t, 0, unspentValue(UTXOSet, bHash))
+
+	// The migrated chain seeds new nodes, its legacy blocks included
+	count, err := chain.ExportChain("tmp/legacy.dat")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, count)
+	imported, err := ImportBlockChain("tmp/legacy.dat", "imported")
+	assert.NoError(t, err)
+	defer imported.Database.Close()
+	assert.Equal(t, chain.LastHash, imported.LastHash)
+	importedUTXO := UTXOSet
+	importedUTXO.Blockchain = imported
+	assert.Equal(t, unspentValue(UTXOSet, aHash), unspentValue(importedUTXO, aHash))
+	assert.Equal(t, 0, unspentValue(importedUTXO, bHash))
+}
@@ -0,0 +1,58 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+)
+
+var notarizationTag = []byte("NTRZ") // Marks the null-data outputs anchoring a document hash
+
+// NotarizationReceipt proves that a document hash was anchored in a block of the best chain.
+type NotarizationReceipt struct {
+	DocHash       []byte      // SHA-256 hash of the document
+	TxID          []byte      // Transaction anchoring the hash
+	BlockHash     []byte      // Block containing the transaction
+	Height        int         // Height of the block
+	Timestamp     int64       // Time the block was mined
+	Confirmations int         // Blocks of the best chain confirming the transaction
+	MerkleRoot    []byte      // Merkle root committed to by the block header
+	Proof         MerkleProof // Path from the transaction to the Merkle root
+}
+
+// NotarizationData returns the null-data payload anchoring the hash of a document.
+func NotarizationData(docHash []byte) []byte {
+	return append(append([]byte{}, notarizationTag...), docHash...)
+}
+
+// IsNotarization checks whether a transaction anchors the hash of a document.
+func IsNotarization(tx *Transaction, docHash []byte) bool {
+	for _, out := range tx.Outputs {
+		if data, ok := ExtractNullData(out.LockingScript); ok && bytes.Equal(data, NotarizationData(docHash)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// VerifyNotarization checks that a transaction of the best chain anchors the hash of a document and
+// returns the receipt proving it, with the Merkle path checked against the block header.
+func (chain *BlockChain) VerifyNotarization(txID, docHash []byte) (NotarizationReceipt, error) {
+	block, err := chain.GetTransactionBlock(txID)
+	if err != nil {
+		return NotarizationReceipt{}, err
+	}
+
+	proof, err := block.TransactionProof(txID)
+	if err != nil {
+		return NotarizationReceipt{}, err
+	}
+	if !IsNotarization(proof.Transaction, docHash) {
+		return NotarizationReceipt{}, errors.New("Transaction does not anchor the document")
+	}
+
+	confirmations := chain.GetBestHeight() - block.Height + 1
+	receipt := NotarizationReceipt{docHash, txID, block.Hash, block.Height, block.Timestamp, confirmations, block.MerkleRoot, proof.Proof}
+
+	return receipt, nil
+}
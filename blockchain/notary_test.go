@@ -0,0 +1,47 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyNotarization(t *testing.T) {
+	chain, w := newTestChain(t)
+	UTXOSet := UTXOSet{chain}
+	genesis := tip(t, chain)
+	docHash := sha256.Sum256([]byte("document"))
+	otherHash := sha256.Sum256([]byte("other document"))
+
+	anchor := NewDataTransaction(w, NotarizationData(docHash[:]), 1, &UTXOSet)
+	assert.True(t, IsNotarization(anchor, docHash[:]))
+	assert.False(t, IsNotarization(anchor, otherHash[:]))
+	block := newTestBlock(genesis, CoinbaseTx(string(w.Address()), "", BlockSubsidy(1)+1), anchor)
+	_, err := chain.AddBlock(block)
+	assert.NoError(t, err)
+	extendChain(t, chain, block, 2, string(w.Address()))
+
+	receipt, err := chain.VerifyNotarization(anchor.ID, docHash[:])
+	assert.NoError(t, err)
+	assert.Equal(t, docHash[:], receipt.DocHash)
+	assert.Equal(t, anchor.ID, receipt.TxID)
+	assert.Equal(t, block.Hash, receipt.BlockHash)
+	assert.Equal(t, 1, receipt.Height)
+	assert.Equal(t, block.Timestamp, receipt.Timestamp)
+	assert.Equal(t, 3, receipt.Confirmations)
+	assert.Equal(t, block.MerkleRoot, receipt.MerkleRoot)
+	assert.True(t, VerifyTransactionProof(&block.BlockHeader, anchor, receipt.Proof), "Receipt proves the transaction is in the block")
+
+	chain.ReindexTransactions()
+	indexed, err := chain.VerifyNotarization(anchor.ID, docHash[:])
+	assert.NoError(t, err)
+	assert.Equal(t, receipt, indexed, "Transaction index finds the same receipt")
+
+	_, err = chain.VerifyNotarization(anchor.ID, otherHash[:])
+	assert.Error(t, err, "Transaction anchors another document")
+	_, err = chain.VerifyNotarization(block.Transactions[0].ID, docHash[:])
+	assert.Error(t, err, "Coinbase anchors nothing")
+	_, err = chain.VerifyNotarization([]byte("unknown"), docHash[:])
+	assert.Error(t, err)
+}
@@ -10,39 +10,31 @@ import (
 	"math/big"
 )
 
-const Difficulty = 12 // Difficulty defines the complexity of the mining process.
+const Difficulty = 12 // Difficulty defines the minimum complexity of the mining process in leading zero bits.
 
-// ProofOfWork represents the proof of work algorithm associated with a block.
+// ProofOfWork represents the proof of work algorithm associated with a block header.
 type ProofOfWork struct {
-	Block  *Block   // The block to which this proof of work applies.
-	Target *big.Int // The target hash for this proof of work.
+	Header *BlockHeader // The block header to which this proof of work applies.
+	Target *big.Int     // The target hash for this proof of work.
 }
 
-// NewProof creates a new proof of work for a given block.
-func NewProof(b *Block) *ProofOfWork {
-	target := big.NewInt(1)
-	// Left-shifting 1 by 256-Difficulty bits to set the target.
-	target.Lsh(target, uint(256-Difficulty))
+// NewProof creates a new proof of work for a given block header.
+func NewProof(h *BlockHeader) *ProofOfWork {
+	// Expanding the compact target stored in the header.
+	target := CompactToBig(h.Bits)
 
-	pow := &ProofOfWork{b, target}
+	pow := &ProofOfWork{h, target}
 
 	return pow
 }
 
 // InitData prepares the data for hashing to find a new nonce.
 func (pow *ProofOfWork) InitData(nonce int) []byte {
-	// Joining block data with nonce and difficulty to prepare for hashing.
-	data := bytes.Join(
-		[][]byte{
-			pow.Block.PrevHash,
-			pow.Block.HashTransactions(),
-			ToHex(int64(nonce)),
-			ToHex(int64(Difficulty)),
-		},
-		[]byte{},
-	)
-
-	return data
+	// Serializing a copy of the header carrying the nonce to try.
+	header := *pow.Header
+	header.Nonce = nonce
+
+	return header.Serialize()
 }
 
 // Run performs the proof-of-work computation.
@@ -76,8 +68,13 @@ func (pow *ProofOfWork) Run() (int, []byte) {
 func (pow *ProofOfWork) Validate() bool {
 	var intHash big.Int
 
+	// The target must be positive and no easier than the limit.
+	if pow.Target.Sign() <= 0 || pow.Target.Cmp(powLimit) > 0 {
+		return false
+	}
+
 	// Preparing and hashing the data with the block's nonce.
-	data := pow.InitData(pow.Block.Nonce)
+	data := pow.InitData(pow.Header.Nonce)
 	hash := sha256.Sum256(data)
 	intHash.SetBytes(hash[:])
 
@@ -95,3 +92,11 @@ func ToHex(num int64) []byte {
 
 	return buff.Bytes()
 }
+
+// Work returns the expected number of hashes needed to find a block meeting the target.
+func (pow *ProofOfWork) Work() *big.Int {
+	// work = 2^256 / (target + 1)
+	denominator := new(big.Int).Add(pow.Target, big.NewInt(1))
+
+	return new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), denominator)
+}
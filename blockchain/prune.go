@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	pruneBatchSize      = 100 // Number of blocks pruned per database transaction
+	pruneGCDiscardRatio = 0.5 // Share of a value log file that must be deleted records for it to be rewritten
+)
+
+var pruneHeightKey = []byte("pruneheight") // Key holding the lowest best chain height that still has its body
+
+// MinPruneDepth is the smallest number of blocks a pruning node keeps behind the tip, so it can
+// still disconnect blocks in a reorganization.
+var MinPruneDepth = 288
+
+// ErrPruned is returned when a block body that a pruning node deleted is needed.
+var ErrPruned = errors.New("block has been pruned")
+
+// pruneHeight returns the lowest best chain height whose block body is stored, 0 if nothing
+// has been pruned.
+func pruneHeight(txn *badger.Txn) (int, error) {
+	item, err := txn.Get(pruneHeightKey)
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	value, err := item.Value()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(binary.BigEndian.Uint64(value)), nil
+}
+
+// PruneHeight returns the lowest best chain height whose block body is stored, 0 if the
+// blockchain keeps every block.
+func (chain *BlockChain) PruneHeight() int {
+	height := 0
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		height, err = pruneHeight(txn)
+		return err
+	})
+	Handle(err)
+
+	return height
+}
+
+// IsPruned reports whether the body of a known block has been deleted by pruning.
+func (chain *BlockChain) IsPruned(hash []byte) bool {
+	pruned := false
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get(hash); err == nil {
+			return nil
+		}
+		if _, err := readHeader(txn, hash); err != nil {
+			return nil // Unknown blocks are missing, not pruned
+		}
+		height, err := pruneHeight(txn)
+		pruned = height > 0
+		return err
+	})
+	Handle(err)
+
+	return pruned
+}
+
+// requireAllBlocks fails on a pruned blockchain, for the operations that read every block.
+func (chain *BlockChain) requireAllBlocks() error {
+	if height := chain.PruneHeight(); height > 0 {
+		return fmt.Errorf("%w: the blockchain is pruned up to height %d", ErrPruned, height)
+	}
+
+	return nil
+}
+
+// Prune deletes the bodies and undo records of the best chain blocks more than depth blocks behind
+// the tip. Headers, the UTXO set, the indexes and the compact filters are kept. It returns the number
+// of pruned blocks. The space of the deleted records is given back by ReclaimSpace.
+func (chain *BlockChain) Prune(depth int) (int, error) {
+	if depth < MinPruneDepth {
+		return 0, fmt.Errorf("Pruning keeps at least %d blocks", MinPruneDepth)
+	}
+
+	var from, to int
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		entry, err := readHeader(txn, chain.LastHash)
+		if err != nil {
+			return err
+		}
+		from, err = pruneHeight(txn)
+		to = entry.Height - depth
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for from < to {
+		end := from + pruneBatchSize
+		if end > to {
+			end = to
+		}
+
+		err := chain.Database.Update(func(txn *badger.Txn) error {
+			for height := from; height < end; height++ {
+				hash, err := hashAtHeight(txn, height)
+				if err != nil {
+					return err
+				}
+				if err := txn.Delete(hash); err != nil {
+					return err
+				}
+				if err := txn.Delete(undoKey(hash)); err != nil {
+					return err
+				}
+			}
+
+			value := make([]byte, 8)
+			binary.BigEndian.PutUint64(value, uint64(end))
+			return txn.Set(pruneHeightKey, value)
+		})
+		if err != nil {
+			return count, err
+		}
+
+		count += end - from
+		from = end
+	}
+
+	return count, nil
+}
+
+// ReclaimSpace rewrites the value log files that are mostly records deleted by pruning and returns
+// how many were rewritten. It makes a single pass, stopping at the first file not worth rewriting.
+// Badger only lets go of a deleted record once a compaction has dropped it, which at the latest
+// happens when the database is closed.
+func (chain *BlockChain) ReclaimSpace() (int, error) {
+	count := 0
+	for {
+		err := chain.Database.RunValueLogGC(pruneGCDiscardRatio)
+		if err == badger.ErrNoRewrite || err == badger.ErrRejected {
+			return count, nil
+		} else if err != nil {
+			return count, err
+		}
+		count++
+	}
+}
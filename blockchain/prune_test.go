@@ -0,0 +1,95 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+)
+
+// dirSize returns the total size of the files in a directory.
+func dirSize(t *testing.T, dir string) int64 {
+	var size int64
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	for _, file := range files {
+		info, err := file.Info()
+		assert.NoError(t, err)
+		size += info.Size()
+	}
+
+	return size
+}
+
+func TestPrune(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer func(depth int) { MinPruneDepth = depth }(MinPruneDepth)
+	MinPruneDepth = 10
+
+	// Reopening the database with small tables and value log files, so pruned files can be dropped
+	path := fmt.Sprintf(dbPath, "test")
+	assert.NoError(t, chain.Database.Close())
+	opts := badger.DefaultOptions
+	opts.Dir = path
+	opts.ValueDir = path
+	opts.MaxTableSize = 1 << 18
+	opts.ValueLogFileSize = 1 << 20
+	opts.ValueLogMaxEntries = 10000 // Value log GC samples 1% of this many records before it rewrites a file
+	db, err := openDB(path, opts)
+	assert.NoError(t, err)
+	chain.Database = db
+
+	// Blocks with large coinbase data fill several value log files
+	block := tip(t, chain)
+	for height := 1; height <= 400; height++ {
+		data := fmt.Sprintf("%d%s", height, bytes.Repeat([]byte{'x'}, 9000))
+		block = newTestBlock(block, CoinbaseTx(string(w.Address()), data, BlockSubsidy(height)))
+		_, err := chain.AddBlock(block)
+		assert.NoError(t, err)
+	}
+
+	reopen := func() {
+		assert.NoError(t, chain.Database.Close())
+		chain.Database, err = openDB(path, opts)
+		assert.NoError(t, err)
+	}
+	reopen()
+	before := dirSize(t, path)
+	UTXOSet := UTXOSet{chain}
+	balance := unspentValue(UTXOSet, wallet.PublicKeyHash(w.PublicKey))
+
+	_, err = chain.Prune(MinPruneDepth - 1)
+	assert.Error(t, err, "Pruning keeps at least MinPruneDepth blocks")
+
+	count, err := chain.Prune(100)
+	assert.NoError(t, err)
+	assert.Equal(t, 300, count)
+	assert.Equal(t, 300, chain.PruneHeight())
+
+	hash, err := chain.GetBlockHashByHeight(299)
+	assert.NoError(t, err)
+	assert.True(t, chain.IsPruned(hash))
+	hash, err = chain.GetBlockHashByHeight(300)
+	assert.NoError(t, err)
+	assert.False(t, chain.IsPruned(hash))
+	assert.Equal(t, balance, unspentValue(UTXOSet, wallet.PublicKeyHash(w.PublicKey)), "UTXO set is kept")
+	assert.True(t, errors.Is(chain.requireAllBlocks(), ErrPruned))
+	_, err = chain.FindTransactionProofs([][]byte{wallet.PublicKeyHash(w.PublicKey)})
+	assert.True(t, errors.Is(err, ErrPruned), "Pruned node cannot prove the older transactions")
+
+	count, err = chain.Prune(100)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count, "Pruning again deletes nothing")
+
+	// Closing compacts the deleted records away, so their space can be reclaimed after the restart
+	reopen()
+	files, err := chain.ReclaimSpace()
+	assert.NoError(t, err)
+	assert.Greater(t, files, 0)
+	assert.Less(t, dirSize(t, path), before*3/4, "Value log space of the pruned blocks is reclaimed")
+}
@@ -0,0 +1,251 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	workPrefix   = []byte("work-")   // Prefix for the cumulative work of each block
+	orphanPrefix = []byte("orphan-") // Prefix for blocks waiting for their parent
+)
+
+// MaxOrphanBlocks is the number of blocks kept waiting for their parent. A new orphan evicts a
+// random one once the pool is full, so peers cannot fill the database with blocks that never connect.
+var MaxOrphanBlocks = 100
+
+// MaxReorgDepth is the largest number of blocks a reorganization may disconnect. The whole switch
+// is written in one database transaction, so deeper branches are refused rather than risking a
+// transaction too big to commit.
+var MaxReorgDepth = 100
+
+// ErrReorgTooDeep is returned when a heavier branch forks off more than MaxReorgDepth blocks back.
+var ErrReorgTooDeep = errors.New("reorganization is deeper than MaxReorgDepth")
+
+// TipChange describes how the best chain moved after a block was added.
+type TipChange struct {
+	Disconnected []*Block // Blocks removed from the best chain, starting from the old tip
+	Connected    []*Block // Blocks added to the best chain, ending with the new tip
+}
+
+// workKey builds the database key holding the cumulative work of a block.
+func workKey(hash []byte) []byte {
+	return append(append([]byte{}, workPrefix...), hash...)
+}
+
+// orphanKey builds the database key linking an orphan block to its missing parent.
+func orphanKey(parent, hash []byte) []byte {
+	return append(append(append([]byte{}, orphanPrefix...), parent...), hash...)
+}
+
+// readBlock loads a block by its hash inside a database transaction.
+func readBlock(txn *badger.Txn, hash []byte) (*Block, error) {
+	item, err := txn.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	blockData, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	return Deserialize(blockData), nil
+}
+
+// chainWork returns the cumulative work of the chain ending at the given header.
+// Missing work records are computed from the indexed ancestors and stored. The second
+// result is false if the header is not in the block index.
+func chainWork(txn *badger.Txn, hash []byte) (*big.Int, bool) {
+	var path [][]byte
+	var headers []*BlockHeader
+	work := new(big.Int)
+
+	// Walking back until a header with known work or the genesis block is reached
+	for current := hash; ; {
+		if item, err := txn.Get(workKey(current)); err == nil {
+			workData, err := item.Value()
+			Handle(err)
+			work.SetBytes(workData)
+			break
+		}
+
+		entry, err := readHeader(txn, current)
+		if err != nil {
+			return nil, false
+		}
+		path = append(path, current)
+		headers = append(headers, &entry.Header)
+
+		if len(entry.Header.PrevHash) == 0 {
+			break
+		}
+		current = entry.Header.PrevHash
+	}
+
+	// Accumulating the work forward and remembering it for every header on the way
+	for i := len(path) - 1; i >= 0; i-- {
+		work.Add(work, NewProof(headers[i]).Work())
+		err := txn.Set(workKey(path[i]), work.Bytes())
+		Handle(err)
+	}
+
+	return new(big.Int).Set(work), true
+}
+
+// hasFullChain reports whether the block and all of its ancestors have their bodies stored.
+func hasFullChain(txn *badger.Txn, hash []byte) bool {
+	if _, err := txn.Get(hash); err != nil {
+		return false
+	}
+	entry, err := readHeader(txn, hash)
+	if err != nil {
+		return false
+	}
+
+	// Bodies waiting for their parent are kept as orphans
+	_, err = txn.Get(orphanKey(entry.Header.PrevHash, hash))
+	return err == badger.ErrKeyNotFound
+}
+
+// addOrphan keeps a stored block aside until the body of its parent arrives. Evicted orphans lose
+// their body and are accepted again if they are sent later.
+func addOrphan(txn *badger.Txn, block *Block) error {
+	var keys [][]byte
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	for it.Seek(orphanPrefix); it.ValidForPrefix(orphanPrefix); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+
+	for len(keys) > 0 && len(keys) >= MaxOrphanBlocks {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(keys))))
+		if err != nil {
+			return err
+		}
+		i := int(n.Int64())
+		if err := txn.Delete(keys[i]); err != nil {
+			return err
+		}
+		if err := txn.Delete(keys[i][len(orphanPrefix)+hashLength:]); err != nil {
+			return err
+		}
+		keys = append(keys[:i], keys[i+1:]...)
+	}
+
+	return txn.Set(orphanKey(block.PrevHash, block.Hash), []byte{})
+}
+
+// takeOrphans removes and returns the stored blocks waiting for the given parent.
+func takeOrphans(txn *badger.Txn, parent []byte) ([]*Block, error) {
+	var keys [][]byte
+	prefix := orphanKey(parent, nil)
+
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	it.Close()
+
+	var orphans []*Block
+	for _, key := range keys {
+		block, err := readBlock(txn, key[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		if err := txn.Delete(key); err != nil {
+			return nil, err
+		}
+		orphans = append(orphans, block)
+	}
+
+	return orphans, nil
+}
+
+// dropOrphans deletes an orphan that broke a rule once its parent arrived, with every orphan
+// descending from it.
+func dropOrphans(txn *badger.Txn, block *Block) error {
+	queue := []*Block{block}
+	for len(queue) > 0 {
+		current := queue[0]
+		queue = queue[1:]
+
+		if err := txn.Delete(current.Hash); err != nil {
+			return err
+		}
+		children, err := takeOrphans(txn, current.Hash)
+		if err != nil {
+			return err
+		}
+		queue = append(queue, children...)
+	}
+
+	return nil
+}
+
+// reorganize moves the best chain from the block with hash lastHash to newTip. Blocks of the old
+// branch are disconnected from the UTXO set and the indexes back to the fork point, then the new
+// branch is connected. The in-memory tip is left to the caller, to be moved once the transaction
+// is committed.
+func (chain *BlockChain) reorganize(txn *badger.Txn, lastHash []byte, newTip *Block) (TipChange, error) {
+	var change TipChange
+	var connect []*Block
+
+	oldBlock, err := readBlock(txn, lastHash)
+	if err != nil {
+		return change, err
+	}
+	newBlock := newTip
+
+	// Walking both branches back until they meet at the fork point
+	for !bytes.Equal(oldBlock.Hash, newBlock.Hash) {
+		if oldBlock.Height >= newBlock.Height {
+			if len(oldBlock.PrevHash) == 0 {
+				return change, errors.New("Branches do not share a genesis block")
+			}
+			change.Disconnected = append(change.Disconnected, oldBlock)
+			if oldBlock, err = readBlock(txn, oldBlock.PrevHash); err != nil {
+				return change, err
+			}
+		}
+		if newBlock.Height > oldBlock.Height {
+			if len(newBlock.PrevHash) == 0 {
+				return change, errors.New("Branches do not share a genesis block")
+			}
+			connect = append(connect, newBlock)
+			if newBlock, err = readBlock(txn, newBlock.PrevHash); err != nil {
+				return change, err
+			}
+		}
+	}
+
+	if len(change.Disconnected) > MaxReorgDepth {
+		return TipChange{}, fmt.Errorf("%w: %d blocks", ErrReorgTooDeep, len(change.Disconnected))
+	}
+
+	// Connecting the new branch starting from the fork point
+	for i := len(connect) - 1; i >= 0; i-- {
+		change.Connected = append(change.Connected, connect[i])
+	}
+
+	for _, block := range change.Disconnected {
+		if err := chain.disconnectBlock(txn, block); err != nil {
+			return change, err
+		}
+	}
+	for _, block := range change.Connected {
+		if err := chain.connectBlock(txn, block); err != nil {
+			return change, &BlockError{block.Hash, err}
+		}
+	}
+
+	if err := txn.Set([]byte("lh"), newTip.Hash); err != nil {
+		return change, err
+	}
+
+	return change, nil
+}
@@ -0,0 +1,640 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+)
+
+// Opcodes understood by the script interpreter. The values follow Bitcoin so scripts read familiar.
+const (
+	OP_0                   = 0x00 // Pushes an empty element, which counts as false
+	OP_PUSHDATA1           = 0x4c // Pushes data whose length is given by the next byte
+	OP_PUSHDATA2           = 0x4d // Pushes data whose length is given by the next two bytes
+	OP_1NEGATE             = 0x4f // Pushes the number -1
+	OP_1                   = 0x51 // Pushes the number 1, OP_2 to OP_16 follow it
+	OP_16                  = 0x60 // Pushes the number 16
+	OP_NOP                 = 0x61 // Does nothing
+	OP_IF                  = 0x63 // Runs the following branch if the top element is true
+	OP_NOTIF               = 0x64 // Runs the following branch if the top element is false
+	OP_ELSE                = 0x67 // Switches to the other branch
+	OP_ENDIF               = 0x68 // Ends a conditional
+	OP_VERIFY              = 0x69 // Fails unless the top element is true, which is removed
+	OP_RETURN              = 0x6a // Fails, marking the output as unspendable
+	OP_DROP                = 0x75 // Removes the top element
+	OP_DUP                 = 0x76 // Duplicates the top element
+	OP_SWAP                = 0x7c // Swaps the two top elements
+	OP_SIZE                = 0x82 // Pushes the length of the top element
+	OP_EQUAL               = 0x87 // Pushes whether the two top elements are equal
+	OP_EQUALVERIFY         = 0x88 // OP_EQUAL followed by OP_VERIFY
+	OP_SHA256              = 0xa8 // Replaces the top element with its SHA-256 hash
+	OP_HASH160             = 0xa9 // Replaces the top element with its RIPEMD-160 of SHA-256 hash
+	OP_CHECKSIG            = 0xac // Pushes whether a signature is valid for a public key
+	OP_CHECKSIGVERIFY      = 0xad // OP_CHECKSIG followed by OP_VERIFY
+	OP_CHECKMULTISIG       = 0xae // Pushes whether enough signatures are valid for a list of keys
+	OP_CHECKMULTISIGVERIFY = 0xaf // OP_CHECKMULTISIG followed by OP_VERIFY
+	OP_CHECKLOCKTIMEVERIFY = 0xb1 // Fails unless the transaction lock time reaches the top element
+	OP_CHECKSEQUENCEVERIFY = 0xb2 // Fails unless the input relative lock reaches the top element
+)
+
+const (
+	maxScriptSize        = 10000 // Largest script in bytes
+	maxScriptElementSize = 520   // Largest element pushed on the stack in bytes
+	maxScriptOps         = 201   // Largest number of non-push operations in a script
+	maxStackSize         = 1000  // Largest number of elements on the stack
+	maxNumSize           = 4     // Largest number operand in bytes
+	maxLockNumSize       = 5     // Largest lock time operand in bytes
+)
+
+// ErrScriptFailed is returned when a script does not unlock the output it is run against.
+var ErrScriptFailed = errors.New("script failed")
+
+var opcodeNames = map[byte]string{
+	OP_0: "OP_0", OP_PUSHDATA1: "OP_PUSHDATA1", OP_PUSHDATA2: "OP_PUSHDATA2", OP_1NEGATE: "OP_1NEGATE",
+	OP_NOP: "OP_NOP", OP_IF: "OP_IF", OP_NOTIF: "OP_NOTIF", OP_ELSE: "OP_ELSE", OP_ENDIF: "OP_ENDIF",
+	OP_VERIFY: "OP_VERIFY", OP_RETURN: "OP_RETURN", OP_DROP: "OP_DROP", OP_DUP: "OP_DUP",
+	OP_SWAP: "OP_SWAP", OP_SIZE: "OP_SIZE", OP_EQUAL: "OP_EQUAL", OP_EQUALVERIFY: "OP_EQUALVERIFY",
+	OP_SHA256: "OP_SHA256", OP_HASH160: "OP_HASH160", OP_CHECKSIG: "OP_CHECKSIG",
+	OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY", OP_CHECKMULTISIG: "OP_CHECKMULTISIG",
+	OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY", OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+// SigChecker gives the interpreter access to the transaction spending the output, for the
+// operations that depend on it.
+type SigChecker interface {
+	CheckSig(signature, pubKey []byte) bool // Whether the signature of the transaction is valid for the key
+	CheckLockTime(lockTime int64) bool      // Whether the transaction lock time reaches the given one
+	CheckSequence(sequence int64) bool      // Whether the input relative lock reaches the given one
+}
+
+// parsedOp is a single operation of a script with the data it pushes.
+type parsedOp struct {
+	Code byte   // The opcode
+	Data []byte // The data pushed by push operations
+}
+
+// isPush reports whether the operation only pushes data.
+func (op parsedOp) isPush() bool {
+	return op.Code <= OP_16 && op.Code != 0x50
+}
+
+// parseScript splits a script into its operations.
+func parseScript(script []byte) ([]parsedOp, error) {
+	var ops []parsedOp
+
+	for i := 0; i < len(script); {
+		code := script[i]
+		i++
+
+		length := 0
+		switch {
+		case code > OP_0 && code < OP_PUSHDATA1:
+			length = int(code)
+		case code == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, fmt.Errorf("%w: truncated push", ErrScriptFailed)
+			}
+			length = int(script[i])
+			i++
+		case code == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, fmt.Errorf("%w: truncated push", ErrScriptFailed)
+			}
+			length = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		}
+		if i+length > len(script) {
+			return nil, fmt.Errorf("%w: truncated push", ErrScriptFailed)
+		}
+
+		op := parsedOp{Code: code}
+		if length > 0 {
+			op.Data = script[i : i+length]
+		}
+		ops = append(ops, op)
+		i += length
+	}
+
+	return ops, nil
+}
+
+// ScriptBuilder assembles a script operation by operation.
+type ScriptBuilder struct {
+	script []byte
+}
+
+// NewScriptBuilder creates an empty script builder.
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+// AddOp appends an opcode.
+func (b *ScriptBuilder) AddOp(code byte) *ScriptBuilder {
+	b.script = append(b.script, code)
+
+	return b
+}
+
+// AddData appends an operation pushing the data with the shortest encoding.
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	switch {
+	case len(data) == 0:
+		b.script = append(b.script, OP_0)
+	case len(data) < OP_PUSHDATA1:
+		b.script = append(b.script, byte(len(data)))
+	case len(data) <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(len(data)))
+	default:
+		b.script = append(b.script, OP_PUSHDATA2, byte(len(data)), byte(len(data)>>8))
+	}
+	b.script = append(b.script, data...)
+
+	return b
+}
+
+// AddInt appends an operation pushing a number.
+func (b *ScriptBuilder) AddInt(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == -1:
+		return b.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return b.AddOp(byte(OP_1 - 1 + n))
+	}
+
+	return b.AddData(encodeNum(n))
+}
+
+// Script returns the assembled script.
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
+
+// encodeNum encodes a number as a little-endian sign and magnitude stack element.
+func encodeNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+
+	var data []byte
+	for n > 0 {
+		data = append(data, byte(n&0xff))
+		n >>= 8
+	}
+
+	// The top bit of the last byte holds the sign
+	if data[len(data)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if negative {
+			extra = 0x80
+		}
+		data = append(data, extra)
+	} else if negative {
+		data[len(data)-1] |= 0x80
+	}
+
+	return data
+}
+
+// decodeNum decodes a stack element into a number no longer than maxLen bytes.
+func decodeNum(data []byte, maxLen int) (int64, error) {
+	if len(data) > maxLen {
+		return 0, fmt.Errorf("%w: number is longer than %d bytes", ErrScriptFailed, maxLen)
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	var n int64
+	for i, b := range data {
+		n |= int64(b) << (8 * uint(i))
+	}
+
+	// Clearing the sign bit and applying it
+	last := len(data) - 1
+	if data[last]&0x80 != 0 {
+		n &^= int64(0x80) << (8 * uint(last))
+		n = -n
+	}
+
+	return n, nil
+}
+
+// asBool interprets a stack element as a boolean: anything but zero, including negative zero, is true.
+func asBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+
+	return false
+}
+
+// fromBool encodes a boolean as a stack element.
+func fromBool(value bool) []byte {
+	if value {
+		return []byte{1}
+	}
+
+	return nil
+}
+
+// scriptEngine runs scripts against a shared stack.
+type scriptEngine struct {
+	stack   [][]byte   // The data stack
+	checker SigChecker // Access to the spending transaction
+}
+
+// pop removes and returns the top element of the stack.
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack is empty", ErrScriptFailed)
+	}
+	top := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+
+	return top, nil
+}
+
+// peek returns the top element of the stack without removing it.
+func (e *scriptEngine) peek() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, fmt.Errorf("%w: stack is empty", ErrScriptFailed)
+	}
+
+	return e.stack[len(e.stack)-1], nil
+}
+
+// push adds an element on top of the stack.
+func (e *scriptEngine) push(data []byte) {
+	e.stack = append(e.stack, data)
+}
+
+// popNum removes the top element of the stack and decodes it as a number.
+func (e *scriptEngine) popNum(maxLen int) (int64, error) {
+	data, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+
+	return decodeNum(data, maxLen)
+}
+
+// execute runs a script against the current stack.
+func (e *scriptEngine) execute(script []byte) error {
+	if len(script) > maxScriptSize {
+		return fmt.Errorf("%w: script is larger than %d bytes", ErrScriptFailed, maxScriptSize)
+	}
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	var conditions []bool // Whether each enclosing branch is being run
+	opCount := 0
+
+	for _, op := range ops {
+		running := true
+		for _, condition := range conditions {
+			running = running && condition
+		}
+
+		if len(op.Data) > maxScriptElementSize {
+			return fmt.Errorf("%w: element is larger than %d bytes", ErrScriptFailed, maxScriptElementSize)
+		}
+		if !op.isPush() {
+			if opCount++; opCount > maxScriptOps {
+				return fmt.Errorf("%w: more than %d operations", ErrScriptFailed, maxScriptOps)
+			}
+		}
+
+		// Branches that are not run only track nested conditionals
+		if !running && (op.Code < OP_IF || op.Code > OP_ENDIF) {
+			continue
+		}
+
+		if err := e.step(op, &conditions, running); err != nil {
+			return err
+		}
+		if len(e.stack) > maxStackSize {
+			return fmt.Errorf("%w: stack holds more than %d elements", ErrScriptFailed, maxStackSize)
+		}
+	}
+
+	if len(conditions) != 0 {
+		return fmt.Errorf("%w: unbalanced conditional", ErrScriptFailed)
+	}
+
+	return nil
+}
+
+// step runs a single operation.
+func (e *scriptEngine) step(op parsedOp, conditions *[]bool, running bool) error {
+	switch {
+	case op.Code == OP_0:
+		e.push(nil)
+		return nil
+	case op.Code < OP_PUSHDATA1 || op.Code == OP_PUSHDATA1 || op.Code == OP_PUSHDATA2:
+		e.push(op.Data)
+		return nil
+	case op.Code == OP_1NEGATE:
+		e.push(encodeNum(-1))
+		return nil
+	case op.Code >= OP_1 && op.Code <= OP_16:
+		e.push(encodeNum(int64(op.Code - OP_1 + 1)))
+		return nil
+	}
+
+	switch op.Code {
+	case OP_NOP:
+
+	case OP_IF, OP_NOTIF:
+		condition := false
+		if running {
+			top, err := e.pop()
+			if err != nil {
+				return err
+			}
+			condition = asBool(top) == (op.Code == OP_IF)
+		}
+		*conditions = append(*conditions, condition)
+
+	case OP_ELSE:
+		if len(*conditions) == 0 {
+			return fmt.Errorf("%w: OP_ELSE without OP_IF", ErrScriptFailed)
+		}
+		last := len(*conditions) - 1
+		(*conditions)[last] = !(*conditions)[last]
+
+	case OP_ENDIF:
+		if len(*conditions) == 0 {
+			return fmt.Errorf("%w: OP_ENDIF without OP_IF", ErrScriptFailed)
+		}
+		*conditions = (*conditions)[:len(*conditions)-1]
+
+	case OP_VERIFY:
+		return e.verify()
+
+	case OP_RETURN:
+		return fmt.Errorf("%w: OP_RETURN", ErrScriptFailed)
+
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+
+	case OP_DUP:
+		top, err := e.peek()
+		if err != nil {
+			return err
+		}
+		e.push(top)
+
+	case OP_SWAP:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(a)
+		e.push(b)
+
+	case OP_SIZE:
+		top, err := e.peek()
+		if err != nil {
+			return err
+		}
+		e.push(encodeNum(int64(len(top))))
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(fromBool(bytes.Equal(a, b)))
+		if op.Code == OP_EQUALVERIFY {
+			return e.verify()
+		}
+
+	case OP_SHA256:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(top)
+		e.push(hash[:])
+
+	case OP_HASH160:
+		top, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(wallet.PublicKeyHash(top))
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := e.pop()
+		if err != nil {
+			return err
+		}
+		e.push(fromBool(len(signature) > 0 && e.checker.CheckSig(signature, pubKey)))
+		if op.Code == OP_CHECKSIGVERIFY {
+			return e.verify()
+		}
+
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		if err := e.checkMultisig(); err != nil {
+			return err
+		}
+		if op.Code == OP_CHECKMULTISIGVERIFY {
+			return e.verify()
+		}
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		top, err := e.peek()
+		if err != nil {
+			return err
+		}
+		lockTime, err := decodeNum(top, maxLockNumSize)
+		if err != nil {
+			return err
+		}
+		if lockTime < 0 || !e.checker.CheckLockTime(lockTime) {
+			return fmt.Errorf("%w: lock time %d is not reached", ErrScriptFailed, lockTime)
+		}
+
+	case OP_CHECKSEQUENCEVERIFY:
+		top, err := e.peek()
+		if err != nil {
+			return err
+		}
+		sequence, err := decodeNum(top, maxLockNumSize)
+		if err != nil {
+			return err
+		}
+		if sequence < 0 || !e.checker.CheckSequence(sequence) {
+			return fmt.Errorf("%w: relative lock %d is not reached", ErrScriptFailed, sequence)
+		}
+
+	default:
+		return fmt.Errorf("%w: unknown opcode %02x", ErrScriptFailed, op.Code)
+	}
+
+	return nil
+}
+
+// verify removes the top element and fails unless it is true.
+func (e *scriptEngine) verify() error {
+	top, err := e.pop()
+	if err != nil {
+		return err
+	}
+	if !asBool(top) {
+		return fmt.Errorf("%w: verification failed", ErrScriptFailed)
+	}
+
+	return nil
+}
+
+// checkMultisig runs OP_CHECKMULTISIG. The stack holds one signature slot per public key, empty
+// for keys that did not sign, then the number of required signatures, the keys and their count.
+// Every signature given must be valid for the key in its slot.
+func (e *scriptEngine) checkMultisig() error {
+	count, err := e.popNum(maxNumSize)
+	if err != nil {
+		return err
+	}
+	if count < 1 || count > wallet.MaxMultisigKeys {
+		return fmt.Errorf("%w: bad number of multisig keys", ErrScriptFailed)
+	}
+	pubKeys := make([][]byte, count)
+	for i := count - 1; i >= 0; i-- {
+		if pubKeys[i], err = e.pop(); err != nil {
+			return err
+		}
+	}
+	required, err := e.popNum(maxNumSize)
+	if err != nil {
+		return err
+	}
+	if required < 1 || required > count {
+		return fmt.Errorf("%w: bad number of required signatures", ErrScriptFailed)
+	}
+	signatures := make([][]byte, count)
+	for i := count - 1; i >= 0; i-- {
+		if signatures[i], err = e.pop(); err != nil {
+			return err
+		}
+	}
+
+	valid := int64(0)
+	for i, signature := range signatures {
+		if len(signature) == 0 {
+			continue // This key has not signed
+		}
+		if !e.checker.CheckSig(signature, pubKeys[i]) {
+			e.push(fromBool(false))
+			return nil
+		}
+		valid++
+	}
+	e.push(fromBool(valid >= required))
+
+	return nil
+}
+
+// VerifyScript checks that an unlocking script unlocks an output with the given locking script.
+// The unlocking script may only push data; the locking script then runs on the resulting stack
+// and must leave a true element on top. For pay-to-script-hash outputs the last element pushed is
+// the redeem script, which then runs on the elements pushed before it.
+func VerifyScript(unlocking, locking []byte, checker SigChecker) error {
+	ops, err := parseScript(unlocking)
+	if err != nil {
+		return err
+	}
+	for _, op := range ops {
+		if !op.isPush() {
+			return fmt.Errorf("%w: unlocking script may only push data", ErrScriptFailed)
+		}
+	}
+
+	engine := scriptEngine{checker: checker}
+	if err := engine.execute(unlocking); err != nil {
+		return err
+	}
+	pushed := append([][]byte{}, engine.stack...)
+	if err := engine.run(locking); err != nil {
+		return err
+	}
+
+	if ClassifyScript(locking) != ScriptHashScript {
+		return nil
+	}
+	redeemEngine := scriptEngine{stack: pushed[:len(pushed)-1], checker: checker}
+
+	return redeemEngine.run(pushed[len(pushed)-1])
+}
+
+// run executes a script and checks that it leaves a true element on top of the stack.
+func (e *scriptEngine) run(script []byte) error {
+	if err := e.execute(script); err != nil {
+		return err
+	}
+
+	top, err := e.peek()
+	if err != nil {
+		return err
+	}
+	if !asBool(top) {
+		return fmt.Errorf("%w: script evaluated to false", ErrScriptFailed)
+	}
+
+	return nil
+}
+
+// DisasmScript returns a human-readable form of a script.
+func DisasmScript(script []byte) string {
+	ops, err := parseScript(script)
+	if err != nil {
+		return fmt.Sprintf("[invalid script %x]", script)
+	}
+
+	var words []string
+	for _, op := range ops {
+		switch {
+		case op.Code > OP_0 && op.Code <= OP_PUSHDATA2:
+			words = append(words, hex.EncodeToString(op.Data))
+		case op.Code >= OP_1 && op.Code <= OP_16:
+			words = append(words, fmt.Sprintf("OP_%d", op.Code-OP_1+1))
+		case opcodeNames[op.Code] != "":
+			words = append(words, opcodeNames[op.Code])
+		default:
+			words = append(words, fmt.Sprintf("OP_UNKNOWN_%02x", op.Code))
+		}
+	}
+
+	return strings.Join(words, " ")
+}
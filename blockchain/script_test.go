@@ -0,0 +1,165 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeChecker accepts the signature "sig" for the key "key" and fixed lock values.
+type fakeChecker struct {
+	lockTime int64
+	sequence int64
+}
+
+func (c fakeChecker) CheckSig(signature, pubKey []byte) bool {
+	return bytes.Equal(signature, []byte("sig")) && bytes.Equal(pubKey, []byte("key"))
+}
+
+func (c fakeChecker) CheckLockTime(lockTime int64) bool { return lockTime <= c.lockTime }
+
+func (c fakeChecker) CheckSequence(sequence int64) bool { return sequence <= c.sequence }
+
+func TestVerifyScript(t *testing.T) {
+	checker := fakeChecker{100, 10}
+	secret := []byte("secret")
+	secretHash := sha256.Sum256(secret)
+
+	// Pay to pubkey hash
+	locking := PayToPubKeyHashScript(wallet.PublicKeyHash([]byte("key")))
+	unlocking := NewScriptBuilder().AddData([]byte("sig")).AddData([]byte("key")).Script()
+	assert.NoError(t, VerifyScript(unlocking, locking, checker), "Matching key and signature unlock")
+	unlocking = NewScriptBuilder().AddData([]byte("bad")).AddData([]byte("key")).Script()
+	assert.True(t, errors.Is(VerifyScript(unlocking, locking, checker), ErrScriptFailed), "Bad signature fails")
+
+	// Pay to script hash revealing the redeem script
+	redeem := locking
+	locking = PayToScriptHashScript(wallet.PublicKeyHash(redeem))
+	unlocking = NewScriptBuilder().AddData([]byte("sig")).AddData([]byte("key")).AddData(redeem).Script()
+	assert.NoError(t, VerifyScript(unlocking, locking, checker), "Redeem script unlocks")
+	unlocking = NewScriptBuilder().AddData([]byte("bad")).AddData([]byte("key")).AddData(redeem).Script()
+	assert.Error(t, VerifyScript(unlocking, locking, checker), "Redeem script runs after the hash matches")
+	unlocking = NewScriptBuilder().AddData([]byte{OP_1}).Script()
+	assert.Error(t, VerifyScript(unlocking, locking, checker), "Other redeem script fails")
+
+	// Hash lock or time lock, chosen with a conditional
+	locking = NewScriptBuilder().AddOp(OP_IF).AddOp(OP_SHA256).AddData(secretHash[:]).AddOp(OP_EQUAL).
+		AddOp(OP_ELSE).AddInt(150).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).AddOp(OP_1).
+		AddOp(OP_ENDIF).Script()
+	unlocking = NewScriptBuilder().AddData(secret).AddOp(OP_1).Script()
+	assert.NoError(t, VerifyScript(unlocking, locking, checker), "Secret unlocks the first branch")
+	unlocking = NewScriptBuilder().AddData([]byte("guess")).AddOp(OP_1).Script()
+	assert.Error(t, VerifyScript(unlocking, locking, checker), "Wrong secret fails")
+	unlocking = NewScriptBuilder().AddOp(OP_0).Script()
+	assert.Error(t, VerifyScript(unlocking, locking, checker), "Lock time is not reached")
+	assert.NoError(t, VerifyScript(unlocking, locking, fakeChecker{200, 10}), "Lock time is reached")
+
+	// Malformed scripts
+	assert.Error(t, VerifyScript(nil, []byte{OP_IF, OP_1}, checker), "Unbalanced conditional fails")
+	assert.Error(t, VerifyScript(nil, []byte{OP_1, OP_RETURN}, checker), "OP_RETURN fails")
+	assert.Error(t, VerifyScript([]byte{OP_1, OP_DUP}, []byte{OP_1}, checker), "Unlocking script may only push")
+	assert.Error(t, VerifyScript(nil, []byte{0x05, 0x01}, checker), "Truncated push fails")
+	assert.Error(t, VerifyScript(nil, bytes.Repeat([]byte{OP_NOP}, maxScriptOps+1), checker), "Operation limit")
+}
+
+func TestScriptNumbers(t *testing.T) {
+	for _, n := range []int64{0, 1, -1, 127, 128, -128, 255, 256, 1 << 31} {
+		decoded, err := decodeNum(encodeNum(n), maxLockNumSize)
+		assert.NoError(t, err)
+		assert.Equal(t, n, decoded, "Number survives the round trip")
+	}
+
+	locking := MultisigLockingScript(2, [][]byte{[]byte("a"), []byte("b"), []byte("c")})
+	assert.Equal(t, MultisigScript, ClassifyScript(locking), "Multisig template is recognised")
+	assert.Equal(t, "OP_2 61 62 63 OP_3 OP_CHECKMULTISIG", DisasmScript(locking), "Script is disassembled")
+}
+
+// payTo mines a block on the tip in which the wallet pays an amount to an address, and returns it.
+func payTo(t *testing.T, chain *BlockChain, w *wallet.Wallet, to string, amount int) *Block {
+	UTXOSet := UTXOSet{chain}
+	parent := tip(t, chain)
+	pay := NewTransaction(w, to, amount, 0, 0, &UTXOSet)
+	block := newTestBlock(parent, CoinbaseTx(string(w.Address()), "", BlockSubsidy(parent.Height+1)), pay)
+	_, err := chain.AddBlock(block)
+	assert.NoError(t, err)
+
+	return block
+}
+
+func TestMultisigSpending(t *testing.T) {
+	chain, w := newTestChain(t)
+	a, b, c, outsider := wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet()
+	to := wallet.MakeWallet()
+	UTXOSet := UTXOSet{chain}
+	address, err := wallet.MultisigAddress(2, [][]byte{a.PublicKey, b.PublicKey, c.PublicKey})
+	assert.NoError(t, err)
+	payTo(t, chain, w, string(address), 10)
+	assert.Equal(t, 10, unspentValue(UTXOSet, wallet.AddressHash(string(address))))
+
+	spend := NewMultisigTransaction(string(address), string(to.Address()), 6, 1, false, &UTXOSet)
+	assert.True(t, errors.Is(chain.ValidateTransaction(spend), ErrBadSignature), "Unsigned spend fails")
+	chain.SignTransaction(spend, outsider.PrivateKey)
+	chain.SignTransaction(spend, a.PrivateKey)
+	assert.True(t, errors.Is(chain.ValidateTransaction(spend), ErrBadSignature), "One signature is not enough")
+	chain.SignTransaction(spend, c.PrivateKey)
+	assert.NoError(t, chain.ValidateTransaction(spend), "Signatures of two keys spend")
+
+	// A signature moved to the slot of another key does not count
+	pushed, err := parseScript(spend.Inputs[0].UnlockingScript)
+	assert.NoError(t, err)
+	forged := *spend
+	forged.Inputs = append([]TxInput{}, spend.Inputs...)
+	forged.Inputs[0].UnlockingScript = NewScriptBuilder().AddOp(OP_0).AddData(pushed[0].Data).AddData(pushed[2].Data).Script()
+	assert.True(t, errors.Is(chain.ValidateTransaction(&forged), ErrBadSignature), "Signature in the wrong slot fails")
+
+	parent := tip(t, chain)
+	block := newTestBlock(parent, CoinbaseTx(string(w.Address()), "", BlockSubsidy(parent.Height+1)+1), spend)
+	_, err = chain.AddBlock(block)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, unspentValue(UTXOSet, wallet.PublicKeyHash(to.PublicKey)))
+	assert.Equal(t, 3, unspentValue(UTXOSet, wallet.AddressHash(string(address))), "Change goes back to the multisig address")
+}
+
+func TestScriptHashSpending(t *testing.T) {
+	chain, w := newTestChain(t)
+	a, b := wallet.MakeWallet(), wallet.MakeWallet()
+	to := wallet.MakeWallet()
+	UTXOSet := UTXOSet{chain}
+	pubKeys := [][]byte{a.PublicKey, b.PublicKey}
+	multisig, err := wallet.MultisigAddress(2, pubKeys)
+	assert.NoError(t, err)
+	address := string(MultisigScriptHashAddress(2, pubKeys))
+	assert.True(t, wallet.ValidateAddress(address))
+	assert.True(t, wallet.IsScriptHashAddress(address))
+
+	funding := payTo(t, chain, w, address, 10)
+	assert.Equal(t, ScriptHashScript, ClassifyScript(funding.Transactions[1].Outputs[0].LockingScript), "Payment locks to the script hash")
+	assert.Equal(t, 10, unspentValue(UTXOSet, wallet.AddressHash(address)))
+
+	spend := NewMultisigTransaction(string(multisig), string(to.Address()), 6, 1, true, &UTXOSet)
+	chain.SignTransaction(spend, a.PrivateKey)
+	assert.True(t, errors.Is(chain.ValidateTransaction(spend), ErrBadSignature), "One signature is not enough")
+	chain.SignTransaction(spend, b.PrivateKey)
+	assert.NoError(t, chain.ValidateTransaction(spend), "Redeem script with both signatures spends")
+
+	// Another redeem script does not match the hash of the output, even if it is satisfied
+	pushed, err := parseScript(spend.Inputs[0].UnlockingScript)
+	assert.NoError(t, err)
+	forged := *spend
+	forged.Inputs = append([]TxInput{}, spend.Inputs...)
+	forged.Inputs[0].UnlockingScript = NewScriptBuilder().AddData(pushed[0].Data).AddData(pushed[1].Data).
+		AddData(MultisigLockingScript(1, pubKeys)).Script()
+	assert.True(t, errors.Is(chain.ValidateTransaction(&forged), ErrBadSignature), "Other redeem script fails")
+
+	parent := tip(t, chain)
+	block := newTestBlock(parent, CoinbaseTx(string(w.Address()), "", BlockSubsidy(parent.Height+1)+1), spend)
+	_, err = chain.AddBlock(block)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, unspentValue(UTXOSet, wallet.PublicKeyHash(to.PublicKey)))
+	assert.Equal(t, 3, unspentValue(UTXOSet, wallet.AddressHash(address)), "Change goes back to the script hash address")
+	assert.Equal(t, 0, unspentValue(UTXOSet, wallet.AddressHash(string(multisig))))
+}
@@ -0,0 +1,135 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SigHashType selects the parts of a transaction a signature commits to. It is appended to every
+// signature as its last byte.
+type SigHashType byte
+
+const (
+	SigHashAll          SigHashType = 0x01 // Commits to every input and output
+	SigHashNone         SigHashType = 0x02 // Commits to no output, so anyone can choose where the coins go
+	SigHashSingle       SigHashType = 0x03 // Commits only to the output with the index of the input
+	SigHashAnyoneCanPay SigHashType = 0x80 // Commits only to its own input, so others can add inputs
+)
+
+// coordinateSize is the size of a P-256 coordinate. Public keys hold two of them, signatures
+// hold r and s padded to it.
+const coordinateSize = 32
+
+// ErrSigHashType is returned for an unknown signature hash type or one that cannot be applied.
+var ErrSigHashType = errors.New("invalid signature hash type")
+
+// base returns the hash type without the ANYONECANPAY flag.
+func (t SigHashType) base() SigHashType {
+	return t &^ SigHashAnyoneCanPay
+}
+
+// ParseSigHashType parses a signature hash type such as ALL, NONE, SINGLE or ALL|ANYONECANPAY.
+func ParseSigHashType(name string) (SigHashType, error) {
+	parts := strings.Split(strings.ToUpper(name), "|")
+
+	var hashType SigHashType
+	switch parts[0] {
+	case "ALL":
+		hashType = SigHashAll
+	case "NONE":
+		hashType = SigHashNone
+	case "SINGLE":
+		hashType = SigHashSingle
+	default:
+		return 0, fmt.Errorf("%w: %s", ErrSigHashType, name)
+	}
+	if len(parts) == 2 && parts[1] == "ANYONECANPAY" {
+		hashType |= SigHashAnyoneCanPay
+	} else if len(parts) != 1 {
+		return 0, fmt.Errorf("%w: %s", ErrSigHashType, name)
+	}
+
+	return hashType, nil
+}
+
+// SignatureHash returns the hash a signature of an input commits to: SHA-256 applied twice to the
+// canonical preimage below, in the binary encoding of binaryWriter.
+//
+//	varint   number of inputs committed to
+//	         per input: varbytes previous txid, uint32 output index,
+//	         varbytes locking script of the spent output (empty for the other inputs), uint32 sequence
+//	varint   number of outputs committed to
+//	         per output: int64 value, varbytes locking script
+//	uint32   lock time
+//	uint32   hash type
+//
+// With ANYONECANPAY only the signed input is listed. With NONE no output is listed, and with SINGLE
+// only the outputs up to the index of the input, the earlier ones blanked to a value of -1 and an
+// empty script; both set the sequence of the other inputs to 0 so they can be updated.
+func (tx *Transaction) SignatureHash(inIdx int, prevOut TxOutput, hashType SigHashType) ([]byte, error) {
+	base := hashType.base()
+	if base < SigHashAll || base > SigHashSingle {
+		return nil, fmt.Errorf("%w: %02x", ErrSigHashType, byte(hashType))
+	}
+	if inIdx < 0 || inIdx >= len(tx.Inputs) {
+		return nil, fmt.Errorf("input %d does not exist", inIdx)
+	}
+	if base == SigHashSingle && inIdx >= len(tx.Outputs) {
+		return nil, fmt.Errorf("%w: no output %d for SINGLE", ErrSigHashType, inIdx)
+	}
+
+	var w binaryWriter
+
+	// Inputs
+	anyoneCanPay := hashType&SigHashAnyoneCanPay != 0
+	if anyoneCanPay {
+		w.writeVarInt(1)
+	} else {
+		w.writeVarInt(uint64(len(tx.Inputs)))
+	}
+	for i, in := range tx.Inputs {
+		if anyoneCanPay && i != inIdx {
+			continue
+		}
+		w.writeVarBytes(in.ID)
+		w.writeUint32(uint32(in.Out))
+		if i == inIdx {
+			w.writeVarBytes(prevOut.LockingScript)
+			w.writeUint32(in.Sequence)
+			continue
+		}
+		w.writeVarBytes(nil)
+		if base == SigHashAll {
+			w.writeUint32(in.Sequence)
+		} else {
+			w.writeUint32(0)
+		}
+	}
+
+	// Outputs
+	var outputs []TxOutput
+	switch base {
+	case SigHashAll:
+		outputs = tx.Outputs
+	case SigHashSingle:
+		for i := 0; i < inIdx; i++ {
+			outputs = append(outputs, TxOutput{-1, nil})
+		}
+		outputs = append(outputs, tx.Outputs[inIdx])
+	}
+	w.writeVarInt(uint64(len(outputs)))
+	for _, out := range outputs {
+		w.writeInt64(int64(out.Value))
+		w.writeVarBytes(out.LockingScript)
+	}
+
+	w.writeUint32(tx.LockTime)
+	w.writeUint32(uint32(hashType))
+
+	first := sha256.Sum256(w.Bytes())
+	hash := sha256.Sum256(first[:])
+
+	return hash[:], nil
+}
@@ -0,0 +1,71 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSignatureHashVector(t *testing.T) {
+	prevOut := TxOutput{10, PayToPubKeyHashScript(make([]byte, 20))}
+	tx := Transaction{TxVersion, nil, []TxInput{{[]byte{1, 2, 3}, 1, nil, MaxSequence}}, []TxOutput{{9, []byte{OP_1}}}, 7}
+
+	hash, err := tx.SignatureHash(0, prevOut, SigHashAll)
+	assert.NoError(t, err)
+	assert.Equal(t, "6e2e117fefddb0fe17c966459621b430ce1e9c470a2e1fc939999c540ac522f9", hex.EncodeToString(hash), "Signature hash is reproducible")
+
+	_, err = tx.SignatureHash(0, prevOut, 0x04)
+	assert.Error(t, err, "Unknown hash type is rejected")
+	tx.Outputs = nil
+	_, err = tx.SignatureHash(0, prevOut, SigHashSingle)
+	assert.Error(t, err, "SINGLE needs the output with the index of the input")
+}
+
+func TestSignatureHashTypes(t *testing.T) {
+	alice, bob := wallet.MakeWallet(), wallet.MakeWallet()
+	prevA := Transaction{TxVersion, []byte("a"), nil, []TxOutput{*NewTXOutput(10, string(alice.Address()))}, 0}
+	prevB := Transaction{TxVersion, []byte("b"), nil, []TxOutput{*NewTXOutput(5, string(bob.Address()))}, 0}
+	prevTXs := map[string]Transaction{"61": prevA, "62": prevB}
+
+	sign := func(hashType SigHashType) *Transaction {
+		tx := &Transaction{TxVersion, nil, []TxInput{{prevA.ID, 0, nil, MaxSequence}}, []TxOutput{*NewTXOutput(8, string(bob.Address()))}, 0}
+		tx.SignWithHashType(alice.PrivateKey, prevTXs, hashType)
+		return tx
+	}
+	verifyWithInput := func(tx *Transaction) error {
+		tx.Inputs = append(tx.Inputs, TxInput{prevB.ID, 0, nil, MaxSequence})
+		tx.SignWithHashType(bob.PrivateKey, prevTXs, SigHashAll)
+		return tx.verifyScripts([]TxOutput{prevA.Outputs[0], prevB.Outputs[0]})
+	}
+
+	tx := sign(SigHashAll)
+	assert.NoError(t, tx.verifyScripts([]TxOutput{prevA.Outputs[0]}), "Signature is valid")
+	tx.Outputs[0].Value = 9
+	assert.Error(t, tx.verifyScripts([]TxOutput{prevA.Outputs[0]}), "ALL commits to the outputs")
+	assert.Error(t, verifyWithInput(sign(SigHashAll)), "ALL commits to the inputs")
+	assert.NoError(t, verifyWithInput(sign(SigHashAll|SigHashAnyoneCanPay)), "ANYONECANPAY lets others add inputs")
+
+	tx = sign(SigHashNone)
+	tx.Outputs[0].Value = 9
+	assert.NoError(t, tx.verifyScripts([]TxOutput{prevA.Outputs[0]}), "NONE commits to no output")
+
+	tx = sign(SigHashSingle | SigHashAnyoneCanPay)
+	tx.Outputs = append(tx.Outputs, *NewTXOutput(4, string(alice.Address())))
+	assert.NoError(t, verifyWithInput(tx), "SINGLE commits only to its own output")
+	tx.Outputs[0].Value = 9
+	assert.Error(t, tx.verifyScripts([]TxOutput{prevA.Outputs[0], prevB.Outputs[0]}), "SINGLE commits to its own output")
+}
+
+func TestSignatureWithLeadingZeroKey(t *testing.T) {
+	// The X coordinate of the key starts with a zero byte, which the encoding keeps
+	w := wallet.MakeWallet()
+	for w.PrivateKey.PublicKey.X.BitLen() > 248 {
+		w = wallet.MakeWallet()
+	}
+	prev := Transaction{TxVersion, []byte("a"), nil, []TxOutput{*NewTXOutput(10, string(w.Address()))}, 0}
+	tx := &Transaction{TxVersion, nil, []TxInput{{prev.ID, 0, nil, MaxSequence}}, []TxOutput{*NewTXOutput(9, string(w.Address()))}, 0}
+	tx.SignWithHashType(w.PrivateKey, map[string]Transaction{"61": prev}, SigHashAll)
+	assert.NoError(t, tx.verifyScripts(prev.Outputs))
+}
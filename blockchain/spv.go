@@ -0,0 +1,304 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dgraph-io/badger"
+)
+
+const headerDBPath = "./tmp/headers_%s" // Path for storing the headers of a light client
+
+// HeaderChain is the chain of block headers kept by a light client. It stores no blocks and checks
+// transactions with the Merkle proofs full nodes send for them.
+type HeaderChain struct {
+	Database *badger.DB // Database holding the block index of the headers
+}
+
+// SPVOutput is an output paying to the light client, proven to be in the best header chain.
+type SPVOutput struct {
+	TxID          []byte // Transaction holding the output
+	Index         int    // Position of the output in the transaction
+	Value         int    // Value of the output
+	Confirmations int    // Blocks of the best header chain confirming the transaction
+}
+
+// OpenHeaderChain opens the header chain of a light client, creating it if needed.
+func OpenHeaderChain(nodeId string) *HeaderChain {
+	path := fmt.Sprintf(headerDBPath, nodeId)
+
+	opts := badger.DefaultOptions
+	opts.Dir = path
+	opts.ValueDir = path
+
+	db, err := openDB(path, opts)
+	Handle(err)
+
+	return &HeaderChain{db}
+}
+
+// AddHeaders validates headers received from a full node and adds them to the header chain. The
+// genesis header is taken from the first peer, every later header must follow the rules.
+func (hc *HeaderChain) AddHeaders(headers []*BlockHeader) error {
+	return hc.Database.Update(func(txn *badger.Txn) error {
+		for _, header := range headers {
+			if len(header.PrevHash) == 0 {
+				if _, err := txn.Get(bestHeaderKey); err == nil {
+					continue // The genesis header is already known
+				}
+				if err := checkHeaderSanity(header); err != nil {
+					return &BlockError{header.Hash(), err}
+				}
+				work := NewProof(header).Work()
+				if err := writeHeader(txn, header.Hash(), headerEntry{*header, 0}, work); err != nil {
+					return err
+				}
+				continue
+			}
+			if _, err := addHeader(txn, header); err != nil {
+				return &BlockError{header.Hash(), err}
+			}
+		}
+		return nil
+	})
+}
+
+// BestHeight returns the height of the best header, or -1 before the genesis header is known.
+func (hc *HeaderChain) BestHeight() int {
+	height := -1
+
+	err := hc.Database.View(func(txn *badger.Txn) error {
+		entry, err := bestHeader(txn)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		height = entry.Height
+		return nil
+	})
+	Handle(err)
+
+	return height
+}
+
+// BlockLocator returns hashes of the best header chain for a full node to find the headers that
+// follow it. It is empty before the genesis header is known, which asks for all headers.
+func (hc *HeaderChain) BlockLocator() [][]byte {
+	if hc.BestHeight() < 0 {
+		return nil
+	}
+
+	return (&BlockChain{Database: hc.Database}).BlockLocator()
+}
+
+// Confirmations returns the number of headers of the best chain confirming a block, counting the
+// block itself. It fails if the block is not on the best header chain.
+func (hc *HeaderChain) Confirmations(blockHash []byte) (int, error) {
+	confirmations := 0
+
+	err := hc.Database.View(func(txn *badger.Txn) error {
+		block, err := readHeader(txn, blockHash)
+		if err != nil {
+			return errors.New("Block header is not known")
+		}
+		best, err := bestHeader(txn)
+		if err != nil {
+			return err
+		}
+
+		// Walking back from the best header to the height of the block
+		entry := best
+		for entry.Height > block.Height {
+			if entry, err = readHeader(txn, entry.Header.PrevHash); err != nil {
+				return err
+			}
+		}
+		if !bytes.Equal(entry.Header.Hash(), blockHash) {
+			return errors.New("Block is not on the best header chain")
+		}
+
+		confirmations = best.Height - block.Height + 1
+		return nil
+	})
+
+	return confirmations, err
+}
+
+// VerifyProof checks that a proven transaction is in a block of the best header chain and returns
+// its confirmations.
+func (hc *HeaderChain) VerifyProof(proof *TxProof) (int, error) {
+	confirmations, err := hc.Confirmations(proof.Header.Hash())
+	if err != nil {
+		return 0, err
+	}
+	if !proof.Verify() {
+		return 0, errors.New("Merkle proof does not lead to the block header")
+	}
+
+	return confirmations, nil
+}
+
+// AddFilter checks a compact filter received from a full node against the header chain and the
+// filter headers already received, then records its filter header. Filters may arrive in any
+// order, so the link to the parent is only checked once the parent filter is known.
+func (hc *HeaderChain) AddFilter(filter *BlockFilter) error {
+	return hc.Database.Update(func(txn *badger.Txn) error {
+		entry, err := readHeader(txn, filter.BlockHash)
+		if err != nil {
+			return errors.New("Block header is not known")
+		}
+		if !filter.Verify() {
+			return errors.New("Filter header does not commit to the filter")
+		}
+
+		prevHeader, err := readPrevFilterHeader(txn, entry.Header.PrevHash)
+		if err == nil && !bytes.Equal(prevHeader, filter.PrevHeader) {
+			return errors.New("Filter header does not follow the filter header chain")
+		}
+		if item, err := txn.Get(filterHeaderKey(filter.BlockHash)); err == nil {
+			header, err := item.Value()
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(header, filter.Header) {
+				return errors.New("Filter header conflicts with the one received before")
+			}
+		}
+
+		return txn.Set(filterHeaderKey(filter.BlockHash), filter.Header)
+	})
+}
+
+// bestHeader loads the block index entry of the header with the most work.
+func bestHeader(txn *badger.Txn) (*headerEntry, error) {
+	item, err := txn.Get(bestHeaderKey)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := item.Value()
+	if err != nil {
+		return nil, err
+	}
+
+	return readHeader(txn, hash)
+}
+
+// FindTransactionProofs returns proofs for every transaction of the best chain paying to one of
+// the public key hashes or spending such a payment, oldest first. Blocks recorded in gob cannot
+// prove their transactions and are skipped. A pruned blockchain fails with ErrPruned, as it can no
+// longer prove the older transactions. With the address index only the blocks holding such
+// transactions are read, otherwise the whole chain is scanned.
+func (chain *BlockChain) FindTransactionProofs(pubKeyHashes [][]byte) ([]*TxProof, error) {
+	if err := chain.requireAllBlocks(); err != nil {
+		return nil, err
+	}
+	if chain.AddrIndexEnabled() {
+		return chain.findIndexedTransactionProofs(pubKeyHashes)
+	}
+
+	var proofs []*TxProof
+	watched := make(map[string]bool) // Outputs paying to the public key hashes
+
+	iter := chain.ForwardIterator()
+	for block := iter.Next(); block != nil; block = iter.Next() {
+		for _, tx := range block.Transactions {
+			relevant := false
+			if !tx.IsCoinbase() {
+				for _, in := range tx.Inputs {
+					if watched[fmt.Sprintf("%x:%d", in.ID, in.Out)] {
+						relevant = true
+					}
+				}
+			}
+			for outIdx, out := range tx.Outputs {
+				for _, pubKeyHash := range pubKeyHashes {
+					if out.IsLockedWithKey(pubKeyHash) {
+						watched[fmt.Sprintf("%x:%d", tx.ID, outIdx)] = true
+						relevant = true
+					}
+				}
+			}
+
+			if !relevant {
+				continue
+			}
+			if proof, err := block.TransactionProof(tx.ID); err == nil {
+				proofs = append(proofs, proof)
+			}
+		}
+	}
+
+	return proofs, nil
+}
+
+// findIndexedTransactionProofs returns the proofs of FindTransactionProofs, finding the
+// transactions in the address index.
+func (chain *BlockChain) findIndexedTransactionProofs(pubKeyHashes [][]byte) ([]*TxProof, error) {
+	var blocks []AddressEvent                    // One event of every block with a relevant transaction
+	relevant := make(map[string]map[string]bool) // Relevant transaction IDs by block hash
+
+	for _, pubKeyHash := range pubKeyHashes {
+		history, err := chain.AddressHistory(pubKeyHash)
+		if err != nil {
+			return nil, err
+		}
+		for _, event := range history {
+			txIDs, ok := relevant[string(event.BlockHash)]
+			if !ok {
+				txIDs = make(map[string]bool)
+				relevant[string(event.BlockHash)] = txIDs
+				blocks = append(blocks, event)
+			}
+			txIDs[string(event.TxID)] = true
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Height < blocks[j].Height })
+
+	var proofs []*TxProof
+	for _, event := range blocks {
+		block, err := chain.GetBlock(event.BlockHash)
+		if err != nil {
+			return nil, err
+		}
+		// Keeping the order of the transactions in the block
+		for _, tx := range block.Transactions {
+			if !relevant[string(block.Hash)][string(tx.ID)] {
+				continue
+			}
+			if proof, err := block.TransactionProof(tx.ID); err == nil {
+				proofs = append(proofs, proof)
+			}
+		}
+	}
+
+	return proofs, nil
+}
+
+// SPVUnspentOutputs returns the outputs of proven transactions that pay to a public key hash and
+// are not spent by another proven transaction. The proofs come with their confirmations.
+func SPVUnspentOutputs(proofs []*TxProof, confirmations []int, pubKeyHash []byte) []SPVOutput {
+	spent := make(map[string]bool)
+	for _, proof := range proofs {
+		if proof.Transaction.IsCoinbase() {
+			continue
+		}
+		for _, in := range proof.Transaction.Inputs {
+			spent[fmt.Sprintf("%x:%d", in.ID, in.Out)] = true
+		}
+	}
+
+	var outputs []SPVOutput
+	for i, proof := range proofs {
+		tx := proof.Transaction
+		for outIdx, out := range tx.Outputs {
+			if out.IsLockedWithKey(pubKeyHash) && !spent[fmt.Sprintf("%x:%d", tx.ID, outIdx)] {
+				outputs = append(outputs, SPVOutput{tx.ID, outIdx, out.Value, confirmations[i]})
+			}
+		}
+	}
+
+	return outputs
+}
@@ -0,0 +1,115 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestHeaderChain opens the header chain of a light client next to the test blockchain.
+func newTestHeaderChain(t *testing.T) *HeaderChain {
+	hc := OpenHeaderChain("spv")
+	t.Cleanup(func() { hc.Database.Close() })
+
+	return hc
+}
+
+func TestHeaderChain(t *testing.T) {
+	chain, w := newTestChain(t)
+	genesis := tip(t, chain)
+	last := extendChain(t, chain, genesis, 3, string(w.Address()))
+	hc := newTestHeaderChain(t)
+	assert.Equal(t, -1, hc.BestHeight())
+	assert.Empty(t, hc.BlockLocator(), "Empty locator asks for all headers")
+
+	// A genesis header without proof of work is refused
+	forged := genesis.BlockHeader
+	for NewProof(&forged).Validate() {
+		forged.Nonce++
+	}
+	err := hc.AddHeaders([]*BlockHeader{&forged})
+	assert.True(t, errors.Is(err, ErrBadProofOfWork), "got %v", err)
+	assert.Equal(t, -1, hc.BestHeight())
+
+	assert.NoError(t, hc.AddHeaders(chain.FindHeaders(hc.BlockLocator(), 100)))
+	assert.Equal(t, 3, hc.BestHeight())
+	assert.Equal(t, last.Hash, hc.BlockLocator()[0])
+
+	confirmations, err := hc.Confirmations(genesis.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, confirmations)
+	confirmations, err = hc.Confirmations(last.Hash)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, confirmations)
+
+	// Headers off the best chain and unknown headers have no confirmations
+	fork := newTestBlock(genesis, CoinbaseTx(string(w.Address()), "fork", BlockSubsidy(1)))
+	assert.NoError(t, hc.AddHeaders([]*BlockHeader{&fork.BlockHeader}))
+	_, err = hc.Confirmations(fork.Hash)
+	assert.Error(t, err)
+	_, err = hc.Confirmations(newTestBlock(last).Hash)
+	assert.Error(t, err)
+
+	// Headers breaking the rules are refused
+	bad := newTestBlock(last)
+	bad.Bits = powLimitBits - 1
+	remine(bad)
+	err = hc.AddHeaders([]*BlockHeader{&bad.BlockHeader})
+	assert.True(t, errors.Is(err, ErrBadDifficulty), "got %v", err)
+	assert.Equal(t, 3, hc.BestHeight())
+}
+
+func TestTransactionProofs(t *testing.T) {
+	chain, w := newTestChain(t)
+	other := wallet.MakeWallet()
+	UTXOSet := UTXOSet{chain}
+	genesis := tip(t, chain)
+
+	// The payment spends the genesis coinbase, leaving change to the payer
+	pay := NewTransaction(w, string(other.Address()), 5, 1, 0, &UTXOSet)
+	block := newTestBlock(genesis, CoinbaseTx(string(w.Address()), "", BlockSubsidy(1)+1), pay)
+	_, err := chain.AddBlock(block)
+	assert.NoError(t, err)
+	extendChain(t, chain, block, 2, string(wallet.MakeWallet().Address()))
+
+	pubKeyHashes := [][]byte{wallet.PublicKeyHash(w.PublicKey), wallet.PublicKeyHash(other.PublicKey)}
+	proofs, err := chain.FindTransactionProofs(pubKeyHashes)
+	assert.NoError(t, err)
+	var ids [][]byte
+	for _, proof := range proofs {
+		ids = append(ids, proof.Transaction.ID)
+	}
+	assert.Equal(t, [][]byte{genesis.Transactions[0].ID, block.Transactions[0].ID, pay.ID}, ids, "Oldest first")
+
+	chain.ReindexAddresses()
+	indexed, err := chain.FindTransactionProofs(pubKeyHashes)
+	assert.NoError(t, err)
+	assert.Equal(t, proofs, indexed, "Address index finds the same proofs")
+
+	hc := newTestHeaderChain(t)
+	assert.NoError(t, hc.AddHeaders(chain.FindHeaders(nil, 100)))
+	var confirmations []int
+	for _, proof := range proofs {
+		confirmation, err := hc.VerifyProof(proof)
+		assert.NoError(t, err)
+		confirmations = append(confirmations, confirmation)
+	}
+	assert.Equal(t, []int{4, 3, 3}, confirmations)
+
+	// A proof of another transaction does not verify
+	forged := *proofs[2]
+	forged.Transaction = block.Transactions[0]
+	_, err = hc.VerifyProof(&forged)
+	assert.Error(t, err)
+
+	// The payer keeps the coinbase and the change, the genesis coinbase is spent
+	outputs := SPVUnspentOutputs(proofs, confirmations, wallet.PublicKeyHash(w.PublicKey))
+	assert.Equal(t, []SPVOutput{
+		{block.Transactions[0].ID, 0, BlockSubsidy(1) + 1, 3},
+		{pay.ID, 1, pay.Outputs[1].Value, 3},
+	}, outputs)
+	outputs = SPVUnspentOutputs(proofs, confirmations, wallet.PublicKeyHash(other.PublicKey))
+	assert.Equal(t, []SPVOutput{{pay.ID, 0, 5, 3}}, outputs)
+}
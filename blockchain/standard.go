@@ -0,0 +1,173 @@
+package blockchain
+
+import "github.com/argonautts/golang-blockchain/wallet"
+
+// ScriptClass identifies the standard template a locking script follows.
+type ScriptClass int
+
+const (
+	NonStandardScript ScriptClass = iota // Any script not following a template
+	PubKeyHashScript                     // Pays to the hash of a public key
+	MultisigScript                       // Needs M of N signatures from listed public keys
+	ScriptHashScript                     // Pays to the hash of a redeem script revealed by the spender
+	HTLCScript                           // Hash time-locked contract, see HTLCLockingScript
+	NullDataScript                       // Carries data and can never be spent
+)
+
+// MaxNullDataSize is the largest amount of data a null-data output may carry.
+const MaxNullDataSize = 80
+
+// PayToPubKeyHashScript returns the locking script paying to the hash of a public key:
+// OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG.
+func PayToPubKeyHashScript(pubKeyHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubKeyHash).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// MultisigLockingScript returns the locking script needing the given number of signatures from
+// the public keys: <required> <pubKey>... <count> OP_CHECKMULTISIG.
+func MultisigLockingScript(required int, pubKeys [][]byte) []byte {
+	builder := NewScriptBuilder().AddInt(int64(required))
+	for _, pubKey := range pubKeys {
+		builder.AddData(pubKey)
+	}
+
+	return builder.AddInt(int64(len(pubKeys))).AddOp(OP_CHECKMULTISIG).Script()
+}
+
+// PayToScriptHashScript returns the locking script paying to the hash of a redeem script:
+// OP_HASH160 <scriptHash> OP_EQUAL.
+func PayToScriptHashScript(scriptHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OP_HASH160).AddData(scriptHash).AddOp(OP_EQUAL).Script()
+}
+
+// NullDataLockingScript returns the provably unspendable script carrying data: OP_RETURN <data>.
+func NullDataLockingScript(data []byte) []byte {
+	return NewScriptBuilder().AddOp(OP_RETURN).AddData(data).Script()
+}
+
+// smallInt returns the number pushed by an OP_1 to OP_16 operation.
+func smallInt(op parsedOp) (int, bool) {
+	if op.Code < OP_1 || op.Code > OP_16 {
+		return 0, false
+	}
+
+	return int(op.Code-OP_1) + 1, true
+}
+
+// parseMultisig returns the required signatures and public keys of a multisig locking script.
+func parseMultisig(ops []parsedOp) (int, [][]byte, bool) {
+	if len(ops) < 4 || ops[len(ops)-1].Code != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+	required, ok := smallInt(ops[0])
+	if !ok {
+		return 0, nil, false
+	}
+	count, ok := smallInt(ops[len(ops)-2])
+	if !ok || count != len(ops)-3 || required > count || count > wallet.MaxMultisigKeys {
+		return 0, nil, false
+	}
+
+	var pubKeys [][]byte
+	for _, op := range ops[1 : len(ops)-2] {
+		if op.Code == OP_0 || !op.isPush() || len(op.Data) == 0 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, op.Data)
+	}
+
+	return required, pubKeys, true
+}
+
+// ClassifyScript returns the standard template a locking script follows.
+func ClassifyScript(script []byte) ScriptClass {
+	ops, err := parseScript(script)
+	if err != nil {
+		return NonStandardScript
+	}
+
+	if len(ops) == 5 && ops[0].Code == OP_DUP && ops[1].Code == OP_HASH160 && len(ops[2].Data) == 20 &&
+		ops[3].Code == OP_EQUALVERIFY && ops[4].Code == OP_CHECKSIG {
+		return PubKeyHashScript
+	}
+	if len(ops) == 2 && ops[0].Code == OP_RETURN && ops[1].isPush() && len(ops[1].Data) <= MaxNullDataSize {
+		return NullDataScript
+	}
+	if len(ops) == 3 && ops[0].Code == OP_HASH160 && len(ops[1].Data) == 20 && ops[2].Code == OP_EQUAL {
+		return ScriptHashScript
+	}
+	if _, _, ok := parseMultisig(ops); ok {
+		return MultisigScript
+	}
+	if _, ok := ExtractHTLC(script); ok {
+		return HTLCScript
+	}
+
+	return NonStandardScript
+}
+
+// ExtractMultisig returns the required signatures and public keys of a multisig locking script.
+func ExtractMultisig(script []byte) (int, [][]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil {
+		return 0, nil, false
+	}
+
+	return parseMultisig(ops)
+}
+
+// ExtractNullData returns the data carried by a null-data script.
+func ExtractNullData(script []byte) ([]byte, bool) {
+	if ClassifyScript(script) != NullDataScript {
+		return nil, false
+	}
+	ops, _ := parseScript(script)
+
+	return ops[1].Data, true
+}
+
+// IsUnspendable checks whether a locking script starts with OP_RETURN, which fails any spend. Such
+// outputs are kept out of the UTXO set.
+func IsUnspendable(script []byte) bool {
+	return len(script) > 0 && script[0] == OP_RETURN
+}
+
+// ExtractAddressHash returns the hash of the address a standard locking script pays to: the public
+// key hash, the hash of the multisig policy or the hash of the redeem script. It returns nil for
+// non-standard scripts.
+func ExtractAddressHash(script []byte) []byte {
+	switch ClassifyScript(script) {
+	case PubKeyHashScript:
+		ops, _ := parseScript(script)
+		return ops[2].Data
+	case MultisigScript:
+		required, pubKeys, _ := ExtractMultisig(script)
+		return wallet.PublicKeyHash(wallet.MultisigPolicy(required, pubKeys))
+	case ScriptHashScript:
+		ops, _ := parseScript(script)
+		return ops[1].Data
+	}
+
+	return nil
+}
+
+// LockingScriptForAddress returns the standard locking script paying to an address.
+func LockingScriptForAddress(address string) []byte {
+	if wallet.IsMultisigAddress(address) {
+		required, pubKeys, err := wallet.ParseMultisigAddress(address)
+		Handle(err)
+		return MultisigLockingScript(required, pubKeys)
+	}
+	if wallet.IsScriptHashAddress(address) {
+		return PayToScriptHashScript(wallet.AddressHash(address))
+	}
+
+	return PayToPubKeyHashScript(wallet.AddressHash(address))
+}
+
+// MultisigScriptHashAddress returns the pay-to-script-hash address of a multisig policy, which can be
+// paid without knowing the keys behind it.
+func MultisigScriptHashAddress(required int, pubKeys [][]byte) []byte {
+	return wallet.ScriptHashAddress(MultisigLockingScript(required, pubKeys))
+}
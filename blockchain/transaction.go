@@ -15,50 +15,172 @@ import (
 	"strings"
 )
 
+var (
+	InitialSubsidy  = 20   // Amount of new coins a coinbase transaction may create in the first blocks
+	HalvingInterval = 1000 // Number of blocks after which the subsidy is halved
+)
+
+// BlockSubsidy returns the amount of new coins the coinbase of a block at the given height may create.
+func BlockSubsidy(height int) int {
+	halvings := height / HalvingInterval
+	if halvings >= 63 {
+		return 0 // The subsidy has been halved down to nothing
+	}
+
+	return InitialSubsidy >> uint(halvings)
+}
+
+const (
+	LockTimeThreshold = 500000000  // Lock times below this are block heights, from it on unix timestamps
+	MaxSequence       = 0xffffffff // Sequence number of an input that does not enable the lock time
+
+	// A sequence number also holds a relative lock on the output the input spends: the input is only
+	// valid a number of blocks, or of 512 second units, after the output was confirmed.
+	SequenceLockDisabled = 1 << 31 // Set when the sequence number holds no relative lock
+	SequenceLockTypeTime = 1 << 22 // Set when the relative lock counts time instead of blocks
+	SequenceLockMask     = 0xffff  // Bits holding the length of the relative lock
+	SequenceLockTimeUnit = 9       // The time lock counts units of 1 << 9 = 512 seconds
+)
+
+// Versions of the transaction format.
+const (
+	LegacyTxVersion = 0 // Transactions recorded in the gob encoding of earlier versions
+	TxVersion       = 1 // Transactions created by this node, identified by their binary encoding
+)
+
 // Transaction represents a blockchain transaction with inputs and outputs.
 type Transaction struct {
-	ID      []byte     // Unique identifier of the transaction
-	Inputs  []TxInput  // Inputs to the transaction
-	Outputs []TxOutput // Outputs from the transaction
+	Version  uint32     // Version of the transaction format
+	ID       []byte     // Unique identifier of the transaction
+	Inputs   []TxInput  // Inputs to the transaction
+	Outputs  []TxOutput // Outputs from the transaction
+	LockTime uint32     // Height or unix time before which the transaction cannot be included in a block
 }
 
 // Hash generates a hash of the transaction, used as its ID.
 func (tx *Transaction) Hash() []byte {
+	// The gob encoding legacy IDs were hashed from cannot be reproduced, so they are kept as recorded
+	if tx.Version == LegacyTxVersion {
+		return tx.ID
+	}
+
 	var hash [32]byte
 
 	txCopy := *tx
-	txCopy.ID = []byte{} // Resetting the ID field to hash the rest of the transaction
+	txCopy.ID = nil // Resetting the ID field to hash the rest of the transaction
+
+	// Unlocking scripts are added after the ID is set, so they are left out of the hash.
+	// The coinbase keeps its data, which makes its ID unique.
+	if !tx.IsCoinbase() {
+		txCopy.Inputs = make([]TxInput, len(tx.Inputs))
+		for i, in := range tx.Inputs {
+			txCopy.Inputs[i] = TxInput{in.ID, in.Out, nil, in.Sequence}
+		}
+	}
 
 	hash = sha256.Sum256(txCopy.Serialize()) // Hashing the serialized transaction
 
 	return hash[:]
 }
 
-// Serialize converts the transaction to a byte slice for storage or transmission.
+// Serialize converts the transaction to its binary encoding for storage or transmission.
 func (tx Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
+	w := newRecordWriter(txRecord)
+	tx.encode(w)
 
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
-	if err != nil {
-		log.Panic(err)
+	return w.Bytes()
+}
+
+// encode writes the transaction without the envelope of a record.
+func (tx *Transaction) encode(w *binaryWriter) {
+	w.writeUint32(tx.Version)
+	if tx.Version == LegacyTxVersion {
+		w.writeVarBytes(tx.ID)
+	}
+
+	w.writeVarInt(uint64(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		w.writeVarBytes(in.ID)
+		w.writeUint32(uint32(in.Out)) // The -1 of the coinbase becomes 0xffffffff
+		w.writeVarBytes(in.UnlockingScript)
+		w.writeUint32(in.Sequence)
+	}
+
+	w.writeVarInt(uint64(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		w.writeInt64(int64(out.Value))
+		w.writeVarBytes(out.LockingScript)
+	}
+
+	w.writeUint32(tx.LockTime)
+}
+
+// decodeTransaction reads a transaction written by encode. The ID of a current transaction is
+// derived from its content.
+func decodeTransaction(r *binaryReader) *Transaction {
+	tx := &Transaction{}
+	tx.Version = r.readUint32()
+	if tx.Version == LegacyTxVersion {
+		tx.ID = r.readVarBytes()
+	}
+
+	for i, n := 0, r.readCount(); i < n; i++ {
+		var in TxInput
+		in.ID = r.readVarBytes()
+		in.Out = int(int32(r.readUint32()))
+		in.UnlockingScript = r.readVarBytes()
+		in.Sequence = r.readUint32()
+		tx.Inputs = append(tx.Inputs, in)
+	}
+
+	for i, n := 0, r.readCount(); i < n; i++ {
+		var out TxOutput
+		out.Value = int(r.readInt64())
+		out.LockingScript = r.readVarBytes()
+		tx.Outputs = append(tx.Outputs, out)
 	}
 
-	return encoded.Bytes()
+	tx.LockTime = r.readUint32()
+	if r.err == nil && tx.Version != LegacyTxVersion {
+		tx.ID = tx.Hash()
+	}
+
+	return tx
 }
 
-// DeserializeTransaction converts a byte slice back into a Transaction struct.
+// DeserializeTransaction converts a byte slice back into a Transaction struct. Transactions
+// written in gob by earlier versions are still read.
 func DeserializeTransaction(data []byte) Transaction {
 	var transaction Transaction
 
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-	err := decoder.Decode(&transaction)
+	if !isBinaryEncoding(data) {
+		decoder := gob.NewDecoder(bytes.NewReader(data))
+		err := decoder.Decode(&transaction)
+		Handle(err)
+		return transaction
+	}
+
+	tx, err := DeserializeTx(data)
 	Handle(err)
-	return transaction
+
+	return *tx
+}
+
+// DeserializeTx decodes a transaction from its binary encoding, failing on malformed data instead
+// of panicking, for transactions that come from outside the database.
+func DeserializeTx(data []byte) (*Transaction, error) {
+	r := newRecordReader(data, txRecord)
+	tx := decodeTransaction(r)
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+
+	return tx, nil
 }
 
 // CoinbaseTx creates a new coinbase transaction, which is the first transaction in a block.
-func CoinbaseTx(to, data string) *Transaction {
+// The value must not exceed the block subsidy plus the fees of the block.
+func CoinbaseTx(to, data string, value int) *Transaction {
 	if data == "" {
 		randData := make([]byte, 24)
 		_, err := rand.Read(randData)
@@ -66,24 +188,32 @@ func CoinbaseTx(to, data string) *Transaction {
 		data = fmt.Sprintf("%x", randData) // Generating a random data if none provided
 	}
 
-	txin := TxInput{[]byte{}, -1, nil, []byte(data)} // Creating a special input for coinbase transaction
-	txout := NewTXOutput(20, to)                     // Creating output for the transaction
+	txin := TxInput{[]byte{}, -1, NewScriptBuilder().AddData([]byte(data)).Script(), MaxSequence} // Creating a special input for coinbase transaction
+	txout := NewTXOutput(value, to)                                                               // Creating output for the transaction
 
-	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
+	tx := Transaction{TxVersion, nil, []TxInput{txin}, []TxOutput{*txout}, 0}
 	tx.ID = tx.Hash() // Setting the transaction ID as the hash of the transaction
 
 	return &tx
 }
 
-// NewTransaction creates a new regular transaction from a wallet to a target address.
-func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Transaction {
+// NewTransaction creates a new regular transaction from a wallet to a target address,
+// leaving the given fee to the miner. A non-zero lock time holds the transaction back until
+// that height or unix time.
+func NewTransaction(w *wallet.Wallet, to string, amount, fee int, lockTime uint32, UTXO *UTXOSet) *Transaction {
 	var inputs []TxInput
 	var outputs []TxOutput
 
+	// The lock time is only enforced if one of the inputs is not final
+	sequence := uint32(MaxSequence)
+	if lockTime != 0 {
+		sequence = MaxSequence - 1
+	}
+
 	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount+fee)
 
-	if acc < amount {
+	if acc < amount+fee {
 		log.Panic("ERROR: Not enough funds")
 	}
 
@@ -93,7 +223,7 @@ func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Tra
 		Handle(err)
 
 		for _, out := range outs {
-			input := TxInput{txID, out, nil, w.PublicKey}
+			input := TxInput{txID, out, nil, sequence}
 			inputs = append(inputs, input)
 		}
 	}
@@ -103,104 +233,407 @@ func NewTransaction(w *wallet.Wallet, to string, amount int, UTXO *UTXOSet) *Tra
 	// Creating output for the receiver
 	outputs = append(outputs, *NewTXOutput(amount, to))
 
-	// Creating a change output if needed
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	// Creating a change output if needed, whatever is not paid out is the fee
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from))
 	}
 
-	tx := Transaction{nil, inputs, outputs}
+	tx := Transaction{TxVersion, nil, inputs, outputs, lockTime}
 	tx.ID = tx.Hash()                                  // Setting the transaction ID
 	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey) // Signing the transaction
 
 	return &tx
 }
 
+// NewDataTransaction creates a transaction embedding data in a null-data output, paid for by the
+// wallet with the given fee. Whatever the fee does not use is sent back as change.
+func NewDataTransaction(w *wallet.Wallet, data []byte, fee int, UTXO *UTXOSet) *Transaction {
+	var inputs []TxInput
+
+	if len(data) > MaxNullDataSize {
+		log.Panicf("ERROR: Data is larger than %d bytes", MaxNullDataSize)
+	}
+
+	// At least one input is needed, even without a fee
+	needed := fee
+	if needed == 0 {
+		needed = 1
+	}
+	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, needed)
+
+	if acc < needed {
+		log.Panic("ERROR: Not enough funds")
+	}
+
+	// Building a list of inputs
+	for txid, outs := range validOutputs {
+		txID, err := hex.DecodeString(txid)
+		Handle(err)
+
+		for _, out := range outs {
+			inputs = append(inputs, TxInput{txID, out, nil, MaxSequence})
+		}
+	}
+
+	outputs := []TxOutput{{0, NullDataLockingScript(data)}}
+	if acc > fee {
+		outputs = append(outputs, *NewTXOutput(acc-fee, string(w.Address())))
+	}
+
+	tx := Transaction{TxVersion, nil, inputs, outputs, 0}
+	tx.ID = tx.Hash()                                  // Setting the transaction ID
+	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey) // Signing the transaction
+
+	return &tx
+}
+
+// NewMultisigTransaction creates an unsigned transaction spending outputs of a multisig address,
+// sending the change back to it. With scriptHash set, the outputs of the pay-to-script-hash
+// address of the policy are spent instead, revealing the policy. The holders of the keys then add
+// their signatures in turn.
+func NewMultisigTransaction(from, to string, amount, fee int, scriptHash bool, UTXO *UTXOSet) *Transaction {
+	var inputs []TxInput
+	var outputs []TxOutput
+
+	required, pubKeys, err := wallet.ParseMultisigAddress(from)
+	Handle(err)
+	if scriptHash {
+		from = string(MultisigScriptHashAddress(required, pubKeys))
+	}
+	acc, validOutputs := UTXO.FindSpendableOutputs(wallet.AddressHash(from), amount+fee)
+
+	if acc < amount+fee {
+		log.Panic("ERROR: Not enough funds")
+	}
+
+	// Building a list of inputs with an empty signature slot for every key
+	emptySlots := NewScriptBuilder()
+	for range pubKeys {
+		emptySlots.AddOp(OP_0)
+	}
+	if scriptHash {
+		emptySlots.AddData(MultisigLockingScript(required, pubKeys)) // Revealing the redeem script
+	}
+	for txid, outs := range validOutputs {
+		txID, err := hex.DecodeString(txid)
+		Handle(err)
+
+		for _, out := range outs {
+			input := TxInput{txID, out, emptySlots.Script(), MaxSequence}
+			inputs = append(inputs, input)
+		}
+	}
+
+	// Creating output for the receiver and the change
+	outputs = append(outputs, *NewTXOutput(amount, to))
+	if acc > amount+fee {
+		outputs = append(outputs, *NewTXOutput(acc-amount-fee, from))
+	}
+
+	tx := Transaction{TxVersion, nil, inputs, outputs, 0}
+	tx.ID = tx.Hash() // Setting the transaction ID
+
+	return &tx
+}
+
 // IsCoinbase checks if the transaction is a coinbase transaction.
 func (tx *Transaction) IsCoinbase() bool {
 	// Coinbase transaction has one input with no ID and a -1 Out index.
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
-// Sign signs each input of the transaction.
+// SequenceLockBlocks returns the sequence number of an input that can only be spent the given
+// number of blocks after the output it spends was confirmed.
+func SequenceLockBlocks(blocks uint16) uint32 {
+	return uint32(blocks)
+}
+
+// SequenceLockSeconds returns the sequence number of an input that can only be spent the given
+// number of seconds, rounded up to 512 second units, after the output it spends was confirmed.
+func SequenceLockSeconds(seconds uint32) uint32 {
+	units := (seconds + 1<<SequenceLockTimeUnit - 1) >> SequenceLockTimeUnit
+	if units > SequenceLockMask {
+		units = SequenceLockMask
+	}
+
+	return SequenceLockTypeTime | units
+}
+
+// IsFinal checks whether the lock time of the transaction allows it into a block at the given height
+// whose median time past is blockTime.
+func (tx *Transaction) IsFinal(height int, blockTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+
+	// Comparing against a height or a time, depending on the kind of lock time
+	lockedUntil := int64(height)
+	if tx.LockTime >= LockTimeThreshold {
+		lockedUntil = blockTime
+	}
+	if int64(tx.LockTime) < lockedUntil {
+		return true
+	}
+
+	// The lock time is ignored when every input is final
+	for _, in := range tx.Inputs {
+		if in.Sequence != MaxSequence {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Sign signs each input of the transaction the key can unlock. Inputs spending a pay-to-pubkey-hash
+// output of the key get the signature and the public key. Inputs spending a multisig output get the signature in the slot of
+// the signing key, and are left alone if the key is not part of the policy. Inputs spending a
+// pay-to-script-hash output are signed for the redeem script their unlocking script ends with.
+// The signatures commit to the whole transaction.
 func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+	tx.SignWithHashType(privKey, prevTXs, SigHashAll)
+}
+
+// SignWithHashType signs each input of the transaction like Sign, committing to the parts of the
+// transaction selected by the hash type.
+func (tx *Transaction) SignWithHashType(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction, hashType SigHashType) {
 	if tx.IsCoinbase() {
 		return // Coinbase transactions don't require a signature.
 	}
 
-	txCopy := tx.TrimmedCopy() // Creating a trimmed copy for signing
+	pubKey := wallet.EncodePublicKey(privKey.PublicKey)
 
-	for inId, in := range txCopy.Inputs {
+	for inId, in := range tx.Inputs {
 		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-
-		dataToSign := fmt.Sprintf("%x\n", txCopy)
+		prevOut := prevTX.Outputs[in.Out]
 
-		// Signing the data
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, []byte(dataToSign))
+		// Signing the hash of the input
+		hash, err := tx.SignatureHash(inId, prevOut, hashType)
+		if err != nil {
+			continue // SINGLE cannot cover inputs without a matching output
+		}
+		r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash)
 		Handle(err)
-		signature := append(r.Bytes(), s.Bytes()...)
+		signature := encodeSignature(r, s, hashType)
 
-		tx.Inputs[inId].Signature = signature
-		txCopy.Inputs[inId].PubKey = nil
+		pushed, err := parseScript(in.UnlockingScript)
+		if err != nil {
+			continue // Leaving scripts we cannot read alone
+		}
+		if ClassifyScript(prevOut.LockingScript) != ScriptHashScript {
+			if unlocking, ok := signTemplate(prevOut.LockingScript, pushed, pubKey, signature); ok {
+				tx.Inputs[inId].UnlockingScript = unlocking
+			}
+			continue
+		}
+
+		// The redeem script must already be in place and match the hash of the output
+		if len(pushed) == 0 {
+			continue
+		}
+		redeemScript := pushed[len(pushed)-1].Data
+		if !bytes.Equal(wallet.PublicKeyHash(redeemScript), prevOut.PubKeyHash()) {
+			continue
+		}
+		if unlocking, ok := signTemplate(redeemScript, pushed[:len(pushed)-1], pubKey, signature); ok {
+			tx.Inputs[inId].UnlockingScript = append(unlocking, NewScriptBuilder().AddData(redeemScript).Script()...)
+		}
 	}
 }
 
-// Verify verifies the signatures of Transaction inputs.
+// signTemplate returns the unlocking script of a standard locking script signed with a key, given
+// the data already pushed for it. It reports false for scripts following no known template.
+func signTemplate(locking []byte, pushed []parsedOp, pubKey, signature []byte) ([]byte, bool) {
+	switch ClassifyScript(locking) {
+	case PubKeyHashScript:
+		if !bytes.Equal(wallet.PublicKeyHash(pubKey), ExtractAddressHash(locking)) {
+			return nil, false // Inputs of other keys are left to them
+		}
+		return NewScriptBuilder().AddData(signature).AddData(pubKey).Script(), true
+	case MultisigScript:
+		_, pubKeys, _ := ExtractMultisig(locking)
+		return signMultisigSlot(pushed, pubKeys, pubKey, signature), true
+	case HTLCScript:
+		return signHTLC(locking, pushed, pubKey, signature)
+	}
+
+	return nil, false
+}
+
+// signMultisigSlot returns the unlocking script of a multisig input with the signature placed in
+// the slot of the signing key, keeping the signatures already pushed.
+func signMultisigSlot(pushed []parsedOp, pubKeys [][]byte, pubKey, signature []byte) []byte {
+	slots := make([][]byte, len(pubKeys))
+	if len(pushed) == len(pubKeys) {
+		for i, op := range pushed {
+			slots[i] = op.Data
+		}
+	}
+
+	builder := NewScriptBuilder()
+	for i, key := range pubKeys {
+		if bytes.Equal(key, pubKey) {
+			slots[i] = signature
+		}
+		builder.AddData(slots[i])
+	}
+
+	return builder.Script()
+}
+
+// signHTLC returns the unlocking script of a hash time-locked contract with the signature and key
+// filled in, keeping the branch chosen by the data already pushed. It reports false if the key is
+// not the one the branch pays to.
+func signHTLC(contract []byte, pushed []parsedOp, pubKey, signature []byte) ([]byte, bool) {
+	htlc, _ := ExtractHTLC(contract)
+	if len(pushed) < 3 {
+		return nil, false
+	}
+
+	// The last element chooses between redeeming with the secret and the refund
+	payee := htlc.Refund
+	if selector := pushed[len(pushed)-1]; selector.Code != OP_0 {
+		payee = htlc.Recipient
+	}
+	if !bytes.Equal(wallet.PublicKeyHash(pubKey), payee) {
+		return nil, false
+	}
+
+	builder := NewScriptBuilder().AddData(signature).AddData(pubKey)
+	for _, op := range pushed[2:] {
+		if n, ok := smallInt(op); ok {
+			builder.AddInt(int64(n))
+		} else {
+			builder.AddData(op.Data)
+		}
+	}
+
+	return builder.Script(), true
+}
+
+// Verify verifies the unlocking scripts of Transaction inputs.
 func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
 	if tx.IsCoinbase() {
 		return true // Coinbase transactions don't require verification.
 	}
 
-	txCopy := tx.TrimmedCopy() // Creating a trimmed copy for verification
-	curve := elliptic.P256()   // Using P256 elliptic curve
+	// Collecting the outputs spent by the inputs
+	var prevOuts []TxOutput
+	for _, in := range tx.Inputs {
+		prevTx := prevTXs[hex.EncodeToString(in.ID)]
+		if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+			return false // Referenced output does not exist.
+		}
+		prevOuts = append(prevOuts, prevTx.Outputs[in.Out])
+	}
+
+	return tx.verifyScripts(prevOuts) == nil
+}
+
+// verifyScripts runs the unlocking script of every input against the locking script of the output
+// it spends.
+func (tx *Transaction) verifyScripts(prevOuts []TxOutput) error {
+	if len(prevOuts) != len(tx.Inputs) {
+		return fmt.Errorf("%w: %d inputs spend %d outputs", ErrScriptFailed, len(tx.Inputs), len(prevOuts))
+	}
 
 	for inId, in := range tx.Inputs {
-		prevTx := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inId].Signature = nil
-		txCopy.Inputs[inId].PubKey = prevTx.Outputs[in.Out].PubKeyHash
+		checker := txSigChecker{tx, inId, prevOuts[inId]}
+		if err := VerifyScript(in.UnlockingScript, prevOuts[inId].LockingScript, checker); err != nil {
+			return fmt.Errorf("input %d: %w", inId, err)
+		}
+	}
 
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
+	return nil // All scripts succeeded.
+}
 
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
+// txSigChecker checks signatures and locks for one input of a transaction.
+type txSigChecker struct {
+	tx      *Transaction // The spending transaction
+	inIdx   int          // Index of the input being verified
+	prevOut TxOutput     // The output spent by the input
+}
 
-		dataToVerify := fmt.Sprintf("%x\n", txCopy)
+// CheckSig checks a signature of the transaction against a public key. The last byte of the
+// signature is the hash type selecting what it commits to. Keys must have both coordinates padded,
+// since an unpadded key cannot be split back into them.
+func (c txSigChecker) CheckSig(signature, pubKey []byte) bool {
+	if len(pubKey) != 2*coordinateSize || len(signature) != 2*coordinateSize+1 {
+		return false
+	}
 
-		rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
-		if ecdsa.Verify(&rawPubKey, []byte(dataToVerify), &r, &s) == false {
-			return false // Signature does not match.
-		}
-		txCopy.Inputs[inId].PubKey = nil
+	hashType := SigHashType(signature[len(signature)-1])
+	hash, err := c.tx.SignatureHash(c.inIdx, c.prevOut, hashType)
+	if err != nil {
+		return false
 	}
 
-	return true // All signatures are valid.
+	return verifySignature(pubKey, signature[:len(signature)-1], hash)
 }
 
-// TrimmedCopy creates a copy of the transaction to be used in signing and verification.
-func (tx *Transaction) TrimmedCopy() Transaction {
-	var inputs []TxInput
-	var outputs []TxOutput
+// CheckLockTime checks that the transaction cannot be included in a block before the given height
+// or time: its lock time must be of the same kind and at least as late, and enforced by the input.
+func (c txSigChecker) CheckLockTime(lockTime int64) bool {
+	txLockTime := int64(c.tx.LockTime)
+	if (lockTime < LockTimeThreshold) != (txLockTime < LockTimeThreshold) {
+		return false
+	}
+	if lockTime > txLockTime {
+		return false
+	}
 
-	// Copying inputs and outputs without the signature and public key.
-	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil})
+	return c.tx.Inputs[c.inIdx].Sequence != MaxSequence
+}
+
+// CheckSequence checks that the relative lock of the input is of the same kind as the given one
+// and at least as long.
+func (c txSigChecker) CheckSequence(sequence int64) bool {
+	if sequence&SequenceLockDisabled != 0 {
+		return true // The operation acts as a no-op
 	}
 
-	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+	inSequence := int64(c.tx.Inputs[c.inIdx].Sequence)
+	if inSequence&SequenceLockDisabled != 0 {
+		return false
+	}
+	if sequence&SequenceLockTypeTime != inSequence&SequenceLockTypeTime {
+		return false
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	return sequence&SequenceLockMask <= inSequence&SequenceLockMask
+}
+
+// encodeSignature encodes an ECDSA signature as r and s padded to the size of a coordinate,
+// followed by the hash type.
+func encodeSignature(r, s *big.Int, hashType SigHashType) []byte {
+	signature := make([]byte, 2*coordinateSize+1)
+	r.FillBytes(signature[:coordinateSize])
+	s.FillBytes(signature[coordinateSize : 2*coordinateSize])
+	signature[2*coordinateSize] = byte(hashType)
+
+	return signature
+}
+
+// verifySignature checks an ECDSA signature of a hash against a public key.
+func verifySignature(pubKey, signature []byte, hash []byte) bool {
+	curve := elliptic.P256() // Using P256 elliptic curve
+
+	r := big.Int{}
+	s := big.Int{}
+	sigLen := len(signature)
+	r.SetBytes(signature[:(sigLen / 2)])
+	s.SetBytes(signature[(sigLen / 2):])
+
+	x := big.Int{}
+	y := big.Int{}
+	keyLen := len(pubKey)
+	x.SetBytes(pubKey[:(keyLen / 2)])
+	y.SetBytes(pubKey[(keyLen / 2):])
+
+	rawPubKey := ecdsa.PublicKey{Curve: curve, X: &x, Y: &y}
 
-	return txCopy
+	return ecdsa.Verify(&rawPubKey, hash, &r, &s)
 }
 
 // String returns a human-readable representation of the transaction.
@@ -212,15 +645,16 @@ func (tx Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:     %x", input.ID))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Out))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
-		lines = append(lines, fmt.Sprintf("       PubKey:    %x", input.PubKey))
+		lines = append(lines, fmt.Sprintf("       Script:    %s", DisasmScript(input.UnlockingScript)))
+		lines = append(lines, fmt.Sprintf("       Sequence:  %x", input.Sequence))
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("       Script: %s", DisasmScript(output.LockingScript)))
 	}
+	lines = append(lines, fmt.Sprintf("     LockTime: %d", tx.LockTime))
 
 	return strings.Join(lines, "\n")
 }
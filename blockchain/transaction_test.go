@@ -0,0 +1,41 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBlockSubsidyHalving(t *testing.T) {
+	tests := []struct {
+		height  int
+		subsidy int
+	}{
+		{0, InitialSubsidy},
+		{HalvingInterval - 1, InitialSubsidy},
+		{HalvingInterval, InitialSubsidy / 2},
+		{4*HalvingInterval - 1, InitialSubsidy >> 3},
+		{4 * HalvingInterval, InitialSubsidy >> 4},
+		{5*HalvingInterval - 1, 1},
+		{5 * HalvingInterval, 0},
+		{63 * HalvingInterval, 0},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.subsidy, BlockSubsidy(test.height), "Subsidy at height %d", test.height)
+	}
+
+	// A coinbase paying nothing is valid once the subsidy is gone
+	height := 5 * HalvingInterval
+	coinbase := CoinbaseTx("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", "data", BlockSubsidy(height))
+	assert.NoError(t, checkTransactionSanity(coinbase))
+	assert.NoError(t, checkCoinbaseValue(coinbase, 0, height))
+	assert.NoError(t, checkCoinbaseValue(CoinbaseTx("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", "data", 3), 3, height), "Fees are still claimed")
+	err := checkCoinbaseValue(CoinbaseTx("1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2", "data", 1), 0, height)
+	assert.True(t, errors.Is(err, ErrBadCoinbaseValue), "Coinbase cannot claim a subsidy that is gone")
+
+	// Other transactions still need positive outputs
+	spend := &Transaction{TxVersion, nil, []TxInput{{coinbase.ID, 0, nil, MaxSequence}}, []TxOutput{*NewTXOutput(0, "1BvBMSEYstWetqTFn5Au4m4GFg7xJaNVN2")}, 0}
+	spend.ID = spend.Hash()
+	assert.True(t, errors.Is(checkTransactionSanity(spend), ErrBadTransaction))
+}
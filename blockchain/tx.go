@@ -3,45 +3,49 @@ package blockchain
 import (
 	"bytes"
 	"encoding/gob"
-	"github.com/argonautts/golang-blockchain/wallet"
 )
 
 // TxOutput represents a transaction output.
 type TxOutput struct {
-	Value      int    // The value of coins in the output
-	PubKeyHash []byte // The hash of the public key that can unlock this output
+	Value         int    // The value of coins in the output
+	LockingScript []byte // The script an input has to satisfy to spend the output
 }
 
 // TxOutputs holds multiple transaction outputs.
 type TxOutputs struct {
-	Outputs []TxOutput // Slice of outputs
+	Outputs  []TxOutput // Slice of outputs
+	Indexes  []int      // Position of each output within its transaction
+	Height   int        // Height of the block that created the outputs
+	Coinbase bool       // Whether the outputs were created by a coinbase transaction
 }
 
 // TxInput represents a transaction input.
 type TxInput struct {
-	ID        []byte // The ID of the transaction the output is in
-	Out       int    // The index of the output in the transaction
-	Signature []byte // The signature that unlocks the output
-	PubKey    []byte // The public key corresponding to the address
+	ID              []byte // The ID of the transaction the output is in
+	Out             int    // The index of the output in the transaction
+	UnlockingScript []byte // The script pushing the signatures and keys that unlock the output
+	Sequence        uint32 // Sequence number, anything below MaxSequence enables the lock time
 }
 
-// UsesKey checks whether the input uses a specific public key hash.
-func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
-	lockingHash := wallet.PublicKeyHash(in.PubKey) // Extract the public key hash from the input's public key
+// Lock locks the output to a specific address.
+func (out *TxOutput) Lock(address []byte) {
+	out.LockingScript = LockingScriptForAddress(string(address)) // Using the template of the address kind
+}
 
-	return bytes.Compare(lockingHash, pubKeyHash) == 0 // Compare with the provided public key hash
+// PubKeyHash returns the hash of the public key, or of the multisig policy, the output is paid to.
+// It returns nil if the locking script follows no standard template.
+func (out *TxOutput) PubKeyHash() []byte {
+	return ExtractAddressHash(out.LockingScript)
 }
 
-// Lock locks the output to a specific address.
-func (out *TxOutput) Lock(address []byte) {
-	pubKeyHash := wallet.Base58Decode(address)     // Decoding the address
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4] // Removing the version and checksum
-	out.PubKeyHash = pubKeyHash                    // Setting the public key hash on the output
+// IsMultisig checks if the output needs signatures from several keys.
+func (out *TxOutput) IsMultisig() bool {
+	return ClassifyScript(out.LockingScript) == MultisigScript
 }
 
 // IsLockedWithKey checks if the output is locked with a specific public key hash.
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0 // Compare with the provided public key hash
+	return bytes.Compare(out.PubKeyHash(), pubKeyHash) == 0 // Compare with the provided public key hash
 }
 
 // NewTXOutput creates a new transaction output locked to the given address.
@@ -52,20 +56,47 @@ func NewTXOutput(value int, address string) *TxOutput {
 	return txo
 }
 
-// Serialize serializes TxOutputs for storage.
+// Serialize serializes TxOutputs for storage in the binary encoding.
 func (outs TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outs)
-	Handle(err)
-	return buffer.Bytes()
+	w := newRecordWriter(outputsRecord)
+	w.writeVarInt(uint64(outs.Height))
+	if outs.Coinbase {
+		w.writeByte(1)
+	} else {
+		w.writeByte(0)
+	}
+
+	w.writeVarInt(uint64(len(outs.Outputs)))
+	for i, out := range outs.Outputs {
+		w.writeVarInt(uint64(outs.Indexes[i]))
+		w.writeInt64(int64(out.Value))
+		w.writeVarBytes(out.LockingScript)
+	}
+
+	return w.Bytes()
 }
 
-// DeserializeOutputs deserializes TxOutputs from a byte slice.
+// DeserializeOutputs deserializes TxOutputs from a byte slice. Outputs written in gob by earlier
+// versions are still read.
 func DeserializeOutputs(data []byte) TxOutputs {
 	var outputs TxOutputs
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	err := decode.Decode(&outputs)
-	Handle(err)
+
+	if !isBinaryEncoding(data) {
+		decode := gob.NewDecoder(bytes.NewReader(data))
+		err := decode.Decode(&outputs)
+		Handle(err)
+		return outputs
+	}
+
+	r := newRecordReader(data, outputsRecord)
+	outputs.Height = int(r.readVarInt())
+	outputs.Coinbase = r.readByte() == 1
+
+	for i, n := 0, r.readCount(); i < n; i++ {
+		outputs.Indexes = append(outputs.Indexes, int(r.readVarInt()))
+		outputs.Outputs = append(outputs.Outputs, TxOutput{int(r.readInt64()), r.readVarBytes()})
+	}
+	Handle(r.finish())
+
 	return outputs
 }
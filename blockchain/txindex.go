@@ -0,0 +1,220 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+
+	"github.com/dgraph-io/badger"
+)
+
+var (
+	txIndexPrefix  = []byte("txi-")    // Prefix for the location of every transaction on the best chain
+	txIndexFlagKey = []byte("txindex") // Key present when the transaction index is enabled
+)
+
+// TxLocation tells where a transaction of the best chain is stored.
+type TxLocation struct {
+	BlockHash []byte // Hash of the block containing the transaction
+	Position  int    // Position of the transaction within the block
+}
+
+// Serialize serializes the transaction location in the binary encoding.
+func (loc TxLocation) Serialize() []byte {
+	w := newRecordWriter(txLocRecord)
+	w.writeVarBytes(loc.BlockHash)
+	w.writeVarInt(uint64(loc.Position))
+
+	return w.Bytes()
+}
+
+// DeserializeTxLocation deserializes a byte slice into a transaction location. Locations written
+// in gob by earlier versions are still read.
+func DeserializeTxLocation(data []byte) TxLocation {
+	var loc TxLocation
+
+	if !isBinaryEncoding(data) {
+		decode := gob.NewDecoder(bytes.NewReader(data))
+		err := decode.Decode(&loc)
+		Handle(err)
+		return loc
+	}
+
+	r := newRecordReader(data, txLocRecord)
+	loc.BlockHash = r.readVarBytes()
+	loc.Position = int(r.readVarInt())
+	Handle(r.finish())
+
+	return loc
+}
+
+// txIndexKey builds the database key holding the location of a transaction.
+func txIndexKey(ID []byte) []byte {
+	return append(append([]byte{}, txIndexPrefix...), ID...)
+}
+
+// txIndexEnabled reports whether the transaction index is maintained for this database.
+func txIndexEnabled(txn *badger.Txn) bool {
+	_, err := txn.Get(txIndexFlagKey)
+
+	return err == nil
+}
+
+// indexTransactions records the location of every transaction of a block connected to the best chain.
+func indexTransactions(txn *badger.Txn, block *Block) error {
+	for i, tx := range block.Transactions {
+		loc := TxLocation{block.Hash, i}
+		if err := txn.Set(txIndexKey(tx.ID), loc.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexTransactions removes the transactions of a block disconnected from the best chain.
+func unindexTransactions(txn *badger.Txn, block *Block) error {
+	for _, tx := range block.Transactions {
+		if err := txn.Delete(txIndexKey(tx.ID)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readTxLocation looks a transaction up in the index inside a database transaction.
+func readTxLocation(txn *badger.Txn, ID []byte) (TxLocation, error) {
+	item, err := txn.Get(txIndexKey(ID))
+	if err == badger.ErrKeyNotFound {
+		return TxLocation{}, errors.New("Transaction does not exist")
+	} else if err != nil {
+		return TxLocation{}, err
+	}
+	locData, err := item.Value()
+	if err != nil {
+		return TxLocation{}, err
+	}
+
+	return DeserializeTxLocation(locData), nil
+}
+
+// TxIndexEnabled reports whether the transaction index is maintained for this blockchain.
+func (chain *BlockChain) TxIndexEnabled() bool {
+	enabled := false
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		enabled = txIndexEnabled(txn)
+		return nil
+	})
+	Handle(err)
+
+	return enabled
+}
+
+// ReindexTransactions enables the transaction index and rebuilds it from the best chain.
+// It returns the number of indexed transactions.
+func (chain *BlockChain) ReindexTransactions() int {
+	count := 0
+
+	Handle(chain.requireAllBlocks())
+
+	// Removing stale entries before rebuilding
+	UTXOSet := UTXOSet{Blockchain: chain}
+	UTXOSet.DeleteByPrefix(txIndexPrefix)
+
+	iter := chain.ForwardIterator()
+	for block := iter.Next(); block != nil; block = iter.Next() {
+		err := chain.Database.Update(func(txn *badger.Txn) error {
+			return indexTransactions(txn, block)
+		})
+		Handle(err)
+		count += len(block.Transactions)
+	}
+
+	// Turning the index on only once it is complete
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(txIndexFlagKey, []byte{1})
+	})
+	Handle(err)
+
+	return count
+}
+
+// FindTransactionLocation returns where a transaction of the best chain is stored.
+// It requires the transaction index.
+func (chain *BlockChain) FindTransactionLocation(ID []byte) (TxLocation, error) {
+	var loc TxLocation
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		if !txIndexEnabled(txn) {
+			return errors.New("Transaction index is not enabled")
+		}
+
+		var err error
+		loc, err = readTxLocation(txn, ID)
+		return err
+	})
+
+	return loc, err
+}
+
+// GetTransactionBlock returns the best chain block containing a transaction. Without the
+// transaction index the best chain is searched from the tip.
+func (chain *BlockChain) GetTransactionBlock(ID []byte) (Block, error) {
+	if chain.TxIndexEnabled() {
+		loc, err := chain.FindTransactionLocation(ID)
+		if err != nil {
+			return Block{}, err
+		}
+		return chain.GetBlock(loc.BlockHash)
+	}
+
+	iter := chain.Iterator()
+	for {
+		block := iter.Next()
+		if block == nil {
+			break // The older blocks are pruned
+		}
+		for _, tx := range block.Transactions {
+			if bytes.Equal(tx.ID, ID) {
+				return *block, nil
+			}
+		}
+
+		// Break if the genesis block is reached
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	return Block{}, errors.New("Transaction does not exist")
+}
+
+// Confirmations returns the number of blocks of the best chain confirming a transaction,
+// counting the block that contains it.
+func (chain *BlockChain) Confirmations(ID []byte) (int, error) {
+	block, err := chain.GetTransactionBlock(ID)
+	if err != nil {
+		return 0, err
+	}
+
+	return chain.GetBestHeight() - block.Height + 1, nil
+}
+
+// findIndexedTransaction loads a transaction through the index inside a database transaction.
+func findIndexedTransaction(txn *badger.Txn, ID []byte) (Transaction, error) {
+	loc, err := readTxLocation(txn, ID)
+	if err != nil {
+		return Transaction{}, err
+	}
+	block, err := readBlock(txn, loc.BlockHash)
+	if err != nil {
+		return Transaction{}, err
+	}
+	if loc.Position >= len(block.Transactions) {
+		return Transaction{}, errors.New("Transaction index is corrupted")
+	}
+
+	return *block.Transactions[loc.Position], nil
+}
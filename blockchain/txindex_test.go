@@ -0,0 +1,70 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransactionIndex(t *testing.T) {
+	chain, w := newTestChain(t)
+	other := wallet.MakeWallet()
+	UTXOSet := UTXOSet{chain}
+	genesis := tip(t, chain)
+
+	pay := NewTransaction(w, string(other.Address()), 5, 1, 0, &UTXOSet)
+	block := newTestBlock(genesis, CoinbaseTx(string(w.Address()), "", BlockSubsidy(1)+1), pay)
+	_, err := chain.AddBlock(block)
+	assert.NoError(t, err)
+	extendChain(t, chain, block, 2, string(w.Address()))
+
+	// Without the index the best chain is searched
+	_, err = chain.FindTransactionLocation(pay.ID)
+	assert.EqualError(t, err, "Transaction index is not enabled")
+	confirmations, err := chain.Confirmations(pay.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, confirmations)
+
+	assert.Equal(t, 5, chain.ReindexTransactions())
+	assert.True(t, chain.TxIndexEnabled())
+	loc, err := chain.FindTransactionLocation(pay.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, TxLocation{block.Hash, 1}, loc)
+	tx, err := chain.FindTransaction(pay.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, pay.ID, tx.ID)
+	confirmations, err = chain.Confirmations(pay.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, confirmations)
+	confirmations, err = chain.Confirmations(genesis.Transactions[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, confirmations)
+	_, err = chain.FindTransactionLocation([]byte("unknown"))
+	assert.Error(t, err)
+
+	// A heavier branch without the payment removes it from the index
+	branch := extendChain(t, chain, genesis, 4, string(wallet.MakeWallet().Address()))
+	_, err = chain.FindTransactionLocation(pay.ID)
+	assert.Error(t, err)
+	_, err = chain.Confirmations(pay.ID)
+	assert.Error(t, err)
+	loc, err = chain.FindTransactionLocation(branch.Transactions[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, TxLocation{branch.Hash, 0}, loc)
+	confirmations, err = chain.Confirmations(branch.Transactions[0].ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, confirmations)
+
+	// Rebuilding drops entries left behind
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(txIndexKey(pay.ID), TxLocation{block.Hash, 1}.Serialize())
+	})
+	assert.NoError(t, err)
+	_, err = chain.FindTransactionLocation(pay.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, chain.ReindexTransactions())
+	_, err = chain.FindTransactionLocation(pay.ID)
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+)
+
+// TxProof proves that a transaction is included in a block to anyone holding the block header,
+// such as a light client that only follows the headers of the best chain.
+type TxProof struct {
+	Header      BlockHeader  // Header of the block including the transaction
+	Transaction *Transaction // The proven transaction
+	Proof       MerkleProof  // Path from the transaction to the Merkle root of the header
+}
+
+// TransactionProof builds the proof that a transaction is included in the block.
+func (b *Block) TransactionProof(txID []byte) (*TxProof, error) {
+	var leaves [][]byte
+	position := -1
+	for i, tx := range b.Transactions {
+		leaves = append(leaves, tx.Serialize())
+		if bytes.Equal(tx.ID, txID) {
+			position = i
+		}
+	}
+	if position < 0 {
+		return nil, errors.New("Transaction is not in the block")
+	}
+
+	path := NewMerkleProof(leaves, position)
+	if b.Version >= hardenedMerkleVersion {
+		path = NewHardenedMerkleProof(leaves, position)
+	}
+	proof := &TxProof{b.BlockHeader, b.Transactions[position], path}
+
+	// Blocks recorded in gob committed to leaves that cannot be rebuilt
+	if !proof.Verify() {
+		return nil, errors.New("Merkle proof does not lead to the block header")
+	}
+
+	return proof, nil
+}
+
+// GetTransactionProof builds the proof that a transaction is included in the best chain.
+func (chain *BlockChain) GetTransactionProof(txID []byte) (*TxProof, error) {
+	block, err := chain.GetTransactionBlock(txID)
+	if err != nil {
+		return nil, err
+	}
+
+	return block.TransactionProof(txID)
+}
+
+// VerifyTransactionProof checks that a Merkle proof leads from a transaction to the Merkle root
+// of a block header, hashing the path as the tree of the block version. Checking that the header
+// is part of the best chain is up to the caller.
+func VerifyTransactionProof(header *BlockHeader, tx *Transaction, proof MerkleProof) bool {
+	if len(proof.Siblings) != len(proof.Right) {
+		return false
+	}
+	for _, sibling := range proof.Siblings {
+		if len(sibling) != hashLength {
+			return false
+		}
+	}
+
+	if header.Version >= hardenedMerkleVersion {
+		return bytes.Equal(proof.HardenedRoot(tx.Serialize()), header.MerkleRoot)
+	}
+
+	return bytes.Equal(proof.Root(tx.Serialize()), header.MerkleRoot)
+}
+
+// Verify checks that the proof leads from its transaction to the Merkle root of its header.
+func (p *TxProof) Verify() bool {
+	return VerifyTransactionProof(&p.Header, p.Transaction, p.Proof)
+}
+
+// Serialize encodes the proof in the binary encoding, see encoding.go.
+func (p *TxProof) Serialize() []byte {
+	w := newRecordWriter(txProofRecord)
+	w.buf.Write(p.Header.Serialize())
+
+	txw := &binaryWriter{}
+	p.Transaction.encode(txw)
+	w.writeVarBytes(txw.Bytes())
+
+	w.writeVarInt(uint64(len(p.Proof.Siblings)))
+	for i, sibling := range p.Proof.Siblings {
+		w.buf.Write(sibling)
+		if p.Proof.Right[i] {
+			w.writeByte(1)
+		} else {
+			w.writeByte(0)
+		}
+	}
+
+	return w.Bytes()
+}
+
+// DeserializeTxProof decodes a proof from its binary encoding.
+func DeserializeTxProof(data []byte) (*TxProof, error) {
+	proof := &TxProof{}
+
+	r := newRecordReader(data, txProofRecord)
+	headerData := r.readBytes(HeaderLength)
+	txr := &binaryReader{data: r.readVarBytes()}
+	proof.Transaction = decodeTransaction(txr)
+	if err := txr.finish(); err != nil && r.err == nil {
+		r.err = err
+	}
+
+	for i, n := 0, r.readCount(); i < n; i++ {
+		proof.Proof.Siblings = append(proof.Proof.Siblings, append([]byte{}, r.readBytes(hashLength)...))
+		proof.Proof.Right = append(proof.Proof.Right, r.readByte() == 1)
+	}
+	if err := r.finish(); err != nil {
+		return nil, err
+	}
+
+	header, err := DeserializeHeader(headerData)
+	if err != nil {
+		return nil, err
+	}
+	proof.Header = *header
+
+	return proof, nil
+}
@@ -0,0 +1,103 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+var undoPrefix = []byte("undo-") // Prefix for the undo records of connected blocks
+
+// BlockUndo holds every output spent by a block, in the order the block spent them.
+type BlockUndo struct {
+	Spent []UTXOEntry
+}
+
+// undoKey builds the database key holding the undo record of a block.
+func undoKey(hash []byte) []byte {
+	return append(append([]byte{}, undoPrefix...), hash...)
+}
+
+// Serialize encodes the undo record in the binary encoding.
+func (undo BlockUndo) Serialize() []byte {
+	w := newRecordWriter(undoRecord)
+	w.writeVarInt(uint64(len(undo.Spent)))
+	for _, entry := range undo.Spent {
+		w.writeVarBytes(entry.ID)
+		w.writeVarInt(uint64(entry.Out))
+		w.writeInt64(int64(entry.Output.Value))
+		w.writeVarBytes(entry.Output.LockingScript)
+		w.writeVarInt(uint64(entry.Height))
+		if entry.Coinbase {
+			w.writeByte(1)
+		} else {
+			w.writeByte(0)
+		}
+	}
+
+	return w.Bytes()
+}
+
+// DeserializeUndo decodes an undo record from a byte slice. Records written in gob by earlier
+// versions are still read.
+func DeserializeUndo(data []byte) BlockUndo {
+	var undo BlockUndo
+
+	if !isBinaryEncoding(data) {
+		decoder := gob.NewDecoder(bytes.NewReader(data))
+		err := decoder.Decode(&undo)
+		Handle(err)
+		return undo
+	}
+
+	r := newRecordReader(data, undoRecord)
+	for i, n := 0, r.readCount(); i < n; i++ {
+		var entry UTXOEntry
+		entry.ID = r.readVarBytes()
+		entry.Out = int(r.readVarInt())
+		entry.Output = TxOutput{int(r.readInt64()), r.readVarBytes()}
+		entry.Height = int(r.readVarInt())
+		entry.Coinbase = r.readByte() == 1
+		undo.Spent = append(undo.Spent, entry)
+	}
+	Handle(r.finish())
+
+	return undo
+}
+
+// readUndo loads the undo record of a block. Blocks connected before undo records
+// were kept get theirs rebuilt from the transactions of their ancestors.
+func readUndo(txn *badger.Txn, block *Block) (BlockUndo, error) {
+	item, err := txn.Get(undoKey(block.Hash))
+	if err == nil {
+		undoData, err := item.Value()
+		if err != nil {
+			return BlockUndo{}, err
+		}
+		return DeserializeUndo(undoData), nil
+	} else if err != badger.ErrKeyNotFound {
+		return BlockUndo{}, err
+	}
+
+	undo := BlockUndo{}
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			prevTx, height, err := findTransactionFrom(txn, block, in.ID)
+			if err != nil {
+				return undo, err
+			}
+			if in.Out < 0 || in.Out >= len(prevTx.Outputs) {
+				return undo, fmt.Errorf("output %d of transaction %x does not exist", in.Out, in.ID)
+			}
+			entry := UTXOEntry{in.ID, in.Out, prevTx.Outputs[in.Out], height, prevTx.IsCoinbase()}
+			undo.Spent = append(undo.Spent, entry)
+		}
+	}
+
+	return undo, nil
+}
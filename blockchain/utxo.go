@@ -3,7 +3,7 @@ package blockchain
 import (
 	"bytes"
 	"encoding/hex"
-	"log"
+	"fmt"
 
 	"github.com/dgraph-io/badger"
 )
@@ -13,12 +13,22 @@ var (
 	prefixLength = len(utxoPrefix)
 )
 
+// UTXOEntry is a single output of the UTXO set together with where it was created.
+type UTXOEntry struct {
+	ID       []byte   // ID of the transaction that created the output
+	Out      int      // Index of the output in that transaction
+	Output   TxOutput // The output itself
+	Height   int      // Height of the block that created the output
+	Coinbase bool     // Whether the output was created by a coinbase transaction
+}
+
 // UTXOSet represents the set of unspent transaction outputs (UTXOs) of a blockchain.
 type UTXOSet struct {
 	Blockchain *BlockChain // Reference to the blockchain to which the UTXO set belongs
 }
 
 // FindSpendableOutputs finds and returns unspent outputs to meet a given amount for a public key hash.
+// Coinbase outputs that have not matured yet are left out.
 func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
 	unspentOuts := make(map[string][]int) // Map for storing unspent outputs
 	accumulated := 0                      // Total amount accumulated
@@ -26,6 +36,9 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 
 	// Reading from the database
 	err := db.View(func(txn *badger.Txn) error {
+		height, err := spendHeight(txn) // Height of the block the spending transaction can enter
+		Handle(err)
+
 		opts := badger.DefaultIteratorOptions
 
 		it := txn.NewIterator(opts) // Creating a new iterator
@@ -42,10 +55,14 @@ func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[s
 			outs := DeserializeOutputs(v)       // Deserializing outputs
 
 			// Checking each output
-			for outIdx, out := range outs.Outputs {
+			for i, out := range outs.Outputs {
+				entry := UTXOEntry{k, outs.Indexes[i], out, outs.Height, outs.Coinbase}
+				if checkMaturity(entry, height) != nil {
+					continue // Not spendable yet
+				}
 				if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
 					accumulated += out.Value
-					unspentOuts[txID] = append(unspentOuts[txID], outIdx) // Adding unspent output
+					unspentOuts[txID] = append(unspentOuts[txID], outs.Indexes[i]) // Adding unspent output
 				}
 			}
 		}
@@ -90,6 +107,57 @@ func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
 	return UTXOs // Returning all unspent transaction outputs
 }
 
+// Balance returns the value of the unspent outputs of a public key hash that can be spent now,
+// and the value of the coinbase outputs that have not matured yet.
+func (u UTXOSet) Balance(pubKeyHash []byte) (int, int) {
+	spendable, immature := 0, 0
+	db := u.Blockchain.Database
+
+	err := db.View(func(txn *badger.Txn) error {
+		height, err := spendHeight(txn)
+		Handle(err)
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+			item := it.Item()
+			v, err := item.Value()
+			Handle(err)
+			txID := bytes.TrimPrefix(item.Key(), utxoPrefix)
+			outs := DeserializeOutputs(v)
+
+			for i, out := range outs.Outputs {
+				if !out.IsLockedWithKey(pubKeyHash) {
+					continue
+				}
+				entry := UTXOEntry{txID, outs.Indexes[i], out, outs.Height, outs.Coinbase}
+				if checkMaturity(entry, height) != nil {
+					immature += out.Value
+				} else {
+					spendable += out.Value
+				}
+			}
+		}
+		return nil
+	})
+	Handle(err)
+
+	return spendable, immature
+}
+
+// FindOutput returns an unspent output with the height of the block that created it.
+func (u UTXOSet) FindOutput(txID []byte, index int) (UTXOEntry, error) {
+	var entry UTXOEntry
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		entry, err = findOutput(txn, txID, index)
+		return err
+	})
+
+	return entry, err
+}
+
 // CountTransactions counts the number of transactions in the UTXO set.
 func (u UTXOSet) CountTransactions() int {
 	db := u.Blockchain.Database
@@ -114,9 +182,11 @@ func (u UTXOSet) CountTransactions() int {
 	return counter // Returning the count of transactions
 }
 
-// Reindex rebuilds the UTXO set from the blockchain transactions.
+// Reindex rebuilds the UTXO set from the blockchain transactions. It needs every block, so a
+// pruned blockchain cannot be reindexed.
 func (u UTXOSet) Reindex() {
 	db := u.Blockchain.Database
+	Handle(u.Blockchain.requireAllBlocks())
 
 	// Delete all UTXOs from the database before rebuilding
 	u.DeleteByPrefix(utxoPrefix)
@@ -145,50 +215,254 @@ func (u *UTXOSet) Update(block *Block) {
 
 	// Update the UTXO set with each transaction in the block
 	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					Handle(err)
-					v, err := item.Value()
-					Handle(err)
-
-					outs := DeserializeOutputs(v)
-
-					// Remove spent outputs and update the database
-					for outIdx, out := range outs.Outputs {
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
+		return u.connect(txn, block)
+	})
+	Handle(err)
+}
+
+// Disconnect reverts the transactions of a block from the UTXO set using its undo record.
+// The block must be the last one applied to the UTXO set.
+func (u *UTXOSet) Disconnect(block *Block) {
+	db := u.Blockchain.Database
 
-					if len(updatedOuts.Outputs) == 0 {
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
-					} else {
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
+	err := db.Update(func(txn *badger.Txn) error {
+		return u.disconnect(txn, block)
+	})
+	Handle(err)
+}
+
+// connect applies the transactions of a block to the UTXO set inside the given database transaction
+// and stores the outputs it spends as the undo record of the block.
+func (u *UTXOSet) connect(txn *badger.Txn, block *Block) error {
+	undo := BlockUndo{}
+	fees := 0
+
+	// Time locks are measured against the median time past of the parent block
+	medianTime, err := medianTimePastOf(txn, block.PrevHash)
+	if err != nil {
+		return err
+	}
+
+	for _, tx := range block.Transactions {
+		if err := checkFinal(tx, block.Height, medianTime); err != nil {
+			return err
+		}
+		if tx.IsCoinbase() == false {
+			var prevOuts []TxOutput
+			var prevEntries []UTXOEntry
+			for _, in := range tx.Inputs {
+				// Remove spent outputs and remember them for the undo record
+				entry, err := spendOutput(txn, in.ID, in.Out)
+				if err != nil {
+					return err
+				}
+				// Coinbase outputs could be spent at once in the first versions
+				if tx.Version != LegacyTxVersion {
+					if err := checkMaturity(entry, block.Height); err != nil {
+						return err
 					}
 				}
+				undo.Spent = append(undo.Spent, entry)
+				prevOuts = append(prevOuts, entry.Output)
+				prevEntries = append(prevEntries, entry)
 			}
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+			if err := checkSequenceLocks(txn, tx, prevEntries, block.Height, medianTime); err != nil {
+				return err
 			}
 
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
+			// Checking signatures and amounts against the spent outputs
+			fee, err := checkTransactionInputs(tx, prevOuts)
+			if err != nil {
+				return err
 			}
+			fees += fee
 		}
 
-		return nil
-	})
-	Handle(err)
+		// A transaction repeating the ID of one with unspent outputs would overwrite them, and
+		// disconnecting it would then delete the outputs of both
+		txID := append(utxoPrefix, tx.ID...)
+		if _, err := txn.Get(txID); err == nil {
+			return fmt.Errorf("%w: %x", ErrOverwrittenTx, tx.ID)
+		} else if err != badger.ErrKeyNotFound {
+			return err
+		}
+
+		newOutputs := TxOutputs{Height: block.Height, Coinbase: tx.IsCoinbase()}
+		for outIdx, out := range tx.Outputs {
+			if IsUnspendable(out.LockingScript) {
+				continue // Null-data outputs can never be spent
+			}
+			newOutputs.Outputs = append(newOutputs.Outputs, out)
+			newOutputs.Indexes = append(newOutputs.Indexes, outIdx)
+		}
+		if len(newOutputs.Outputs) == 0 {
+			continue
+		}
+
+		if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	// The coinbase may claim the subsidy and the fees of the block
+	if err := checkCoinbaseValue(block.Transactions[0], fees, block.Height); err != nil {
+		return err
+	}
+
+	return txn.Set(undoKey(block.Hash), undo.Serialize())
+}
+
+// disconnect reverts the transactions of a block from the UTXO set inside the given database transaction.
+func (u *UTXOSet) disconnect(txn *badger.Txn, block *Block) error {
+	undo, err := readUndo(txn, block)
+	if err != nil {
+		return err
+	}
+	next := len(undo.Spent) // Undo entries are consumed from the end
+
+	// Walking the transactions backwards so outputs created and spent in the same block cancel out
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+
+		// Removing the outputs created by the transaction
+		if err := txn.Delete(append(utxoPrefix, tx.ID...)); err != nil {
+			return err
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		// Restoring the outputs spent by the transaction
+		for range tx.Inputs {
+			if next == 0 {
+				return fmt.Errorf("undo record of block %x is incomplete", block.Hash)
+			}
+			next--
+			spent := undo.Spent[next]
+			if err := restoreOutput(txn, spent); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// findOutput returns a single unspent output from the UTXO set.
+func findOutput(txn *badger.Txn, txID []byte, index int) (UTXOEntry, error) {
+	item, err := txn.Get(append(utxoPrefix, txID...))
+	if err == badger.ErrKeyNotFound {
+		return UTXOEntry{}, fmt.Errorf("%w: %x:%d", ErrMissingInput, txID, index)
+	} else if err != nil {
+		return UTXOEntry{}, err
+	}
+	v, err := item.Value()
+	if err != nil {
+		return UTXOEntry{}, err
+	}
+
+	outs := DeserializeOutputs(v)
+	for i, out := range outs.Outputs {
+		if outs.Indexes[i] == index {
+			return UTXOEntry{txID, index, out, outs.Height, outs.Coinbase}, nil
+		}
+	}
+
+	return UTXOEntry{}, fmt.Errorf("%w: %x:%d", ErrMissingInput, txID, index)
+}
+
+// spendOutput removes a single output from the UTXO set and returns it.
+func spendOutput(txn *badger.Txn, txID []byte, index int) (UTXOEntry, error) {
+	spent, err := findOutput(txn, txID, index)
+	if err != nil {
+		return UTXOEntry{}, err
+	}
+
+	key := append(utxoPrefix, txID...)
+	item, err := txn.Get(key)
+	if err != nil {
+		return UTXOEntry{}, err
+	}
+	v, err := item.Value()
+	if err != nil {
+		return UTXOEntry{}, err
+	}
+
+	outs := DeserializeOutputs(v)
+	updatedOuts := TxOutputs{Height: outs.Height, Coinbase: outs.Coinbase}
+
+	for i, out := range outs.Outputs {
+		if outs.Indexes[i] != index {
+			updatedOuts.Outputs = append(updatedOuts.Outputs, out)
+			updatedOuts.Indexes = append(updatedOuts.Indexes, outs.Indexes[i])
+		}
+	}
+
+	if len(updatedOuts.Outputs) == 0 {
+		err = txn.Delete(key)
+	} else {
+		err = txn.Set(key, updatedOuts.Serialize())
+	}
+
+	return spent, err
+}
+
+// restoreOutput puts a spent output back into the UTXO set, keeping the outputs ordered by index.
+func restoreOutput(txn *badger.Txn, entry UTXOEntry) error {
+	key := append(utxoPrefix, entry.ID...)
+	outs := TxOutputs{Height: entry.Height, Coinbase: entry.Coinbase}
+
+	if item, err := txn.Get(key); err == nil {
+		v, err := item.Value()
+		if err != nil {
+			return err
+		}
+		outs = DeserializeOutputs(v)
+	} else if err != badger.ErrKeyNotFound {
+		return err
+	}
+
+	index, out := entry.Out, entry.Output
+	restored := TxOutputs{Height: outs.Height, Coinbase: outs.Coinbase}
+	inserted := false
+	for i, existing := range outs.Outputs {
+		if outs.Indexes[i] == index {
+			return fmt.Errorf("output %d of transaction %x is already unspent", index, entry.ID)
+		}
+		if !inserted && outs.Indexes[i] > index {
+			restored.Outputs = append(restored.Outputs, out)
+			restored.Indexes = append(restored.Indexes, index)
+			inserted = true
+		}
+		restored.Outputs = append(restored.Outputs, existing)
+		restored.Indexes = append(restored.Indexes, outs.Indexes[i])
+	}
+	if !inserted {
+		restored.Outputs = append(restored.Outputs, out)
+		restored.Indexes = append(restored.Indexes, index)
+	}
+
+	return txn.Set(key, restored.Serialize())
+}
+
+// spendHeight returns the height of the next block of the best chain, the earliest block
+// a new transaction can be included in.
+func spendHeight(txn *badger.Txn) (int, error) {
+	item, err := txn.Get([]byte("lh"))
+	if err != nil {
+		return 0, err
+	}
+	lastHash, err := item.Value()
+	if err != nil {
+		return 0, err
+	}
+	entry, err := readHeader(txn, lastHash)
+	if err != nil {
+		return 0, err
+	}
+
+	return entry.Height + 1, nil
 }
 
 // DeleteByPrefix deletes all keys in the database with a given prefix.
@@ -0,0 +1,56 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+)
+
+// utxoRecords returns the stored UTXO set as it is encoded in the database.
+func utxoRecords(t *testing.T, chain *BlockChain) map[string][]byte {
+	records := make(map[string][]byte)
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			records[string(it.Item().Key())] = value
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+
+	return records
+}
+
+func TestConnectDisconnectRestoresUTXOSet(t *testing.T) {
+	chain, w := newTestChain(t)
+	other := wallet.MakeWallet()
+	UTXOSet := UTXOSet{chain}
+	before := utxoRecords(t, chain)
+
+	// The block spends the genesis coinbase and, in a second transaction, an output of the first
+	pay := NewTransaction(w, string(w.Address()), 5, 1, 0, &UTXOSet)
+	assert.Len(t, pay.Outputs, 2, "Payment leaves change")
+	spend := &Transaction{TxVersion, nil, []TxInput{{pay.ID, 0, nil, MaxSequence}}, []TxOutput{*NewTXOutput(4, string(other.Address()))}, 0}
+	spend.ID = spend.Hash()
+	spend.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(pay.ID): *pay})
+	block := newTestBlock(tip(t, chain), CoinbaseTx(string(w.Address()), "", BlockSubsidy(1)+2), pay, spend)
+
+	UTXOSet.Update(block)
+	_, err := UTXOSet.FindOutput(pay.ID, 0)
+	assert.Error(t, err, "Output spent in its own block is not unspent")
+	entry, err := UTXOSet.FindOutput(pay.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, pay.Outputs[1].Value, entry.Output.Value)
+	assert.Equal(t, 4, unspentValue(UTXOSet, wallet.PublicKeyHash(other.PublicKey)))
+
+	UTXOSet.Disconnect(block)
+	assert.Equal(t, before, utxoRecords(t, chain), "Disconnecting restores the exact UTXO set")
+}
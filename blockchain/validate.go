@@ -0,0 +1,497 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/dgraph-io/badger"
+)
+
+const (
+	maxFutureBlockTime = 2 * 60 * 60 // Seconds a block timestamp may be ahead of the local clock
+	medianTimeBlocks   = 11          // Number of previous blocks used for the median time
+)
+
+var invalidPrefix = []byte("invalid-") // Prefix marking blocks that broke a consensus rule
+
+// CoinbaseMaturity is the number of blocks a coinbase output must be buried under before it can be
+// spent, so that coins never depend on a block that a reorganization may still remove.
+var CoinbaseMaturity = 100
+
+// Errors returned when a block or transaction breaks a consensus rule.
+var (
+	ErrBadHash          = errors.New("block hash does not match its header")
+	ErrBadVersion       = errors.New("block or transaction version is not supported")
+	ErrBadMerkleRoot    = errors.New("merkle root does not match the block transactions")
+	ErrBadProofOfWork   = errors.New("block hash does not meet its target")
+	ErrBadDifficulty    = errors.New("block target does not match the expected difficulty")
+	ErrBadHeight        = errors.New("block height does not follow its parent")
+	ErrBadTimestamp     = errors.New("block timestamp is out of range")
+	ErrUnknownParent    = errors.New("parent block is not known")
+	ErrInvalidAncestor  = errors.New("block descends from an invalid block")
+	ErrNoTransactions   = errors.New("block has no transactions")
+	ErrBadCoinbase      = errors.New("block must start with exactly one coinbase transaction")
+	ErrBadCoinbaseValue = errors.New("coinbase pays more than the subsidy and fees")
+	ErrDuplicateTx      = errors.New("block contains a transaction twice")
+	ErrOverwrittenTx    = errors.New("transaction ID already has unspent outputs")
+	ErrDoubleSpend      = errors.New("output is spent twice")
+	ErrMissingInput     = errors.New("input does not refer to an unspent output")
+	ErrBadTxID          = errors.New("transaction ID does not match its contents")
+	ErrBadTransaction   = errors.New("transaction is malformed")
+	ErrBadSignature     = errors.New("transaction signature is invalid")
+	ErrInsufficientFund = errors.New("transaction spends more than its inputs")
+	ErrImmatureSpend    = errors.New("coinbase output is spent before it matures")
+	ErrNonFinal         = errors.New("transaction is locked until a later height or time")
+	ErrSequenceLock     = errors.New("input spends an output before its relative lock expires")
+)
+
+// BlockError ties a consensus rule violation to the block that broke it.
+type BlockError struct {
+	Hash []byte // Hash of the offending block
+	Err  error  // The rule that was broken
+}
+
+// Error describes the violation.
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block %x: %s", e.Hash, e.Err)
+}
+
+// Unwrap exposes the broken rule to errors.Is.
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// invalidKey builds the database key marking a block as invalid.
+func invalidKey(hash []byte) []byte {
+	return append(append([]byte{}, invalidPrefix...), hash...)
+}
+
+// hasInvalidAncestor reports whether a block or one of its ancestors is marked as invalid. The walk
+// stops at the best chain, whose blocks are all valid, or at a block missing from the block index.
+func hasInvalidAncestor(txn *badger.Txn, hash []byte) bool {
+	for len(hash) > 0 {
+		if _, err := txn.Get(invalidKey(hash)); err == nil {
+			return true
+		}
+		entry, err := readHeader(txn, hash)
+		if err != nil {
+			return false
+		}
+		if indexed, err := hashAtHeight(txn, entry.Height); err == nil && bytes.Equal(indexed, hash) {
+			return false
+		}
+		hash = entry.Header.PrevHash
+	}
+
+	return false
+}
+
+// ValidateBlock checks a block against all consensus rules without adding it. The proof of work,
+// header fields and transaction structure are always checked; spent outputs, signatures and the
+// coinbase amount are checked against the UTXO set when the block extends the current tip,
+// otherwise they are checked when the block is connected during a reorganization.
+func (chain *BlockChain) ValidateBlock(block *Block) error {
+	if err := checkBlockSanity(block); err != nil {
+		return &BlockError{block.Hash, err}
+	}
+
+	txn := chain.Database.NewTransaction(true)
+	defer txn.Discard() // Nothing is ever written by the validation
+
+	if hasInvalidAncestor(txn, block.PrevHash) {
+		return &BlockError{block.Hash, ErrInvalidAncestor}
+	}
+	parent, err := readHeader(txn, block.PrevHash)
+	if err == badger.ErrKeyNotFound {
+		return &BlockError{block.Hash, ErrUnknownParent}
+	} else if err != nil {
+		return err
+	}
+
+	if err := checkHeaderContext(txn, &block.BlockHeader, parent); err != nil {
+		return &BlockError{block.Hash, err}
+	}
+	if block.Height != parent.Height+1 {
+		return &BlockError{block.Hash, fmt.Errorf("%w: got %d, want %d", ErrBadHeight, block.Height, parent.Height+1)}
+	}
+
+	item, err := txn.Get([]byte("lh"))
+	if err != nil {
+		return err
+	}
+	lastHash, err := item.Value()
+	if err != nil {
+		return err
+	}
+
+	// Connecting the block in a transaction that is never committed
+	if bytes.Equal(block.PrevHash, lastHash) {
+		UTXOSet := UTXOSet{Blockchain: chain}
+		if err := UTXOSet.connect(txn, block); err != nil {
+			return &BlockError{block.Hash, err}
+		}
+	}
+
+	return nil
+}
+
+// ValidateTransaction checks a loose transaction against the current UTXO set.
+func (chain *BlockChain) ValidateTransaction(tx *Transaction) error {
+	_, err := chain.TransactionFee(tx)
+
+	return err
+}
+
+// TransactionFee checks a loose transaction against the current UTXO set and returns the fee
+// it leaves for the miner, the value of its inputs minus the value of its outputs.
+func (chain *BlockChain) TransactionFee(tx *Transaction) (int, error) {
+	if tx.IsCoinbase() {
+		return 0, ErrBadCoinbase // Coinbase transactions are only valid inside blocks
+	}
+	if err := checkTransactionSanity(tx); err != nil {
+		return 0, err
+	}
+
+	fee := 0
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		height, err := spendHeight(txn)
+		if err != nil {
+			return err
+		}
+
+		// The next block has to accept the lock time, its parent being the current tip
+		item, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
+		lastHash, err := item.Value()
+		if err != nil {
+			return err
+		}
+		medianTime, err := medianTimePastOf(txn, lastHash)
+		if err != nil {
+			return err
+		}
+		if err := checkFinal(tx, height, medianTime); err != nil {
+			return err
+		}
+
+		var prevOuts []TxOutput
+		var prevEntries []UTXOEntry
+		for _, in := range tx.Inputs {
+			entry, err := findOutput(txn, in.ID, in.Out)
+			if err != nil {
+				return err
+			}
+			if err := checkMaturity(entry, height); err != nil {
+				return err
+			}
+			prevOuts = append(prevOuts, entry.Output)
+			prevEntries = append(prevEntries, entry)
+		}
+		if err := checkSequenceLocks(txn, tx, prevEntries, height, medianTime); err != nil {
+			return err
+		}
+
+		fee, err = checkTransactionInputs(tx, prevOuts)
+		return err
+	})
+
+	return fee, err
+}
+
+// BlockReward returns the most a coinbase may claim in the next block of the best chain
+// if the block includes the given transactions.
+func (chain *BlockChain) BlockReward(txs []*Transaction) (int, error) {
+	reward := BlockSubsidy(chain.GetBestHeight() + 1)
+	for _, tx := range txs {
+		fee, err := chain.TransactionFee(tx)
+		if err != nil {
+			return 0, err
+		}
+		reward += fee
+	}
+
+	return reward, nil
+}
+
+// checkHeaderSanity checks the header rules that do not depend on any other block.
+func checkHeaderSanity(header *BlockHeader) error {
+	if header.Version < minBlockVersion {
+		return fmt.Errorf("%w: block version %d", ErrBadVersion, header.Version)
+	}
+	if !NewProof(header).Validate() {
+		return ErrBadProofOfWork
+	}
+
+	if header.Timestamp > time.Now().Unix()+maxFutureBlockTime {
+		return fmt.Errorf("%w: block is too far in the future", ErrBadTimestamp)
+	}
+
+	return nil
+}
+
+// checkBlockSanity checks the rules that do not depend on any other block.
+func checkBlockSanity(block *Block) error {
+	// The stored hash must be the hash of the header
+	if !bytes.Equal(block.BlockHeader.Hash(), block.Hash) {
+		return ErrBadHash
+	}
+	if err := checkHeaderSanity(&block.BlockHeader); err != nil {
+		return err
+	}
+
+	if len(block.Transactions) == 0 {
+		return ErrNoTransactions
+	}
+
+	// Listing a transaction twice leaves the Merkle root of version 2 blocks unchanged, so
+	// duplicates are rejected before the root is compared
+	txIDs := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		txID := hex.EncodeToString(tx.ID)
+		if txIDs[txID] {
+			return fmt.Errorf("%w: %s", ErrDuplicateTx, txID)
+		}
+		txIDs[txID] = true
+	}
+
+	// The header must commit to exactly these transactions
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return ErrBadMerkleRoot
+	}
+
+	spent := make(map[string]bool)
+
+	for i, tx := range block.Transactions {
+		if tx.IsCoinbase() != (i == 0) {
+			return ErrBadCoinbase
+		}
+		if err := checkTransactionSanity(tx); err != nil {
+			return err
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			outpoint := fmt.Sprintf("%x:%d", in.ID, in.Out)
+			if spent[outpoint] {
+				return fmt.Errorf("%w: %s", ErrDoubleSpend, outpoint)
+			}
+			spent[outpoint] = true
+		}
+	}
+
+	return nil
+}
+
+// checkTransactionSanity checks the structure of a single transaction.
+func checkTransactionSanity(tx *Transaction) error {
+	if tx.Version != TxVersion {
+		return fmt.Errorf("%w: transaction version %d", ErrBadVersion, tx.Version)
+	}
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return fmt.Errorf("%w: no inputs or outputs", ErrBadTransaction)
+	}
+	if !bytes.Equal(tx.ID, tx.Hash()) {
+		return ErrBadTxID
+	}
+
+	for _, out := range tx.Outputs {
+		if IsUnspendable(out.LockingScript) {
+			if ClassifyScript(out.LockingScript) != NullDataScript || out.Value != 0 {
+				return fmt.Errorf("%w: null-data output must carry at most %d bytes and no value", ErrBadTransaction, MaxNullDataSize)
+			}
+			continue
+		}
+		// Once the subsidy is halved down to nothing a coinbase without fees pays nothing
+		if out.Value < 0 || out.Value == 0 && !tx.IsCoinbase() {
+			return fmt.Errorf("%w: output value must be positive", ErrBadTransaction)
+		}
+		if len(out.LockingScript) > maxScriptSize {
+			return fmt.Errorf("%w: locking script is too large", ErrBadTransaction)
+		}
+	}
+
+	for _, in := range tx.Inputs {
+		if len(in.UnlockingScript) > maxScriptSize {
+			return fmt.Errorf("%w: unlocking script is too large", ErrBadTransaction)
+		}
+	}
+	if tx.IsCoinbase() {
+		return nil
+	}
+	for _, in := range tx.Inputs {
+		if len(in.ID) == 0 || in.Out < 0 {
+			return fmt.Errorf("%w: input does not refer to an output", ErrBadTransaction)
+		}
+	}
+
+	return nil
+}
+
+// isMutated checks whether a block was rejected for transactions its header does not commit to.
+// The block may have been altered on the way and can still arrive intact under the same hash.
+func isMutated(err error) bool {
+	return errors.Is(err, ErrBadHash) || errors.Is(err, ErrBadMerkleRoot) || errors.Is(err, ErrDuplicateTx)
+}
+
+// checkHeaderContext checks the header rules that depend on the ancestors of the block.
+func checkHeaderContext(txn *badger.Txn, header *BlockHeader, parent *headerEntry) error {
+	if err := checkDifficulty(txn, header, parent); err != nil {
+		return err
+	}
+
+	return checkMedianTime(txn, header, parent)
+}
+
+// checkMedianTime checks that a header is not older than the median time past of its parent.
+func checkMedianTime(txn *badger.Txn, header *BlockHeader, parent *headerEntry) error {
+	median, err := medianTimePast(txn, parent)
+	if err != nil {
+		return err
+	}
+	if header.Timestamp < median {
+		return fmt.Errorf("%w: block is older than the median of its ancestors", ErrBadTimestamp)
+	}
+
+	return nil
+}
+
+// medianTimePast returns the median timestamp of the last blocks ending with the given one.
+func medianTimePast(txn *badger.Txn, entry *headerEntry) (int64, error) {
+	var timestamps []int64
+
+	for i := 0; i < medianTimeBlocks; i++ {
+		timestamps = append(timestamps, entry.Header.Timestamp)
+		if len(entry.Header.PrevHash) == 0 {
+			break
+		}
+
+		var err error
+		if entry, err = readHeader(txn, entry.Header.PrevHash); err != nil {
+			return 0, err
+		}
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	return timestamps[len(timestamps)/2], nil
+}
+
+// checkTransactionInputs checks the scripts and amounts of a transaction against the outputs
+// it spends and returns the fee it leaves for the miner.
+func checkTransactionInputs(tx *Transaction, prevOuts []TxOutput) (int, error) {
+	// Legacy transactions were signed over gob encodings that cannot be rebuilt. Only blocks of an
+	// imported legacy chain hold them, checkTransactionSanity refuses them everywhere else.
+	if tx.Version != LegacyTxVersion {
+		if err := tx.verifyScripts(prevOuts); err != nil {
+			return 0, fmt.Errorf("%w: %x: %s", ErrBadSignature, tx.ID, err)
+		}
+	}
+
+	in, out := 0, 0
+	for _, prevOut := range prevOuts {
+		in += prevOut.Value
+	}
+	for _, output := range tx.Outputs {
+		out += output.Value
+	}
+	if in < out {
+		return 0, fmt.Errorf("%w: %x", ErrInsufficientFund, tx.ID)
+	}
+
+	return in - out, nil
+}
+
+// checkFinal checks that the lock time of a transaction allows it into a block at the given height
+// whose parent has the given median time past.
+func checkFinal(tx *Transaction, height int, medianTime int64) error {
+	if !tx.IsFinal(height, medianTime) {
+		return fmt.Errorf("%w: %x", ErrNonFinal, tx.ID)
+	}
+
+	return nil
+}
+
+// checkSequenceLocks checks the relative locks of the inputs of a transaction against the
+// confirmation of the outputs they spend, for a block at the given height whose parent has the
+// given median time past. Time locks start at the median time past of the block before the one
+// that confirmed the output.
+func checkSequenceLocks(txn *badger.Txn, tx *Transaction, prevEntries []UTXOEntry, height int, medianTime int64) error {
+	for i, in := range tx.Inputs {
+		if in.Sequence&SequenceLockDisabled != 0 {
+			continue
+		}
+		entry := prevEntries[i]
+		lock := int64(in.Sequence & SequenceLockMask)
+
+		if in.Sequence&SequenceLockTypeTime == 0 {
+			if int64(height) < int64(entry.Height)+lock {
+				return fmt.Errorf("%w: %x:%d can be spent from height %d", ErrSequenceLock, in.ID, in.Out, int64(entry.Height)+lock)
+			}
+			continue
+		}
+
+		startHeight := entry.Height - 1
+		if startHeight < 0 {
+			startHeight = 0
+		}
+		startHash, err := hashAtHeight(txn, startHeight)
+		if err != nil {
+			return err
+		}
+		startTime, err := medianTimePastOf(txn, startHash)
+		if err != nil {
+			return err
+		}
+		if unlockTime := startTime + lock<<SequenceLockTimeUnit; medianTime < unlockTime {
+			return fmt.Errorf("%w: %x:%d can be spent from time %d", ErrSequenceLock, in.ID, in.Out, unlockTime)
+		}
+	}
+
+	return nil
+}
+
+// medianTimePastOf returns the median time past of the block with the given hash.
+func medianTimePastOf(txn *badger.Txn, hash []byte) (int64, error) {
+	entry, err := readHeader(txn, hash)
+	if err != nil {
+		return 0, err
+	}
+
+	return medianTimePast(txn, entry)
+}
+
+// checkMaturity checks that an output may be spent by a block at the given height. The genesis
+// coinbase is exempt, as the genesis block can never be reorganized away.
+func checkMaturity(entry UTXOEntry, height int) error {
+	if entry.Coinbase && entry.Height > 0 && height-entry.Height < CoinbaseMaturity {
+		return fmt.Errorf("%w: %x:%d matures at height %d", ErrImmatureSpend, entry.ID, entry.Out, entry.Height+CoinbaseMaturity)
+	}
+
+	return nil
+}
+
+// checkCoinbaseValue checks that a coinbase does not claim more than the subsidy of the block
+// height and the fees.
+func checkCoinbaseValue(coinbase *Transaction, fees, height int) error {
+	value := 0
+	for _, out := range coinbase.Outputs {
+		value += out.Value
+	}
+	reward := BlockSubsidy(height) + fees
+	if coinbase.Version == LegacyTxVersion {
+		reward = InitialSubsidy + fees // The first versions paid the same subsidy in every block
+	}
+	if value > reward {
+		return fmt.Errorf("%w: %d > %d", ErrBadCoinbaseValue, value, reward)
+	}
+
+	return nil
+}
@@ -0,0 +1,216 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/dgraph-io/badger"
+	"github.com/stretchr/testify/assert"
+)
+
+// remine finds a new proof of work for a block whose header was changed.
+func remine(block *Block) {
+	block.Nonce = 0
+	for !NewProof(&block.BlockHeader).Validate() {
+		block.Nonce++
+	}
+	block.Hash = block.BlockHeader.Hash()
+}
+
+func TestAddBlockRejectsInvalidBlocks(t *testing.T) {
+	chain, w := newTestChain(t)
+	other := wallet.MakeWallet()
+	UTXOSet := UTXOSet{chain}
+	parent := tip(t, chain)
+
+	// A block paying a coinbase that the later blocks repeat
+	repeated := CoinbaseTx(string(w.Address()), "repeated", BlockSubsidy(1))
+	parent = newTestBlock(parent, repeated)
+	_, err := chain.AddBlock(parent)
+	assert.NoError(t, err)
+
+	coinbase := func() *Transaction {
+		return CoinbaseTx(string(w.Address()), "", BlockSubsidy(parent.Height+1))
+	}
+	spend := func(amount int) *Transaction {
+		return NewTransaction(w, string(other.Address()), amount, 1, 0, &UTXOSet)
+	}
+
+	tests := []struct {
+		name  string
+		block func() *Block
+		err   error
+	}{
+		{"bad proof of work", func() *Block {
+			block := newTestBlock(parent, coinbase())
+			for NewProof(&block.BlockHeader).Validate() {
+				block.Nonce++
+			}
+			block.Hash = block.BlockHeader.Hash()
+			return block
+		}, ErrBadProofOfWork},
+		{"bad merkle root", func() *Block {
+			block := newTestBlock(parent, coinbase())
+			block.MerkleRoot = bytes.Repeat([]byte{1}, hashLength)
+			remine(block)
+			return block
+		}, ErrBadMerkleRoot},
+		{"double spend", func() *Block {
+			return newTestBlock(parent, coinbase(), spend(5), spend(6))
+		}, ErrDoubleSpend},
+		{"coinbase overpay", func() *Block {
+			return newTestBlock(parent, CoinbaseTx(string(w.Address()), "", BlockSubsidy(parent.Height+1)+1))
+		}, ErrBadCoinbaseValue},
+		{"invalid signature", func() *Block {
+			tx := spend(5)
+			tx.Outputs[0].Value++ // The signature commits to the old value
+			tx.ID = tx.Hash()
+			return newTestBlock(parent, coinbase(), tx)
+		}, ErrBadSignature},
+		{"overwritten transaction", func() *Block {
+			return newTestBlock(parent, repeated)
+		}, ErrOverwrittenTx},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			block := test.block()
+			_, err := chain.AddBlock(block)
+			var blockErr *BlockError
+			assert.True(t, errors.As(err, &blockErr), "Rule violations are block errors")
+			assert.True(t, errors.Is(err, test.err), "got %v", err)
+			assert.Equal(t, parent.Hash, chain.LastHash, "Tip is kept")
+		})
+	}
+
+	// The spends of the table are valid on their own
+	block := newTestBlock(parent, CoinbaseTx(string(w.Address()), "", BlockSubsidy(parent.Height+1)+1), spend(5))
+	_, err = chain.AddBlock(block)
+	assert.NoError(t, err)
+	assert.Equal(t, block.Hash, chain.LastHash)
+}
+
+func TestValidateBlock(t *testing.T) {
+	chain, w := newTestChain(t)
+	other := wallet.MakeWallet()
+	UTXOSet := UTXOSet{chain}
+	genesis := tip(t, chain)
+	before := utxoRecords(t, chain)
+
+	spend := func(amount int) *Transaction {
+		return NewTransaction(w, string(other.Address()), amount, 1, 0, &UTXOSet)
+	}
+	coinbase := CoinbaseTx(string(w.Address()), "", BlockSubsidy(1)+1)
+
+	block := newTestBlock(genesis, coinbase, spend(5))
+	assert.NoError(t, chain.ValidateBlock(block))
+	assert.Equal(t, genesis.Hash, chain.LastHash, "Validation does not add the block")
+	assert.Equal(t, before, utxoRecords(t, chain), "Validation leaves the UTXO set alone")
+
+	// Rules checked against the UTXO set of the tip
+	err := chain.ValidateBlock(newTestBlock(genesis, coinbase, spend(5), spend(6)))
+	assert.True(t, errors.Is(err, ErrDoubleSpend), "got %v", err)
+
+	// Rules of the block itself and of its header
+	bad := newTestBlock(genesis, coinbase)
+	bad.MerkleRoot = bytes.Repeat([]byte{1}, hashLength)
+	remine(bad)
+	err = chain.ValidateBlock(bad)
+	assert.True(t, errors.Is(err, ErrBadMerkleRoot), "got %v", err)
+	err = chain.ValidateBlock(newTestBlock(newTestBlock(genesis, coinbase), coinbase))
+	assert.True(t, errors.Is(err, ErrUnknownParent), "got %v", err)
+
+	// A block off the tip is only checked against its header chain
+	_, err = chain.AddBlock(block)
+	assert.NoError(t, err)
+	fork := newTestBlock(genesis, CoinbaseTx(string(other.Address()), "fork", BlockSubsidy(1)))
+	assert.NoError(t, chain.ValidateBlock(fork))
+	assert.Equal(t, block.Hash, chain.LastHash)
+}
+
+func TestCheckMaturity(t *testing.T) {
+	coinbase := UTXOEntry{[]byte("coinbase"), 0, TxOutput{}, 5, true}
+	err := checkMaturity(coinbase, 5+CoinbaseMaturity-1)
+	assert.True(t, errors.Is(err, ErrImmatureSpend), "got %v", err)
+	assert.NoError(t, checkMaturity(coinbase, 5+CoinbaseMaturity))
+
+	assert.NoError(t, checkMaturity(UTXOEntry{[]byte("tx"), 0, TxOutput{}, 5, false}, 6), "Other outputs are mature at once")
+	assert.NoError(t, checkMaturity(UTXOEntry{[]byte("genesis"), 0, TxOutput{}, 0, true}, 1), "Genesis coinbase is exempt")
+}
+
+func TestCheckFinal(t *testing.T) {
+	tx := &Transaction{TxVersion, []byte("tx"), []TxInput{{[]byte("prev"), 0, nil, 0}}, nil, 0}
+
+	tests := []struct {
+		name       string
+		lockTime   uint32
+		height     int
+		medianTime int64
+		final      bool
+	}{
+		{"height lock at its height", 100, 100, LockTimeThreshold + 1000, false},
+		{"height lock after its height", 100, 101, 0, true},
+		{"highest height lock ignores the time", LockTimeThreshold - 1, LockTimeThreshold - 1, LockTimeThreshold + 1000, false},
+		{"time lock at its time", LockTimeThreshold, LockTimeThreshold + 1000, LockTimeThreshold, false},
+		{"time lock after its time", LockTimeThreshold, 0, LockTimeThreshold + 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tx.LockTime = test.lockTime
+			err := checkFinal(tx, test.height, test.medianTime)
+			if test.final {
+				assert.NoError(t, err)
+			} else {
+				assert.True(t, errors.Is(err, ErrNonFinal), "got %v", err)
+			}
+		})
+	}
+
+	// Final inputs disable the lock time
+	tx.LockTime = 100
+	tx.Inputs[0].Sequence = MaxSequence
+	assert.NoError(t, checkFinal(tx, 1, 0))
+}
+
+func TestCheckSequenceLocks(t *testing.T) {
+	chain, w := newTestChain(t)
+	extendChain(t, chain, tip(t, chain), 12, string(w.Address()))
+
+	timestamp := func(height int) int64 {
+		block, err := chain.GetBlockByHeight(height)
+		assert.NoError(t, err)
+		return block.Timestamp
+	}
+	prevEntries := []UTXOEntry{{[]byte("prev"), 0, TxOutput{}, 3, false}}
+	spend := func(sequence uint32) *Transaction {
+		return &Transaction{TxVersion, []byte("tx"), []TxInput{{[]byte("prev"), 0, nil, sequence}}, nil, 0}
+	}
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		// The median time past covers the last blocks, or all of them near the genesis block
+		for height, median := range map[int]int{0: 0, 2: 1, 4: 2, 12: 7} {
+			hash, err := hashAtHeight(txn, height)
+			assert.NoError(t, err)
+			medianTime, err := medianTimePastOf(txn, hash)
+			assert.NoError(t, err)
+			assert.Equal(t, timestamp(median), medianTime, "Median time past of height %d", height)
+		}
+
+		// A lock of 5 blocks on an output of height 3
+		err := checkSequenceLocks(txn, spend(5), prevEntries, 7, 0)
+		assert.True(t, errors.Is(err, ErrSequenceLock), "got %v", err)
+		assert.NoError(t, checkSequenceLocks(txn, spend(5), prevEntries, 8, 0))
+		assert.NoError(t, checkSequenceLocks(txn, spend(SequenceLockDisabled|5), prevEntries, 4, 0), "Disabled lock")
+
+		// A lock of 512 seconds from the median time past of height 2
+		start := timestamp(1)
+		err = checkSequenceLocks(txn, spend(SequenceLockTypeTime|1), prevEntries, 12, start+511)
+		assert.True(t, errors.Is(err, ErrSequenceLock), "got %v", err)
+		assert.NoError(t, checkSequenceLocks(txn, spend(SequenceLockTypeTime|1), prevEntries, 12, start+512))
+		return nil
+	})
+	assert.NoError(t, err)
+}
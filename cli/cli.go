@@ -2,15 +2,19 @@
 package cli
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
 	"github.com/argonautts/golang-blockchain/blockchain"
 	"github.com/argonautts/golang-blockchain/network"
 	"github.com/argonautts/golang-blockchain/wallet"
+	"io/ioutil"
 	"log"
+	"math"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 )
 
 type CommandLine struct{}
@@ -21,11 +25,30 @@ func (cli *CommandLine) printUsage() {
 	fmt.Println(" getbalance -address ADDRESS - get the balance for an address")
 	fmt.Println(" createblockchain -address ADDRESS creates a blockchain and sends genesis reward to address")
 	fmt.Println(" printchain - Prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT -mine - Send amount of coins. Then -mine flag is set, mine off of this node")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT -fee FEE -locktime LOCKTIME -mine - Send amount of coins, leaving an optional fee to the miner and optionally locked until a block height or unix time. Then -mine flag is set, mine off of this node")
 	fmt.Println(" createwallet - Creates a new Wallet")
 	fmt.Println(" listaddresses - Lists the addresses in our wallet file")
 	fmt.Println(" reindexutxo - Rebuilds the UTXO set")
-	fmt.Println(" startnode -miner ADDRESS - Start a node with ID specified in NODE_ID env. var. -miner enables mining")
+	fmt.Println(" migratedb - Rewrites the records stored in gob by earlier versions in the binary encoding and rebuilds the block index")
+	fmt.Println(" exportchain -file FILE - Writes every block of the best chain in height order to a checksummed FILE")
+	fmt.Println(" importchain -file FILE - Creates the blockchain from a FILE written by exportchain, validating every block")
+	fmt.Println(" reindextx - Builds the transaction index and keeps it up to date from now on")
+	fmt.Println(" gettransaction -txid TXID - Shows the block and confirmations of a transaction (needs the transaction index)")
+	fmt.Println(" getmerkleproof -txid TXID - Prints the proof that TXID is in its block, which can be checked with the block header alone")
+	fmt.Println(" reindexaddr - Builds the address index and keeps it up to date from now on")
+	fmt.Println(" getaddresshistory -address ADDRESS - Lists every payment to and from an address (needs the address index)")
+	fmt.Println(" getpubkey -address ADDRESS - Prints the public key of an address in our wallet file")
+	fmt.Println(" createmultisig -required M -pubkeys KEY,KEY,... - Creates an address needing M signatures of the given public keys")
+	fmt.Println(" createmultisigspend -from MULTISIG -to TO -amount AMOUNT -fee FEE -file FILE -p2sh - Writes an unsigned spend from a multisig address to FILE. With -p2sh, spends from its pay-to-script-hash address")
+	fmt.Println(" signmultisig -file FILE -address ADDRESS -sighash TYPE - Adds the signature of ADDRESS to the spend in FILE, committing to ALL (default), NONE or SINGLE outputs, optionally with |ANYONECANPAY")
+	fmt.Println(" sendmultisig -file FILE -mine - Sends the fully signed spend in FILE. Then -mine flag is set, mine off of this node")
+	fmt.Println(" htlc-initiate -from FROM -to TO -amount AMOUNT -fee FEE -locktime LOCKTIME -secrethash HASH -mine - Pays into a contract TO can redeem with a secret, refunded to FROM after LOCKTIME. Without -secrethash a new secret is generated")
+	fmt.Println(" htlc-redeem -contract CONTRACT -txid TXID -secret SECRET -fee FEE -mine - Redeems the contract paid in TXID by revealing the secret")
+	fmt.Println(" htlc-refund -contract CONTRACT -txid TXID -fee FEE -mine - Takes back the contract paid in TXID once its lock time has passed")
+	fmt.Println(" htlc-audit -contract CONTRACT -txid TXID - Shows the terms and state of the contract paid in TXID, and the secret once redeemed")
+	fmt.Println(" notarize -file FILE -from FROM -fee FEE -mine - Anchors the hash of FILE in a transaction paid by FROM")
+	fmt.Println(" verify-notarization -file FILE -txid TXID - Proves that TXID anchors the hash of FILE with its block and Merkle path")
+	fmt.Println(" startnode -miner ADDRESS -spv -prune N - Start a node with ID specified in NODE_ID env. var. -miner enables mining. -spv starts a light client keeping only headers and reporting the verified balances of the wallet file. -prune deletes the blocks more than N blocks behind the tip")
 }
 
 // validateArgs validates if the necessary command-line arguments are provided.
@@ -36,9 +59,22 @@ func (cli *CommandLine) validateArgs() {
 	}
 }
 
-// StartNode is used to start the network module.
-func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
+// StartNode is used to start the network module. A light client needs no blockchain database.
+func (cli *CommandLine) StartNode(nodeID, minerAddress string, spv bool, prune int) {
 	fmt.Printf("Starting Node %s\n", nodeID)
+	if prune != 0 && prune < blockchain.MinPruneDepth {
+		log.Panicf("A pruning node keeps at least %d blocks!", blockchain.MinPruneDepth)
+	}
+	if spv {
+		if len(minerAddress) > 0 {
+			log.Panic("A light client cannot mine!")
+		}
+		if prune != 0 {
+			log.Panic("A light client keeps no blocks to prune!")
+		}
+		network.StartSPVNode(nodeID)
+		return
+	}
 	if len(minerAddress) > 0 {
 		if wallet.ValidateAddress(minerAddress) {
 			fmt.Println("Mining is on. Address to receive rewards: ", minerAddress)
@@ -46,20 +82,305 @@ func (cli *CommandLine) StartNode(nodeID, minerAddress string) {
 			log.Panic("Wrong miner address!")
 		}
 	}
-	network.StartServer(nodeID, minerAddress)
+	if prune != 0 {
+		fmt.Printf("Pruning is on. Keeping the last %d blocks\n", prune)
+	}
+	network.StartServer(nodeID, minerAddress, prune)
 }
 
 // reindexUTXO rebuilds the UTXO set.
 func (cli *CommandLine) reindexUTXO(nodeID string) {
 	chain := blockchain.ContinueBlockChain(nodeID)
 	defer chain.Database.Close()
-	UTXOSet := blockchain.UTXOSet{chain}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	UTXOSet.Reindex()
 
 	count := UTXOSet.CountTransactions()
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 }
 
+// migrateDatabase rewrites the records stored in gob in the binary encoding.
+func (cli *CommandLine) migrateDatabase(nodeID string) {
+	count := blockchain.MigrateBlockChain(nodeID)
+	fmt.Printf("Done! Rewrote %d records in the binary encoding.\n", count)
+}
+
+// exportChain writes the best chain to a chain file.
+func (cli *CommandLine) exportChain(file, nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	count, err := chain.ExportChain(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	fmt.Printf("Done! Exported %d blocks to %s.\n", count, file)
+}
+
+// importChain creates the blockchain from a chain file.
+func (cli *CommandLine) importChain(file, nodeID string) {
+	chain, err := blockchain.ImportBlockChain(file, nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer chain.Database.Close()
+
+	fmt.Printf("Done! Imported %d blocks from %s.\n", chain.GetBestHeight()+1, file)
+}
+
+// reindexTransactions builds the transaction index.
+func (cli *CommandLine) reindexTransactions(nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	count := chain.ReindexTransactions()
+	fmt.Printf("Done! There are %d transactions in the transaction index.\n", count)
+}
+
+// getTransaction prints a transaction with its containing block and confirmations.
+func (cli *CommandLine) getTransaction(txID, nodeID string) {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic("Transaction ID is not Valid")
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	block, err := chain.GetTransactionBlock(ID)
+	if err != nil {
+		log.Panic(err)
+	}
+	tx, err := chain.FindTransaction(ID)
+	if err != nil {
+		log.Panic(err)
+	}
+	confirmations, err := chain.Confirmations(ID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Block: %x\n", block.Hash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Confirmations: %d\n", confirmations)
+	fmt.Println(tx)
+}
+
+// getMerkleProof prints the proof that a transaction is included in its block, in its fields and
+// in the binary encoding for light clients.
+func (cli *CommandLine) getMerkleProof(txID, nodeID string) {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic("Transaction ID is not Valid")
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	proof, err := chain.GetTransactionProof(ID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Transaction:   %x\n", proof.Transaction.ID)
+	fmt.Printf("Block:         %x\n", proof.Header.Hash())
+	fmt.Printf("Merkle root:   %x\n", proof.Header.MerkleRoot)
+	printMerklePath(proof.Proof)
+	fmt.Printf("Encoded:       %x\n", proof.Serialize())
+}
+
+// printMerklePath prints the sibling hashes of a Merkle proof from the leaf up.
+func printMerklePath(proof blockchain.MerkleProof) {
+	for i, sibling := range proof.Siblings {
+		side := "left"
+		if proof.Right[i] {
+			side = "right"
+		}
+		fmt.Printf("Proof %d:       %x (%s)\n", i, sibling, side)
+	}
+}
+
+// reindexAddresses builds the address index.
+func (cli *CommandLine) reindexAddresses(nodeID string) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	count := chain.ReindexAddresses()
+	fmt.Printf("Done! There are %d entries in the address index.\n", count)
+}
+
+// getAddressHistory prints a statement of every output received and spent by an address.
+func (cli *CommandLine) getAddressHistory(address, nodeID string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panic("Address is not Valid")
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	pubKeyHash := wallet.AddressHash(address)
+	history, err := chain.AddressHistory(pubKeyHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	balance := 0
+	fmt.Printf("History of %s:\n", address)
+	for _, event := range history {
+		direction := "in"
+		amount := event.Amount
+		if event.Spent {
+			direction = "out"
+			amount = -amount
+		}
+		balance += amount
+		fmt.Printf("%x  height %d  %-3s  %+d  balance %d\n", event.TxID, event.Height, direction, amount, balance)
+	}
+	fmt.Printf("Balance of %s: %d\n", address, balance)
+}
+
+// getPubKey prints the public key of a wallet address, to be shared for a multisig address.
+func (cli *CommandLine) getPubKey(address, nodeID string) {
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("Address is not in the wallet file")
+	}
+
+	fmt.Printf("%x\n", w.PublicKey)
+}
+
+// createMultisig prints the address of an M-of-N multisig policy, and the pay-to-script-hash address
+// that can be shared with senders without revealing the keys.
+func (cli *CommandLine) createMultisig(required int, keys string) {
+	var pubKeys [][]byte
+	for _, key := range strings.Split(keys, ",") {
+		pubKey, err := hex.DecodeString(strings.TrimSpace(key))
+		if err != nil {
+			log.Panic("Public key is not Valid")
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	address, err := wallet.MultisigAddress(required, pubKeys)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("New multisig address is: %s\n", address)
+	fmt.Printf("Pay-to-script-hash address is: %s\n", blockchain.MultisigScriptHashAddress(required, pubKeys))
+}
+
+// createMultisigSpend writes an unsigned transaction spending from a multisig address, or from its
+// pay-to-script-hash address, to a file.
+func (cli *CommandLine) createMultisigSpend(from, to string, amount, fee int, scriptHash bool, file, nodeID string) {
+	if !wallet.ValidateAddress(to) || !wallet.ValidateAddress(from) {
+		log.Panic("Address is not Valid")
+	}
+	if !wallet.IsMultisigAddress(from) {
+		log.Panic("Source address is not a multisig address")
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	tx := blockchain.NewMultisigTransaction(from, to, amount, fee, scriptHash, &UTXOSet)
+	writeTransaction(file, tx)
+
+	fmt.Printf("Unsigned transaction %x written to %s\n", tx.ID, file)
+}
+
+// signMultisig adds the signature of a wallet address to a multisig spend stored in a file,
+// committing to the parts of the transaction selected by the signature hash type.
+func (cli *CommandLine) signMultisig(file, address, sigHash, nodeID string) {
+	hashType, err := blockchain.ParseSigHashType(sigHash)
+	if err != nil {
+		log.Panic(err)
+	}
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w, ok := wallets.Wallets[address]
+	if !ok {
+		log.Panic("Address is not in the wallet file")
+	}
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	tx := readTransaction(file)
+	chain.SignTransactionWithHashType(tx, w.PrivateKey, hashType)
+	writeTransaction(file, tx)
+
+	if chain.VerifyTransaction(tx) {
+		fmt.Println("Signed! The transaction has all the signatures it needs.")
+	} else {
+		fmt.Println("Signed! More signatures are needed.")
+	}
+}
+
+// sendMultisig sends a fully signed multisig spend stored in a file.
+func (cli *CommandLine) sendMultisig(file, nodeID string, mineNow bool) {
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	tx := readTransaction(file)
+	submitTransaction(chain, tx, nodeID, mineNow)
+
+	fmt.Println("Success!")
+}
+
+// submitTransaction validates a transaction and either mines it right away, paying the reward to
+// the first address of the wallet file, or sends it to the network.
+func submitTransaction(chain *blockchain.BlockChain, tx *blockchain.Transaction, nodeID string, mineNow bool) {
+	if err := chain.ValidateTransaction(tx); err != nil {
+		log.Panic(err)
+	}
+
+	if mineNow {
+		reward, err := chain.BlockReward([]*blockchain.Transaction{tx})
+		if err != nil {
+			log.Panic(err)
+		}
+		wallets, err := wallet.CreateWallets(nodeID)
+		if err != nil {
+			log.Panic(err)
+		}
+		addresses := wallets.GetAllAddresses()
+		if len(addresses) == 0 {
+			log.Panic("No address in the wallet file to receive the block reward")
+		}
+		cbTx := blockchain.CoinbaseTx(addresses[0], "", reward)
+		chain.MineBlock([]*blockchain.Transaction{cbTx, tx})
+	} else {
+		network.SendTx(network.KnownNodes[0], tx)
+		fmt.Println("send tx")
+	}
+}
+
+// writeTransaction stores a hex encoded transaction in a file.
+func writeTransaction(file string, tx *blockchain.Transaction) {
+	err := ioutil.WriteFile(file, []byte(hex.EncodeToString(tx.Serialize())), 0644)
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// readTransaction loads a hex encoded transaction from a file.
+func readTransaction(file string) *blockchain.Transaction {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	data, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		log.Panic(err)
+	}
+	tx := blockchain.DeserializeTransaction(data)
+
+	return &tx
+}
+
 // listAddresses lists all addresses in the wallet file for a given node ID.
 func (cli *CommandLine) listAddresses(nodeID string) {
 	wallets, _ := wallet.CreateWallets(nodeID)
@@ -87,10 +408,13 @@ func (cli *CommandLine) printChain(nodeID string) {
 
 	for {
 		block := iter.Next()
+		if block == nil {
+			break // The older blocks are pruned
+		}
 
 		fmt.Printf("Hash: %x\n", block.Hash)
 		fmt.Printf("Prev. hash: %x\n", block.PrevHash)
-		pow := blockchain.NewProof(block)
+		pow := blockchain.NewProof(&block.BlockHeader)
 		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
 		for _, tx := range block.Transactions {
 			fmt.Println(tx)
@@ -111,7 +435,7 @@ func (cli *CommandLine) createBlockChain(address, nodeID string) {
 	chain := blockchain.InitBlockChain(address, nodeID)
 	defer chain.Database.Close()
 
-	UTXOSet := blockchain.UTXOSet{chain}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	UTXOSet.Reindex()
 
 	fmt.Println("Finished!")
@@ -123,23 +447,20 @@ func (cli *CommandLine) getBalance(address, nodeID string) {
 		log.Panic("Address is not Valid")
 	}
 	chain := blockchain.ContinueBlockChain(nodeID)
-	UTXOSet := blockchain.UTXOSet{chain}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 
-	balance := 0
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
-
-	for _, out := range UTXOs {
-		balance += out.Value
-	}
+	pubKeyHash := wallet.AddressHash(address)
+	balance, immature := UTXOSet.Balance(pubKeyHash)
 
 	fmt.Printf("Balance of %s: %d\n", address, balance)
+	if immature > 0 {
+		fmt.Printf("Immature balance of %s: %d\n", address, immature)
+	}
 }
 
 // send performs a transaction from one address to another.
-func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow bool) {
+func (cli *CommandLine) send(from, to string, amount, fee int, lockTime uint, nodeID string, mineNow bool) {
 	if !wallet.ValidateAddress(to) {
 		log.Panic("Address is not Valid")
 	}
@@ -147,7 +468,7 @@ func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow
 		log.Panic("Address is not Valid")
 	}
 	chain := blockchain.ContinueBlockChain(nodeID)
-	UTXOSet := blockchain.UTXOSet{chain}
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 
 	wallets, err := wallet.CreateWallets(nodeID)
@@ -156,16 +477,8 @@ func (cli *CommandLine) send(from, to string, amount int, nodeID string, mineNow
 	}
 	wallet := wallets.GetWallet(from)
 
-	tx := blockchain.NewTransaction(&wallet, to, amount, &UTXOSet)
-	if mineNow {
-		cbTx := blockchain.CoinbaseTx(from, "")
-		txs := []*blockchain.Transaction{cbTx, tx}
-		block := chain.MineBlock(txs)
-		UTXOSet.Update(block)
-	} else {
-		network.SendTx(network.KnownNodes[0], tx)
-		fmt.Println("send tx")
-	}
+	tx := blockchain.NewTransaction(&wallet, to, amount, fee, uint32(lockTime), &UTXOSet)
+	submitTransaction(chain, tx, nodeID, mineNow)
 
 	fmt.Println("Success!")
 }
@@ -188,6 +501,25 @@ func (cli *CommandLine) Run() {
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	migrateDBCmd := flag.NewFlagSet("migratedb", flag.ExitOnError)
+	exportChainCmd := flag.NewFlagSet("exportchain", flag.ExitOnError)
+	importChainCmd := flag.NewFlagSet("importchain", flag.ExitOnError)
+	reindexTxCmd := flag.NewFlagSet("reindextx", flag.ExitOnError)
+	getMerkleProofCmd := flag.NewFlagSet("getmerkleproof", flag.ExitOnError)
+	getTransactionCmd := flag.NewFlagSet("gettransaction", flag.ExitOnError)
+	reindexAddrCmd := flag.NewFlagSet("reindexaddr", flag.ExitOnError)
+	getAddressHistoryCmd := flag.NewFlagSet("getaddresshistory", flag.ExitOnError)
+	getPubKeyCmd := flag.NewFlagSet("getpubkey", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
+	createMultisigSpendCmd := flag.NewFlagSet("createmultisigspend", flag.ExitOnError)
+	signMultisigCmd := flag.NewFlagSet("signmultisig", flag.ExitOnError)
+	sendMultisigCmd := flag.NewFlagSet("sendmultisig", flag.ExitOnError)
+	htlcInitiateCmd := flag.NewFlagSet("htlc-initiate", flag.ExitOnError)
+	htlcRedeemCmd := flag.NewFlagSet("htlc-redeem", flag.ExitOnError)
+	htlcRefundCmd := flag.NewFlagSet("htlc-refund", flag.ExitOnError)
+	htlcAuditCmd := flag.NewFlagSet("htlc-audit", flag.ExitOnError)
+	notarizeCmd := flag.NewFlagSet("notarize", flag.ExitOnError)
+	verifyNotarizationCmd := flag.NewFlagSet("verify-notarization", flag.ExitOnError)
 	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 
 	// Command-specific flags.
@@ -196,8 +528,55 @@ func (cli *CommandLine) Run() {
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendFee := sendCmd.Int("fee", 0, "Fee left to the miner")
+	sendLockTime := sendCmd.Uint("locktime", 0, "Block height, or unix time from 500000000 on, before which the transaction cannot be mined")
 	sendMine := sendCmd.Bool("mine", false, "Mine immediately on the same node")
+	exportChainFile := exportChainCmd.String("file", "", "File to write the chain to")
+	importChainFile := importChainCmd.String("file", "", "File written by exportchain")
+	getTransactionID := getTransactionCmd.String("txid", "", "The ID of the transaction")
+	getMerkleProofTxID := getMerkleProofCmd.String("txid", "", "The ID of the transaction to prove")
+	getAddressHistoryAddress := getAddressHistoryCmd.String("address", "", "The address to list the history of")
+	getPubKeyAddress := getPubKeyCmd.String("address", "", "The address to print the public key of")
+	createMultisigRequired := createMultisigCmd.Int("required", 0, "Number of signatures needed to spend")
+	createMultisigPubKeys := createMultisigCmd.String("pubkeys", "", "Comma separated public keys allowed to sign")
+	multisigSpendFrom := createMultisigSpendCmd.String("from", "", "Source multisig address")
+	multisigSpendTo := createMultisigSpendCmd.String("to", "", "Destination wallet address")
+	multisigSpendAmount := createMultisigSpendCmd.Int("amount", 0, "Amount to send")
+	multisigSpendFee := createMultisigSpendCmd.Int("fee", 0, "Fee left to the miner")
+	multisigSpendFile := createMultisigSpendCmd.String("file", "", "File to write the unsigned transaction to")
+	multisigSpendScriptHash := createMultisigSpendCmd.Bool("p2sh", false, "Spend from the pay-to-script-hash address of the multisig address")
+	signMultisigFile := signMultisigCmd.String("file", "", "File holding the transaction to sign")
+	signMultisigAddress := signMultisigCmd.String("address", "", "Address in our wallet file to sign with")
+	signMultisigSigHash := signMultisigCmd.String("sighash", "ALL", "Signature hash type: ALL, NONE or SINGLE, optionally with |ANYONECANPAY")
+	sendMultisigFile := sendMultisigCmd.String("file", "", "File holding the signed transaction")
+	sendMultisigMine := sendMultisigCmd.Bool("mine", false, "Mine immediately on the same node")
+	htlcInitiateFrom := htlcInitiateCmd.String("from", "", "Source wallet address, refunded after the lock time")
+	htlcInitiateTo := htlcInitiateCmd.String("to", "", "Address that can redeem the contract with the secret")
+	htlcInitiateAmount := htlcInitiateCmd.Int("amount", 0, "Amount to pay into the contract")
+	htlcInitiateFee := htlcInitiateCmd.Int("fee", 0, "Fee left to the miner")
+	htlcInitiateLockTime := htlcInitiateCmd.Uint("locktime", 0, "Block height, or unix time from 500000000 on, from which the contract can be refunded")
+	htlcInitiateSecretHash := htlcInitiateCmd.String("secrethash", "", "Hash of the secret of the other side of the swap")
+	htlcInitiateMine := htlcInitiateCmd.Bool("mine", false, "Mine immediately on the same node")
+	htlcRedeemContract := htlcRedeemCmd.String("contract", "", "The contract")
+	htlcRedeemTxID := htlcRedeemCmd.String("txid", "", "The ID of the transaction paying to the contract")
+	htlcRedeemSecret := htlcRedeemCmd.String("secret", "", "The secret of the contract")
+	htlcRedeemFee := htlcRedeemCmd.Int("fee", 0, "Fee left to the miner")
+	htlcRedeemMine := htlcRedeemCmd.Bool("mine", false, "Mine immediately on the same node")
+	htlcRefundContract := htlcRefundCmd.String("contract", "", "The contract")
+	htlcRefundTxID := htlcRefundCmd.String("txid", "", "The ID of the transaction paying to the contract")
+	htlcRefundFee := htlcRefundCmd.Int("fee", 0, "Fee left to the miner")
+	htlcRefundMine := htlcRefundCmd.Bool("mine", false, "Mine immediately on the same node")
+	htlcAuditContract := htlcAuditCmd.String("contract", "", "The contract")
+	htlcAuditTxID := htlcAuditCmd.String("txid", "", "The ID of the transaction paying to the contract")
+	notarizeFile := notarizeCmd.String("file", "", "The document to notarize")
+	notarizeFrom := notarizeCmd.String("from", "", "Wallet address paying the fee")
+	notarizeFee := notarizeCmd.Int("fee", 0, "Fee left to the miner")
+	notarizeMine := notarizeCmd.Bool("mine", false, "Mine immediately on the same node")
+	verifyNotarizationFile := verifyNotarizationCmd.String("file", "", "The notarized document")
+	verifyNotarizationTxID := verifyNotarizationCmd.String("txid", "", "The ID of the transaction anchoring the document")
 	startNodeMiner := startNodeCmd.String("miner", "", "Enable mining mode and send reward to ADDRESS")
+	startNodeSPV := startNodeCmd.Bool("spv", false, "Only download headers and verify the transactions of the wallet with Merkle proofs")
+	startNodePrune := startNodeCmd.Int("prune", 0, "Delete the blocks more than N blocks behind the tip, 0 keeps every block")
 
 	// Parsing the arguments based on the command.
 	switch os.Args[1] {
@@ -206,6 +585,71 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "migratedb":
+		err := migrateDBCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "exportchain":
+		err := exportChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "importchain":
+		err := importChainCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "reindextx":
+		err := reindexTxCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "gettransaction":
+		err := getTransactionCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getmerkleproof":
+		err := getMerkleProofCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "reindexaddr":
+		err := reindexAddrCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getaddresshistory":
+		err := getAddressHistoryCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getpubkey":
+		err := getPubKeyCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisigspend":
+		err := createMultisigSpendCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signmultisig":
+		err := signMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "sendmultisig":
+		err := sendMultisigCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	case "getbalance":
 		err := getBalanceCmd.Parse(os.Args[2:])
 		if err != nil {
@@ -241,6 +685,36 @@ func (cli *CommandLine) Run() {
 		if err != nil {
 			log.Panic(err)
 		}
+	case "htlc-initiate":
+		err := htlcInitiateCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "htlc-redeem":
+		err := htlcRedeemCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "htlc-refund":
+		err := htlcRefundCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "htlc-audit":
+		err := htlcAuditCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "notarize":
+		err := notarizeCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verify-notarization":
+		err := verifyNotarizationCmd.Parse(os.Args[2:])
+		if err != nil {
+			log.Panic(err)
+		}
 	default:
 		cli.printUsage()
 		runtime.Goexit()
@@ -276,14 +750,138 @@ func (cli *CommandLine) Run() {
 	if reindexUTXOCmd.Parsed() {
 		cli.reindexUTXO(nodeID)
 	}
+	if migrateDBCmd.Parsed() {
+		cli.migrateDatabase(nodeID)
+	}
+	if exportChainCmd.Parsed() {
+		if *exportChainFile == "" {
+			exportChainCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.exportChain(*exportChainFile, nodeID)
+	}
+	if importChainCmd.Parsed() {
+		if *importChainFile == "" {
+			importChainCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.importChain(*importChainFile, nodeID)
+	}
+	if reindexTxCmd.Parsed() {
+		cli.reindexTransactions(nodeID)
+	}
+	if getTransactionCmd.Parsed() {
+		if *getTransactionID == "" {
+			getTransactionCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getTransaction(*getTransactionID, nodeID)
+	}
+	if getMerkleProofCmd.Parsed() {
+		if *getMerkleProofTxID == "" {
+			getMerkleProofCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getMerkleProof(*getMerkleProofTxID, nodeID)
+	}
+	if reindexAddrCmd.Parsed() {
+		cli.reindexAddresses(nodeID)
+	}
+	if getAddressHistoryCmd.Parsed() {
+		if *getAddressHistoryAddress == "" {
+			getAddressHistoryCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getAddressHistory(*getAddressHistoryAddress, nodeID)
+	}
+	if getPubKeyCmd.Parsed() {
+		if *getPubKeyAddress == "" {
+			getPubKeyCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.getPubKey(*getPubKeyAddress, nodeID)
+	}
+	if createMultisigCmd.Parsed() {
+		if *createMultisigRequired <= 0 || *createMultisigPubKeys == "" {
+			createMultisigCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.createMultisig(*createMultisigRequired, *createMultisigPubKeys)
+	}
+	if createMultisigSpendCmd.Parsed() {
+		if *multisigSpendFrom == "" || *multisigSpendTo == "" || *multisigSpendAmount <= 0 || *multisigSpendFee < 0 || *multisigSpendFile == "" {
+			createMultisigSpendCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.createMultisigSpend(*multisigSpendFrom, *multisigSpendTo, *multisigSpendAmount, *multisigSpendFee, *multisigSpendScriptHash, *multisigSpendFile, nodeID)
+	}
+	if signMultisigCmd.Parsed() {
+		if *signMultisigFile == "" || *signMultisigAddress == "" {
+			signMultisigCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.signMultisig(*signMultisigFile, *signMultisigAddress, *signMultisigSigHash, nodeID)
+	}
+	if sendMultisigCmd.Parsed() {
+		if *sendMultisigFile == "" {
+			sendMultisigCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.sendMultisig(*sendMultisigFile, nodeID, *sendMultisigMine)
+	}
 
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendLockTime > math.MaxUint32 {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount, nodeID, *sendMine)
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, *sendLockTime, nodeID, *sendMine)
+	}
+
+	if htlcInitiateCmd.Parsed() {
+		if *htlcInitiateFrom == "" || *htlcInitiateTo == "" || *htlcInitiateAmount <= 0 || *htlcInitiateFee < 0 ||
+			*htlcInitiateLockTime == 0 || *htlcInitiateLockTime > math.MaxUint32 {
+			htlcInitiateCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.htlcInitiate(*htlcInitiateFrom, *htlcInitiateTo, *htlcInitiateAmount, *htlcInitiateFee, *htlcInitiateLockTime, *htlcInitiateSecretHash, nodeID, *htlcInitiateMine)
+	}
+	if htlcRedeemCmd.Parsed() {
+		if *htlcRedeemContract == "" || *htlcRedeemTxID == "" || *htlcRedeemSecret == "" || *htlcRedeemFee < 0 {
+			htlcRedeemCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.htlcRedeem(*htlcRedeemContract, *htlcRedeemTxID, *htlcRedeemSecret, *htlcRedeemFee, nodeID, *htlcRedeemMine)
+	}
+	if htlcRefundCmd.Parsed() {
+		if *htlcRefundContract == "" || *htlcRefundTxID == "" || *htlcRefundFee < 0 {
+			htlcRefundCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.htlcRefund(*htlcRefundContract, *htlcRefundTxID, *htlcRefundFee, nodeID, *htlcRefundMine)
+	}
+	if htlcAuditCmd.Parsed() {
+		if *htlcAuditContract == "" || *htlcAuditTxID == "" {
+			htlcAuditCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.htlcAudit(*htlcAuditContract, *htlcAuditTxID, nodeID)
+	}
+
+	if notarizeCmd.Parsed() {
+		if *notarizeFile == "" || *notarizeFrom == "" || *notarizeFee < 0 {
+			notarizeCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.notarize(*notarizeFile, *notarizeFrom, *notarizeFee, nodeID, *notarizeMine)
+	}
+	if verifyNotarizationCmd.Parsed() {
+		if *verifyNotarizationFile == "" || *verifyNotarizationTxID == "" {
+			verifyNotarizationCmd.Usage()
+			runtime.Goexit()
+		}
+		cli.verifyNotarization(*verifyNotarizationFile, *verifyNotarizationTxID, nodeID)
 	}
 
 	if startNodeCmd.Parsed() {
@@ -292,6 +890,6 @@ func (cli *CommandLine) Run() {
 			startNodeCmd.Usage()
 			runtime.Goexit()
 		}
-		cli.StartNode(nodeID, *startNodeMiner)
+		cli.StartNode(nodeID, *startNodeMiner, *startNodeSPV, *startNodePrune)
 	}
 }
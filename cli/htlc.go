@@ -0,0 +1,179 @@
+package cli
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+
+	"github.com/argonautts/golang-blockchain/blockchain"
+	"github.com/argonautts/golang-blockchain/wallet"
+)
+
+// htlcInitiate pays into a hash time-locked contract the recipient can redeem with the secret, and
+// the sender can take back once the lock time has passed. Without a secret hash a new secret is
+// generated; the other side of a swap passes the hash of the initiator's secret instead.
+func (cli *CommandLine) htlcInitiate(from, to string, amount, fee int, lockTime uint, secretHash, nodeID string, mineNow bool) {
+	if !wallet.ValidateAddress(from) || !wallet.ValidateAddress(to) {
+		log.Panic("Address is not Valid")
+	}
+	if wallet.IsMultisigAddress(to) || wallet.IsScriptHashAddress(to) {
+		log.Panic("Recipient must be a single key address")
+	}
+
+	var secret []byte
+	hash, err := hex.DecodeString(secretHash)
+	if err != nil || (secretHash != "" && len(hash) != sha256.Size) {
+		log.Panic("Secret hash is not Valid")
+	}
+	if secretHash == "" {
+		secret = make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			log.Panic(err)
+		}
+		sum := sha256.Sum256(secret)
+		hash = sum[:]
+	}
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w := wallets.GetWallet(from)
+
+	htlc := blockchain.HTLC{SecretHash: hash, Recipient: wallet.AddressHash(to), Refund: wallet.PublicKeyHash(w.PublicKey), LockTime: uint32(lockTime)}
+	contract := blockchain.HTLCLockingScript(htlc)
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	tx := blockchain.NewTransaction(&w, string(blockchain.HTLCAddress(contract)), amount, fee, 0, &UTXOSet)
+	submitTransaction(chain, tx, nodeID, mineNow)
+
+	if secret != nil {
+		fmt.Printf("Secret:        %x (keep it until the swap is done)\n", secret)
+	}
+	fmt.Printf("Secret hash:   %x\n", hash)
+	fmt.Printf("Contract:      %x\n", contract)
+	fmt.Printf("Address:       %s\n", blockchain.HTLCAddress(contract))
+	fmt.Printf("Transaction:   %x\n", tx.ID)
+}
+
+// htlcRedeem spends a hash time-locked contract to the recipient wallet by revealing the secret.
+func (cli *CommandLine) htlcRedeem(contractHex, txID, secretHex string, fee int, nodeID string, mineNow bool) {
+	secret, err := hex.DecodeString(secretHex)
+	if err != nil || len(secret) == 0 {
+		log.Panic("Secret is not Valid")
+	}
+	cli.htlcSpend(contractHex, txID, secret, fee, nodeID, mineNow)
+}
+
+// htlcRefund spends a hash time-locked contract back to the sender once its lock time has passed.
+func (cli *CommandLine) htlcRefund(contractHex, txID string, fee int, nodeID string, mineNow bool) {
+	cli.htlcSpend(contractHex, txID, nil, fee, nodeID, mineNow)
+}
+
+// htlcSpend redeems a hash time-locked contract with the secret, or refunds it without one, using
+// the wallet the chosen branch pays to.
+func (cli *CommandLine) htlcSpend(contractHex, txID string, secret []byte, fee int, nodeID string, mineNow bool) {
+	contract, htlc := parseContract(contractHex)
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	payee := htlc.Recipient
+	if secret == nil {
+		payee = htlc.Refund
+	}
+	w, ok := wallets.FindWallet(payee)
+	if !ok {
+		log.Panic("The contract does not pay to any address in the wallet file")
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	contractTx := findTransaction(chain, txID)
+	tx, err := blockchain.NewHTLCTransaction(w, contract, &contractTx, secret, fee)
+	if err != nil {
+		log.Panic(err)
+	}
+	submitTransaction(chain, tx, nodeID, mineNow)
+
+	fmt.Printf("Spent contract in transaction %x to %s\n", tx.ID, w.Address())
+}
+
+// htlcAudit prints the terms of a hash time-locked contract and the state of the output paying to
+// it, including the secret once the contract has been redeemed.
+func (cli *CommandLine) htlcAudit(contractHex, txID, nodeID string) {
+	contract, htlc := parseContract(contractHex)
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	contractTx := findTransaction(chain, txID)
+	out, ok := blockchain.FindContractOutput(&contractTx, contract)
+	if !ok {
+		log.Panic("Transaction does not pay to the contract")
+	}
+
+	fmt.Printf("Address:       %s\n", blockchain.HTLCAddress(contract))
+	fmt.Printf("Amount:        %d\n", contractTx.Outputs[out].Value)
+	fmt.Printf("Recipient:     %s\n", wallet.HashAddress(htlc.Recipient))
+	fmt.Printf("Refund:        %s\n", wallet.HashAddress(htlc.Refund))
+	fmt.Printf("Secret hash:   %x\n", htlc.SecretHash)
+	fmt.Printf("Lock time:     %d\n", htlc.LockTime)
+
+	if entry, err := UTXOSet.FindOutput(contractTx.ID, out); err == nil {
+		fmt.Printf("Confirmations: %d\n", chain.GetBestHeight()-entry.Height+1)
+		fmt.Println("Status:        unspent")
+		return
+	}
+
+	spender, err := chain.FindSpendingTransaction(contractTx.ID, out)
+	if err != nil {
+		fmt.Printf("Status:        %s\n", err)
+		return
+	}
+	for _, in := range spender.Inputs {
+		if secret, ok := blockchain.ExtractHTLCSecret(in, htlc.SecretHash); ok {
+			fmt.Printf("Status:        redeemed in %x\n", spender.ID)
+			fmt.Printf("Secret:        %x\n", secret)
+			return
+		}
+	}
+	fmt.Printf("Status:        refunded in %x\n", spender.ID)
+}
+
+// parseContract decodes a hex encoded hash time-locked contract.
+func parseContract(contractHex string) ([]byte, blockchain.HTLC) {
+	contract, err := hex.DecodeString(contractHex)
+	if err != nil {
+		log.Panic("Contract is not Valid")
+	}
+	htlc, ok := blockchain.ExtractHTLC(contract)
+	if !ok {
+		log.Panic("Contract is not a hash time-locked contract")
+	}
+
+	return contract, htlc
+}
+
+// findTransaction looks up a transaction of the chain by its hex encoded ID.
+func findTransaction(chain *blockchain.BlockChain, txID string) blockchain.Transaction {
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic("Transaction ID is not Valid")
+	}
+	tx, err := chain.FindTransaction(ID)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	return tx
+}
@@ -0,0 +1,75 @@
+package cli
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"time"
+
+	"github.com/argonautts/golang-blockchain/blockchain"
+	"github.com/argonautts/golang-blockchain/wallet"
+)
+
+// notarize anchors the hash of a file in a null-data output of a transaction paid by an address.
+func (cli *CommandLine) notarize(file, from string, fee int, nodeID string, mineNow bool) {
+	if !wallet.ValidateAddress(from) {
+		log.Panic("Address is not Valid")
+	}
+	docHash := hashFile(file)
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	w := wallets.GetWallet(from)
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	tx := blockchain.NewDataTransaction(&w, blockchain.NotarizationData(docHash), fee, &UTXOSet)
+	submitTransaction(chain, tx, nodeID, mineNow)
+
+	fmt.Printf("Document hash: %x\n", docHash)
+	fmt.Printf("Transaction:   %x\n", tx.ID)
+}
+
+// verifyNotarization checks that a transaction anchors the hash of a file and prints the receipt.
+func (cli *CommandLine) verifyNotarization(file, txID, nodeID string) {
+	docHash := hashFile(file)
+	ID, err := hex.DecodeString(txID)
+	if err != nil {
+		log.Panic("Transaction ID is not Valid")
+	}
+
+	chain := blockchain.ContinueBlockChain(nodeID)
+	defer chain.Database.Close()
+
+	receipt, err := chain.VerifyNotarization(ID, docHash)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Document hash: %x\n", receipt.DocHash)
+	fmt.Printf("Transaction:   %x\n", receipt.TxID)
+	fmt.Printf("Block:         %x\n", receipt.BlockHash)
+	fmt.Printf("Height:        %d\n", receipt.Height)
+	fmt.Printf("Time:          %s\n", time.Unix(receipt.Timestamp, 0).UTC().Format(time.RFC3339))
+	fmt.Printf("Confirmations: %d\n", receipt.Confirmations)
+	fmt.Printf("Merkle root:   %x\n", receipt.MerkleRoot)
+	printMerklePath(receipt.Proof)
+	fmt.Println("Verified!")
+}
+
+// hashFile returns the SHA-256 hash of the content of a file.
+func hashFile(file string) []byte {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Panic(err)
+	}
+	hash := sha256.Sum256(content)
+
+	return hash[:]
+}
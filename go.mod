@@ -5,16 +5,19 @@ go 1.18
 require (
 	github.com/dgraph-io/badger v1.5.4
 	github.com/mr-tron/base58 v1.2.0
+	github.com/stretchr/testify v1.4.0
+	github.com/vrecan/death v3.0.1+incompatible
 	golang.org/x/crypto v0.14.0
 )
 
 require (
 	github.com/AndreasBriese/bbloom v0.0.0-20190825152654-46b345b51c96 // indirect
+	github.com/davecgh/go-spew v1.1.0 // indirect
 	github.com/dgryski/go-farm v0.0.0-20190423205320-6a90982ecee2 // indirect
 	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/pkg/errors v0.8.1 // indirect
-	github.com/stretchr/testify v1.4.0 // indirect
-	github.com/vrecan/death v3.0.1+incompatible // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
 	golang.org/x/net v0.17.0 // indirect
 	golang.org/x/sys v0.13.0 // indirect
+	gopkg.in/yaml.v2 v2.2.2 // indirect
 )
@@ -22,12 +22,16 @@ const (
 	protocol      = "tcp" // Network protocol used
 	version       = 1     // Version of the protocol
 	commandLength = 12    // Length of the command in the protocol
+	maxHeaders    = 2000  // Maximum number of headers sent in one 'headers' message
+	maxFilters    = 2000  // Maximum number of filters sent for one 'getcfilters' message
 )
 
 // Global variables used in the network package.
 var (
 	nodeAddress     string                                    // Address of the current node
 	mineAddress     string                                    // Mining address
+	pruneDepth      int                                       // Blocks kept behind the tip, 0 keeps every block
+	reclaimRequests = make(chan struct{}, 1)                  // Wakes up the reclaiming of pruned space
 	KnownNodes      = []string{"localhost:3000"}              // Initial known nodes
 	blocksInTransit = [][]byte{}                              // Blocks being transmitted
 	memoryPool      = make(map[string]blockchain.Transaction) // Pool of transactions
@@ -46,6 +50,16 @@ type GetBlocks struct {
 	AddrFrom string
 }
 
+type GetHeaders struct {
+	AddrFrom string
+	Locator  [][]byte
+}
+
+type Headers struct {
+	AddrFrom string
+	Headers  [][]byte
+}
+
 type GetData struct {
 	AddrFrom string
 	Type     string
@@ -64,9 +78,10 @@ type Tx struct {
 }
 
 type Version struct {
-	Version    int
-	BestHeight int
-	AddrFrom   string
+	Version     int
+	BestHeight  int
+	AddrFrom    string
+	PruneHeight int
 }
 
 // Utility functions for the network communication
@@ -170,6 +185,27 @@ func SendGetBlocks(address string) {
 	SendData(address, request)
 }
 
+// SendGetHeaders sends 'getheaders' command with a locator of our best header chain.
+func SendGetHeaders(address string, chain *blockchain.BlockChain) {
+	payload := GobEncode(GetHeaders{nodeAddress, chain.BlockLocator()})
+	request := append(CmdToBytes("getheaders"), payload...)
+
+	SendData(address, request)
+}
+
+// SendHeaders sends 'headers' command with serialized block headers.
+func SendHeaders(address string, headers []*blockchain.BlockHeader) {
+	var items [][]byte
+	for _, header := range headers {
+		items = append(items, header.Serialize())
+	}
+
+	payload := GobEncode(Headers{nodeAddress, items})
+	request := append(CmdToBytes("headers"), payload...)
+
+	SendData(address, request)
+}
+
 // SendGetData sends 'getdata' command to a specified address.
 func SendGetData(address, kind string, id []byte) {
 	payload := GobEncode(GetData{nodeAddress, kind, id})
@@ -190,7 +226,7 @@ func SendTx(addr string, tnx *blockchain.Transaction) {
 // SendVersion sends 'version' command to a specified address.
 func SendVersion(addr string, chain *blockchain.BlockChain) {
 	bestHeight := chain.GetBestHeight()
-	payload := GobEncode(Version{version, bestHeight, nodeAddress})
+	payload := GobEncode(Version{version, bestHeight, nodeAddress, chain.PruneHeight()})
 
 	request := append(CmdToBytes("version"), payload...)
 
@@ -228,25 +264,80 @@ func HandleBlock(request []byte, chain *blockchain.BlockChain) {
 		log.Panic(err)
 	}
 
+	// Dropping blocks that are not in the binary encoding rather than crashing on them
 	blockData := payload.Block
-	block := blockchain.Deserialize(blockData)
+	block, err := blockchain.DeserializeBlock(blockData)
+	if err != nil {
+		fmt.Printf("Dropped block from %s: %s\n", payload.AddrFrom, err)
+		return
+	}
 
 	fmt.Println("Recevied a new block!")
-	chain.AddBlock(block)
-
-	fmt.Printf("Added Block %x\n", block.Hash)
+	change, err := chain.AddBlock(block)
+	if err != nil {
+		fmt.Printf("Rejected Block %x: %s\n", block.Hash, err)
+	} else {
+		UpdateMemoryPool(change)
+		fmt.Printf("Added Block %x\n", block.Hash)
+		if len(change.Connected) > 0 {
+			PruneBlocks(chain)
+		}
+	}
 
 	if len(blocksInTransit) > 0 {
 		blockHash := blocksInTransit[0]
 		SendGetData(payload.AddrFrom, "block", blockHash)
 
 		blocksInTransit = blocksInTransit[1:]
-	} else {
-		UTXOSet := blockchain.UTXOSet{chain}
-		UTXOSet.Reindex()
 	}
 }
 
+// UpdateMemoryPool keeps the memory pool in line with the best chain after it has moved.
+func UpdateMemoryPool(change blockchain.TipChange) {
+	// Returning transactions of disconnected blocks to the pool
+	for _, block := range change.Disconnected {
+		for _, tx := range block.Transactions {
+			if !tx.IsCoinbase() {
+				memoryPool[hex.EncodeToString(tx.ID)] = *tx
+			}
+		}
+	}
+
+	// Dropping transactions confirmed by the new best chain
+	for _, block := range change.Connected {
+		for _, tx := range block.Transactions {
+			delete(memoryPool, hex.EncodeToString(tx.ID))
+		}
+	}
+}
+
+// mergeBlocksInTransit queues blocks for download after the ones already queued, once each.
+func mergeBlocksInTransit(hashes [][]byte) {
+	for _, hash := range hashes {
+		queued := false
+		for _, b := range blocksInTransit {
+			if bytes.Equal(b, hash) {
+				queued = true
+				break
+			}
+		}
+		if !queued {
+			blocksInTransit = append(blocksInTransit, hash)
+		}
+	}
+}
+
+// removeBlockInTransit takes a requested block out of the download queue.
+func removeBlockInTransit(hash []byte) {
+	newInTransit := [][]byte{}
+	for _, b := range blocksInTransit {
+		if bytes.Compare(b, hash) != 0 {
+			newInTransit = append(newInTransit, b)
+		}
+	}
+	blocksInTransit = newInTransit
+}
+
 // HandleInv handles 'inv' (inventory) command by processing the inventory of blocks or transactions received from another node.
 func HandleInv(request []byte, chain *blockchain.BlockChain) {
 	var buff bytes.Buffer
@@ -265,19 +356,11 @@ func HandleInv(request []byte, chain *blockchain.BlockChain) {
 
 	// Handling block type inventory
 	if payload.Type == "block" {
-		blocksInTransit = payload.Items
+		mergeBlocksInTransit(payload.Items)
 
 		blockHash := payload.Items[0]
 		SendGetData(payload.AddrFrom, "block", blockHash)
-
-		// Filtering out the requested block from blocksInTransit
-		newInTransit := [][]byte{}
-		for _, b := range blocksInTransit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
-			}
-		}
-		blocksInTransit = newInTransit
+		removeBlockInTransit(blockHash)
 	}
 
 	// Handling transaction type inventory
@@ -309,6 +392,69 @@ func HandleGetBlocks(request []byte, chain *blockchain.BlockChain) {
 	SendInv(payload.AddrFrom, "block", blocks)
 }
 
+// HandleGetHeaders handles 'getheaders' command by sending the headers following the fork point with the requester.
+func HandleGetHeaders(request []byte, chain *blockchain.BlockChain) {
+	var buff bytes.Buffer
+	var payload GetHeaders
+
+	// Decoding the payload from the request
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	headers := chain.FindHeaders(payload.Locator, maxHeaders)
+	SendHeaders(payload.AddrFrom, headers)
+}
+
+// HandleHeaders handles 'headers' command by validating the received header chain and then
+// requesting the bodies of the blocks that are still missing.
+func HandleHeaders(request []byte, chain *blockchain.BlockChain) {
+	var buff bytes.Buffer
+	var payload Headers
+
+	// Decoding the payload from the request
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	fmt.Printf("Recevied %d headers\n", len(payload.Headers))
+
+	var headers []*blockchain.BlockHeader
+	for _, data := range payload.Headers {
+		header, err := blockchain.DeserializeHeader(data)
+		if err != nil {
+			fmt.Printf("Rejected headers: %s\n", err)
+			return
+		}
+		headers = append(headers, header)
+	}
+
+	if err := chain.AddHeaders(headers); err != nil {
+		fmt.Printf("Rejected headers: %s\n", err)
+		return
+	}
+
+	// Asking for more headers until the peer has sent all of them
+	if len(headers) == maxHeaders {
+		SendGetHeaders(payload.AddrFrom, chain)
+		return
+	}
+
+	// Downloading the bodies of the validated headers in chain order
+	missing := chain.MissingBlocks()
+	if len(missing) > 0 {
+		mergeBlocksInTransit(missing)
+		SendGetData(payload.AddrFrom, "block", missing[0])
+		removeBlockInTransit(missing[0])
+	}
+}
+
 // HandleGetData handles 'getdata' command by sending requested block or transaction data to the requester.
 func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 	var buff bytes.Buffer
@@ -324,6 +470,10 @@ func HandleGetData(request []byte, chain *blockchain.BlockChain) {
 
 	// Sending the requested block
 	if payload.Type == "block" {
+		if chain.IsPruned(payload.ID) {
+			fmt.Printf("Refusing pruned block %x\n", payload.ID)
+			return
+		}
 		block, err := chain.GetBlock([]byte(payload.ID))
 		if err != nil {
 			return
@@ -354,10 +504,18 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 		log.Panic(err)
 	}
 
-	// Adding the transaction to the memory pool
+	// Adding the transaction to the memory pool if it is valid
 	txData := payload.Transaction
-	tx := blockchain.DeserializeTransaction(txData)
-	memoryPool[hex.EncodeToString(tx.ID)] = tx
+	tx, err := blockchain.DeserializeTx(txData)
+	if err != nil {
+		fmt.Printf("Dropped transaction from %s: %s\n", payload.AddrFrom, err)
+		return
+	}
+	if err := chain.ValidateTransaction(tx); err != nil {
+		fmt.Printf("Rejected transaction %x: %s\n", tx.ID, err)
+		return
+	}
+	memoryPool[hex.EncodeToString(tx.ID)] = *tx
 
 	fmt.Printf("%s, %d", nodeAddress, len(memoryPool))
 
@@ -377,14 +535,36 @@ func HandleTx(request []byte, chain *blockchain.BlockChain) {
 // MineTx mines a new block with transactions from the memory pool
 func MineTx(chain *blockchain.BlockChain) {
 	var txs []*blockchain.Transaction
+	spent := make(map[string]bool) // Outputs spent by the collected transactions
+	fees := 0                      // Fees left by the collected transactions
 
 	// Verifying and collecting valid transactions
 	for id := range memoryPool {
 		fmt.Printf("tx: %s\n", memoryPool[id].ID)
 		tx := memoryPool[id]
-		if chain.VerifyTransaction(&tx) {
-			txs = append(txs, &tx)
+		fee, err := chain.TransactionFee(&tx)
+		if err != nil {
+			fmt.Printf("Dropping transaction %x: %s\n", tx.ID, err)
+			delete(memoryPool, id)
+			continue
+		}
+
+		// Leaving transactions that conflict with a collected one for a later block
+		conflict := false
+		for _, in := range tx.Inputs {
+			if spent[fmt.Sprintf("%x:%d", in.ID, in.Out)] {
+				conflict = true
+			}
+		}
+		if conflict {
+			continue
 		}
+		for _, in := range tx.Inputs {
+			spent[fmt.Sprintf("%x:%d", in.ID, in.Out)] = true
+		}
+
+		txs = append(txs, &tx)
+		fees += fee
 	}
 
 	if len(txs) == 0 {
@@ -392,14 +572,15 @@ func MineTx(chain *blockchain.BlockChain) {
 		return
 	}
 
-	cbTx := blockchain.CoinbaseTx(mineAddress, "")
-	txs = append(txs, cbTx)
+	// The coinbase transaction always comes first in a block and claims the subsidy and the fees
+	reward := blockchain.BlockSubsidy(chain.GetBestHeight()+1) + fees
+	cbTx := blockchain.CoinbaseTx(mineAddress, "", reward)
+	txs = append([]*blockchain.Transaction{cbTx}, txs...)
 
 	newBlock := chain.MineBlock(txs)
-	UTXOSet := blockchain.UTXOSet{chain}
-	UTXOSet.Reindex()
 
 	fmt.Println("A new block has been mined")
+	PruneBlocks(chain)
 
 	for _, tx := range txs {
 		txID := hex.EncodeToString(tx.ID)
@@ -434,9 +615,11 @@ func HandleVersion(request []byte, chain *blockchain.BlockChain) {
 	bestHeight := chain.GetBestHeight()
 	otherHeight := payload.BestHeight
 
-	// Requesting blocks from a node with a higher blockchain
-	if bestHeight < otherHeight {
-		SendGetBlocks(payload.AddrFrom)
+	// Requesting headers from a node with a higher blockchain, unless it has pruned the blocks we miss
+	if bestHeight < otherHeight && payload.PruneHeight > bestHeight+1 {
+		fmt.Printf("Peer %s is pruned and cannot serve blocks below height %d\n", payload.AddrFrom, payload.PruneHeight)
+	} else if bestHeight < otherHeight {
+		SendGetHeaders(payload.AddrFrom, chain)
 	} else if bestHeight > otherHeight {
 		// Sending version to a node with a lower blockchain
 		SendVersion(payload.AddrFrom, chain)
@@ -470,22 +653,32 @@ func HandleConnection(conn net.Conn, chain *blockchain.BlockChain) {
 		HandleInv(req, chain)
 	case "getblocks":
 		HandleGetBlocks(req, chain)
+	case "getheaders":
+		HandleGetHeaders(req, chain)
+	case "headers":
+		HandleHeaders(req, chain)
 	case "getdata":
 		HandleGetData(req, chain)
 	case "tx":
 		HandleTx(req, chain)
 	case "version":
 		HandleVersion(req, chain)
+	case "getproofs":
+		HandleGetProofs(req, chain)
+	case "getcfilters":
+		HandleGetCFilters(req, chain)
 	default:
 		fmt.Println("Unknown command")
 	}
 
 }
 
-// StartServer initializes a server for the blockchain node.
-func StartServer(nodeID, minerAddress string) {
+// StartServer initializes a server for the blockchain node. A positive prune depth deletes the
+// bodies of the blocks further behind the tip.
+func StartServer(nodeID, minerAddress string, prune int) {
 	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
 	mineAddress = minerAddress
+	pruneDepth = prune
 	ln, err := net.Listen(protocol, nodeAddress)
 	if err != nil {
 		log.Panic(err)
@@ -496,6 +689,13 @@ func StartServer(nodeID, minerAddress string) {
 	chain := blockchain.ContinueBlockChain(nodeID)
 	defer chain.Database.Close()
 	go CloseDB(chain)
+	if pruneDepth != 0 {
+		go ReclaimSpace(chain)
+	}
+	PruneBlocks(chain)
+	if chain.PruneHeight() > 0 {
+		requestReclaim() // Records pruned before the restart have been compacted away
+	}
 
 	// Syncs with the main node if not the main node itself
 	if nodeAddress != KnownNodes[0] {
@@ -513,6 +713,45 @@ func StartServer(nodeID, minerAddress string) {
 	}
 }
 
+// PruneBlocks deletes the bodies of the blocks further than the prune depth behind the tip on a
+// pruning node.
+func PruneBlocks(chain *blockchain.BlockChain) {
+	if pruneDepth == 0 {
+		return
+	}
+
+	count, err := chain.Prune(pruneDepth)
+	if err != nil {
+		fmt.Printf("Pruning failed: %s\n", err)
+		return
+	}
+	if count > 0 {
+		fmt.Printf("Pruned %d blocks, keeping blocks from height %d\n", count, chain.PruneHeight())
+		requestReclaim()
+	}
+}
+
+// requestReclaim asks ReclaimSpace for a pass, unless one is already waiting.
+func requestReclaim() {
+	select {
+	case reclaimRequests <- struct{}{}:
+	default:
+	}
+}
+
+// ReclaimSpace gives back the space of pruned blocks in the background, one pass after each
+// pruning that deleted blocks, so block processing does not wait for the value log GC.
+func ReclaimSpace(chain *blockchain.BlockChain) {
+	for range reclaimRequests {
+		files, err := chain.ReclaimSpace()
+		if err != nil {
+			fmt.Printf("Reclaiming pruned space failed: %s\n", err)
+		} else if files > 0 {
+			fmt.Printf("Reclaimed space of %d value log files\n", files)
+		}
+	}
+}
+
 // GobEncode encodes data into bytes using GOB encoding.
 func GobEncode(data interface{}) []byte {
 	var buff bytes.Buffer
@@ -0,0 +1,405 @@
+package network
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+
+	"github.com/argonautts/golang-blockchain/blockchain"
+	"github.com/argonautts/golang-blockchain/wallet"
+	"github.com/vrecan/death"
+)
+
+// A light client only keeps headers. It asks a full node for the proofs of the transactions
+// touching its addresses and checks them against its own header chain. It also fetches the compact
+// filters of new blocks to find the blocks touching its addresses without revealing them.
+
+var (
+	spvAddresses []string                // Wallet addresses watched by a light client
+	prunedPeers  = make(map[string]bool) // Peers that pruned the blocks proofs are built from
+)
+
+type GetProofs struct {
+	AddrFrom     string
+	PubKeyHashes [][]byte
+}
+
+type Proofs struct {
+	AddrFrom string
+	Proofs   [][]byte
+}
+
+type GetCFilters struct {
+	AddrFrom    string
+	StartHeight int
+	StopHash    []byte
+}
+
+type CFilter struct {
+	AddrFrom   string
+	BlockHash  []byte
+	Filter     []byte
+	PrevHeader []byte
+	Header     []byte
+}
+
+// SendGetProofs asks a full node for the proofs of the transactions touching the watched addresses.
+func SendGetProofs(address string) {
+	var pubKeyHashes [][]byte
+	for _, addr := range spvAddresses {
+		pubKeyHashes = append(pubKeyHashes, wallet.AddressHash(addr))
+	}
+
+	payload := GobEncode(GetProofs{nodeAddress, pubKeyHashes})
+	request := append(CmdToBytes("getproofs"), payload...)
+
+	SendData(address, request)
+}
+
+// SendProofs sends transaction proofs in their binary encoding.
+func SendProofs(address string, proofs []*blockchain.TxProof) {
+	var items [][]byte
+	for _, proof := range proofs {
+		items = append(items, proof.Serialize())
+	}
+
+	payload := GobEncode(Proofs{nodeAddress, items})
+	request := append(CmdToBytes("proofs"), payload...)
+
+	SendData(address, request)
+}
+
+// SendGetCFilters asks a full node for the compact filters of the best chain blocks from a height
+// up to the block with the stop hash.
+func SendGetCFilters(address string, startHeight int, stopHash []byte) {
+	payload := GobEncode(GetCFilters{nodeAddress, startHeight, stopHash})
+	request := append(CmdToBytes("getcfilters"), payload...)
+
+	SendData(address, request)
+}
+
+// SendCFilter sends the compact filter of a block with its filter headers.
+func SendCFilter(address string, filter *blockchain.BlockFilter) {
+	payload := GobEncode(CFilter{nodeAddress, filter.BlockHash, filter.Filter, filter.PrevHeader, filter.Header})
+	request := append(CmdToBytes("cfilter"), payload...)
+
+	SendData(address, request)
+}
+
+// SendSPVVersion sends 'version' command with the height of the header chain of a light client.
+func SendSPVVersion(addr string, headers *blockchain.HeaderChain) {
+	payload := GobEncode(Version{version, headers.BestHeight(), nodeAddress, 0})
+	request := append(CmdToBytes("version"), payload...)
+
+	SendData(addr, request)
+}
+
+// SendSPVGetHeaders sends 'getheaders' command with a locator of the header chain of a light client.
+func SendSPVGetHeaders(address string, headers *blockchain.HeaderChain) {
+	payload := GobEncode(GetHeaders{nodeAddress, headers.BlockLocator()})
+	request := append(CmdToBytes("getheaders"), payload...)
+
+	SendData(address, request)
+}
+
+// HandleGetProofs handles 'getproofs' command on a full node by sending the proofs of every
+// transaction of the best chain touching the requested public key hashes. A pruning node refuses
+// the request rather than sending incomplete proofs.
+func HandleGetProofs(request []byte, chain *blockchain.BlockChain) {
+	var buff bytes.Buffer
+	var payload GetProofs
+
+	// Decoding the payload from the request
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	proofs, err := chain.FindTransactionProofs(payload.PubKeyHashes)
+	if err != nil {
+		fmt.Printf("Refused getproofs from %s: %s\n", payload.AddrFrom, err)
+		return
+	}
+	SendProofs(payload.AddrFrom, proofs)
+}
+
+// HandleGetCFilters handles 'getcfilters' command on a full node by sending one 'cfilter' message
+// per requested block of the best chain.
+func HandleGetCFilters(request []byte, chain *blockchain.BlockChain) {
+	var buff bytes.Buffer
+	var payload GetCFilters
+
+	// Decoding the payload from the request
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	filters, err := chain.FindBlockFilters(payload.StartHeight, payload.StopHash, maxFilters)
+	if err != nil {
+		fmt.Printf("Dropped filter request from %s: %s\n", payload.AddrFrom, err)
+		return
+	}
+	for _, filter := range filters {
+		SendCFilter(payload.AddrFrom, filter)
+	}
+}
+
+// HandleSPVVersion handles 'version' command on a light client by remembering the peers that
+// pruned their blocks, as they cannot prove the older transactions.
+func HandleSPVVersion(request []byte) {
+	var buff bytes.Buffer
+	var payload Version
+
+	// Decoding the payload from the request
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if payload.PruneHeight > 0 {
+		fmt.Printf("Peer %s is pruned and cannot serve proofs\n", payload.AddrFrom)
+		prunedPeers[payload.AddrFrom] = true
+	}
+}
+
+// HandleSPVHeaders handles 'headers' command on a light client by validating the headers, asking
+// for their compact filters and then for the proofs of its transactions once the header chain has
+// caught up.
+func HandleSPVHeaders(request []byte, headers *blockchain.HeaderChain) {
+	var buff bytes.Buffer
+	var payload Headers
+
+	// Decoding the payload from the request
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var received []*blockchain.BlockHeader
+	for _, data := range payload.Headers {
+		header, err := blockchain.DeserializeHeader(data)
+		if err != nil {
+			fmt.Printf("Rejected headers: %s\n", err)
+			return
+		}
+		received = append(received, header)
+	}
+
+	if err := headers.AddHeaders(received); err != nil {
+		fmt.Printf("Rejected headers: %s\n", err)
+		return
+	}
+	fmt.Printf("Header chain is at height %d\n", headers.BestHeight())
+
+	// Matching the filters of the new blocks locally
+	if len(received) > 0 {
+		start := headers.BestHeight() - len(received) + 1
+		SendGetCFilters(payload.AddrFrom, start, received[len(received)-1].Hash())
+	}
+
+	// Asking for more headers until the peer has sent all of them
+	if len(received) == maxHeaders {
+		SendSPVGetHeaders(payload.AddrFrom, headers)
+		return
+	}
+
+	// Proofs are only asked from peers that keep every block
+	if prunedPeers[payload.AddrFrom] {
+		fmt.Printf("Not asking pruned peer %s for proofs\n", payload.AddrFrom)
+		return
+	}
+	SendGetProofs(payload.AddrFrom)
+}
+
+// HandleSPVInv handles 'inv' command on a light client by following new blocks through their
+// headers. Transactions are only learnt about once they are in a block.
+func HandleSPVInv(request []byte, headers *blockchain.HeaderChain) {
+	var buff bytes.Buffer
+	var payload Inv
+
+	// Decoding the payload from the request
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	if payload.Type == "block" {
+		SendSPVGetHeaders(payload.AddrFrom, headers)
+	}
+}
+
+// HandleProofs handles 'proofs' command on a light client by checking every proof against the
+// header chain and reporting the verified balance of each watched address.
+func HandleProofs(request []byte, headers *blockchain.HeaderChain) {
+	var buff bytes.Buffer
+	var payload Proofs
+
+	// Decoding the payload from the request
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	var proofs []*blockchain.TxProof
+	var confirmations []int
+	for _, data := range payload.Proofs {
+		proof, err := blockchain.DeserializeTxProof(data)
+		if err != nil {
+			fmt.Printf("Rejected proof: %s\n", err)
+			continue
+		}
+		confs, err := headers.VerifyProof(proof)
+		if err != nil {
+			fmt.Printf("Rejected proof of %x: %s\n", proof.Transaction.ID, err)
+			continue
+		}
+		proofs = append(proofs, proof)
+		confirmations = append(confirmations, confs)
+	}
+
+	fmt.Printf("Verified balances at height %d:\n", headers.BestHeight())
+	for _, address := range spvAddresses {
+		outputs := blockchain.SPVUnspentOutputs(proofs, confirmations, wallet.AddressHash(address))
+
+		balance := 0
+		for _, out := range outputs {
+			balance += out.Value
+		}
+		fmt.Printf("%s: %d\n", address, balance)
+		for _, out := range outputs {
+			fmt.Printf("  %x:%d %d (%d confirmations)\n", out.TxID, out.Index, out.Value, out.Confirmations)
+		}
+	}
+}
+
+// HandleCFilter handles 'cfilter' command on a light client by checking the filter against the
+// header chain and reporting whether the block may touch a watched address.
+func HandleCFilter(request []byte, headers *blockchain.HeaderChain) {
+	var buff bytes.Buffer
+	var payload CFilter
+
+	// Decoding the payload from the request
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	filter := &blockchain.BlockFilter{
+		BlockHash:  payload.BlockHash,
+		Filter:     payload.Filter,
+		PrevHeader: payload.PrevHeader,
+		Header:     payload.Header,
+	}
+	if err := headers.AddFilter(filter); err != nil {
+		fmt.Printf("Rejected filter of %x: %s\n", filter.BlockHash, err)
+		return
+	}
+
+	var items [][]byte
+	for _, address := range spvAddresses {
+		items = append(items, wallet.AddressHash(address))
+	}
+	match, err := filter.Match(items)
+	if err != nil {
+		fmt.Printf("Rejected filter of %x: %s\n", filter.BlockHash, err)
+		return
+	}
+	if match {
+		fmt.Printf("Block %x may touch a watched address\n", filter.BlockHash)
+	}
+}
+
+// HandleSPVConnection routes the commands a light client understands to their handlers.
+func HandleSPVConnection(conn net.Conn, headers *blockchain.HeaderChain) {
+	req, err := ioutil.ReadAll(conn)
+	defer conn.Close()
+
+	if err != nil {
+		log.Panic(err)
+	}
+
+	command := BytesToCmd(req[:commandLength])
+	fmt.Printf("Received %s command\n", command)
+
+	switch command {
+	case "headers":
+		HandleSPVHeaders(req, headers)
+	case "inv":
+		HandleSPVInv(req, headers)
+	case "proofs":
+		HandleProofs(req, headers)
+	case "cfilter":
+		HandleCFilter(req, headers)
+	case "version":
+		HandleSPVVersion(req)
+	case "addr":
+		// Peers are only asked for headers and proofs
+	default:
+		fmt.Println("Unknown command")
+	}
+}
+
+// StartSPVNode starts a light client that follows the headers of the first known node and reports
+// the verified balances of the addresses in the wallet file of the node.
+func StartSPVNode(nodeID string) {
+	nodeAddress = fmt.Sprintf("localhost:%s", nodeID)
+	ln, err := net.Listen(protocol, nodeAddress)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer ln.Close()
+
+	wallets, err := wallet.CreateWallets(nodeID)
+	if err != nil {
+		log.Panic(err)
+	}
+	spvAddresses = wallets.GetAllAddresses()
+
+	headers := blockchain.OpenHeaderChain(nodeID)
+	defer headers.Database.Close()
+	go CloseHeaderDB(headers)
+
+	// Announcing ourselves so new blocks are announced to us, then catching up
+	SendSPVVersion(KnownNodes[0], headers)
+	SendSPVGetHeaders(KnownNodes[0], headers)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Panic(err)
+		}
+		go HandleSPVConnection(conn, headers)
+	}
+}
+
+// CloseHeaderDB gracefully closes the header database of a light client on termination signals.
+func CloseHeaderDB(headers *blockchain.HeaderChain) {
+	d := death.NewDeath(syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+
+	d.WaitForDeathWithFunc(func() {
+		defer os.Exit(1)
+		defer runtime.Goexit()
+		headers.Database.Close()
+	})
+}
@@ -0,0 +1,93 @@
+package wallet
+
+import "errors"
+
+const (
+	multisigVersion = byte(0x01) // Version byte of multisignature addresses
+	MaxMultisigKeys = 15         // Largest number of public keys in a multisignature policy
+)
+
+// MultisigPolicy encodes an M-of-N multisignature policy: the number of required signatures,
+// the number of keys, then every public key prefixed by its length.
+func MultisigPolicy(required int, pubKeys [][]byte) []byte {
+	policy := []byte{byte(required), byte(len(pubKeys))}
+	for _, pubKey := range pubKeys {
+		policy = append(policy, byte(len(pubKey)))
+		policy = append(policy, pubKey...)
+	}
+
+	return policy
+}
+
+// ParseMultisigPolicy decodes a multisignature policy into the number of required signatures
+// and the public keys.
+func ParseMultisigPolicy(policy []byte) (int, [][]byte, error) {
+	if len(policy) < 2 {
+		return 0, nil, errors.New("multisig policy is too short")
+	}
+	required, count := int(policy[0]), int(policy[1])
+	if required < 1 || required > count || count > MaxMultisigKeys {
+		return 0, nil, errors.New("multisig policy must require between 1 and all of at most 15 keys")
+	}
+
+	var pubKeys [][]byte
+	rest := policy[2:]
+	for i := 0; i < count; i++ {
+		if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+			return 0, nil, errors.New("multisig policy is truncated")
+		}
+		pubKeys = append(pubKeys, append([]byte{}, rest[1:1+int(rest[0])]...))
+		rest = rest[1+int(rest[0]):]
+	}
+	if len(rest) != 0 {
+		return 0, nil, errors.New("multisig policy has trailing bytes")
+	}
+
+	return required, pubKeys, nil
+}
+
+// MultisigAddress generates the address of outputs that need the given number of signatures
+// from the given public keys to be spent.
+func MultisigAddress(required int, pubKeys [][]byte) ([]byte, error) {
+	policy := MultisigPolicy(required, pubKeys)
+	if _, _, err := ParseMultisigPolicy(policy); err != nil {
+		return nil, err
+	}
+
+	versionedPolicy := append([]byte{multisigVersion}, policy...) // Appending version byte to the policy
+	checksum := Checksum(versionedPolicy)                         // Generating checksum for the versioned policy
+
+	return Base58Encode(append(versionedPolicy, checksum...)), nil
+}
+
+// ParseMultisigAddress returns the number of required signatures and the public keys of a
+// multisignature address.
+func ParseMultisigAddress(address string) (int, [][]byte, error) {
+	if !ValidateAddress(address) || !IsMultisigAddress(address) {
+		return 0, nil, errors.New("not a valid multisig address")
+	}
+	decoded := Base58Decode([]byte(address))
+
+	return ParseMultisigPolicy(decoded[1 : len(decoded)-checksumLength])
+}
+
+// IsMultisigAddress checks whether an address locks outputs to a multisignature policy.
+func IsMultisigAddress(address string) bool {
+	decoded := Base58Decode([]byte(address))
+
+	return len(decoded) > 0 && decoded[0] == multisigVersion
+}
+
+// AddressHash returns the hash outputs paid to an address are locked with: the public key hash
+// for a single key address, the hash of the policy for a multisignature address and the hash of
+// the redeem script for a pay-to-script-hash address.
+func AddressHash(address string) []byte {
+	decoded := Base58Decode([]byte(address))
+	payload := decoded[1 : len(decoded)-checksumLength] // Removing the version and checksum
+
+	if decoded[0] == multisigVersion {
+		return PublicKeyHash(payload)
+	}
+
+	return payload
+}
@@ -0,0 +1,19 @@
+package wallet
+
+const scriptHashVersion = byte(0x05) // Version byte of pay-to-script-hash addresses
+
+// ScriptHashAddress generates the address of outputs locked to the hash of a redeem script. The
+// script itself is only revealed by whoever spends the outputs.
+func ScriptHashAddress(redeemScript []byte) []byte {
+	versionedHash := append([]byte{scriptHashVersion}, PublicKeyHash(redeemScript)...) // Appending version byte to the script hash
+	checksum := Checksum(versionedHash)                                                // Generating checksum for the versioned hash
+
+	return Base58Encode(append(versionedHash, checksum...))
+}
+
+// IsScriptHashAddress checks whether an address locks outputs to the hash of a redeem script.
+func IsScriptHashAddress(address string) bool {
+	decoded := Base58Decode([]byte(address))
+
+	return len(decoded) > 0 && decoded[0] == scriptHashVersion
+}
@@ -10,6 +10,7 @@ import (
 	"crypto/sha256"
 	"log"
 
+	"github.com/mr-tron/base58"
 	"golang.org/x/crypto/ripemd160"
 )
 
@@ -37,6 +38,14 @@ func (w Wallet) Address() []byte {
 	return address
 }
 
+// HashAddress generates the single key address of a public key hash.
+func HashAddress(pubKeyHash []byte) []byte {
+	versionedHash := append([]byte{version}, pubKeyHash...) // Appending version byte to the public hash
+	checksum := Checksum(versionedHash)                     // Generating checksum for the versioned hash
+
+	return Base58Encode(append(versionedHash, checksum...))
+}
+
 // NewKeyPair generates a new ECDSA private and public key pair.
 func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 	curve := elliptic.P256() // Using P256 elliptic curve for generating the key
@@ -46,10 +55,19 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 		log.Panic(err)
 	}
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...) // Appending X and Y coordinates of the public key
+	pub := EncodePublicKey(private.PublicKey) // Appending X and Y coordinates of the public key
 	return *private, pub
 }
 
+// EncodePublicKey encodes a public key as its X and Y coordinates, each padded to 32 bytes.
+func EncodePublicKey(pub ecdsa.PublicKey) []byte {
+	encoded := make([]byte, 64)
+	pub.X.FillBytes(encoded[:32])
+	pub.Y.FillBytes(encoded[32:])
+
+	return encoded
+}
+
 // MakeWallet creates a new Wallet with a generated key pair.
 func MakeWallet() *Wallet {
 	private, public := NewKeyPair()
@@ -83,11 +101,26 @@ func Checksum(payload []byte) []byte {
 
 // ValidateAddress checks if the provided address is valid.
 func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))                        // Decoding the address from Base58
-	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]      // Extracting checksum from the address
-	version := pubKeyHash[0]                                           // Extracting version byte
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]        // Extracting public key hash
-	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...)) // Generating target checksum for comparison
+	pubKeyHash, err := base58.Decode(address) // Decoding the address from Base58
+	if err != nil || len(pubKeyHash) <= 1+checksumLength {
+		return false
+	}
+	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]          // Extracting checksum from the address
+	addrVersion := pubKeyHash[0]                                           // Extracting version byte
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]            // Extracting public key hash
+	targetChecksum := Checksum(append([]byte{addrVersion}, pubKeyHash...)) // Generating target checksum for comparison
+	if bytes.Compare(actualChecksum, targetChecksum) != 0 {
+		return false
+	}
 
-	return bytes.Compare(actualChecksum, targetChecksum) == 0 // Comparing actual checksum with target checksum
+	// Checking the payload matches the kind of address
+	switch addrVersion {
+	case version, scriptHashVersion:
+		return len(pubKeyHash) == ripemd160.Size
+	case multisigVersion:
+		_, _, err := ParseMultisigPolicy(pubKeyHash)
+		return err == nil
+	default:
+		return false
+	}
 }
@@ -0,0 +1,50 @@
+package wallet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// leadingZeroWallet makes a wallet whose X coordinate starts with a zero byte.
+func leadingZeroWallet() *Wallet {
+	for {
+		w := MakeWallet()
+		if w.PrivateKey.PublicKey.X.BitLen() <= 248 {
+			return w
+		}
+	}
+}
+
+func TestEncodePublicKeyPadsCoordinates(t *testing.T) {
+	w := leadingZeroWallet()
+	assert.Len(t, w.PublicKey, 64)
+	assert.Equal(t, byte(0), w.PublicKey[0])
+	assert.Equal(t, w.PrivateKey.PublicKey.X.Bytes(), w.PublicKey[1:32])
+	assert.Equal(t, w.PrivateKey.PublicKey.Y.FillBytes(make([]byte, 32)), w.PublicKey[32:])
+}
+
+func TestMigrateShortKeys(t *testing.T) {
+	// The short wallet is stored the way older versions encoded its key
+	short, padded := leadingZeroWallet(), MakeWallet()
+	pub := short.PrivateKey.PublicKey
+	stored := &Wallet{short.PrivateKey, append(pub.X.Bytes(), pub.Y.Bytes()...)}
+	oldAddress := string(stored.Address())
+	assert.NotEqual(t, string(short.Address()), oldAddress)
+	ws := Wallets{map[string]*Wallet{oldAddress: stored, string(padded.Address()): padded}}
+
+	migrated, err := ws.migrateKeys()
+	assert.NoError(t, err)
+	assert.True(t, migrated)
+	assert.ElementsMatch(t, []string{string(short.Address()), string(padded.Address())}, ws.GetAllAddresses())
+	assert.Equal(t, short.PublicKey, ws.GetWallet(string(short.Address())).PublicKey)
+
+	migrated, err = ws.migrateKeys()
+	assert.NoError(t, err)
+	assert.False(t, migrated, "Padded keys are kept")
+
+	// A key that does not belong to the private key is refused
+	ws = Wallets{map[string]*Wallet{oldAddress: {short.PrivateKey, padded.PublicKey}}}
+	_, err = ws.migrateKeys()
+	assert.Error(t, err)
+}
@@ -55,6 +55,17 @@ func (ws Wallets) GetWallet(address string) Wallet {
 	return *ws.Wallets[address]
 }
 
+// FindWallet retrieves the wallet whose public key hashes to the given hash.
+func (ws Wallets) FindWallet(pubKeyHash []byte) (*Wallet, bool) {
+	for _, w := range ws.Wallets {
+		if bytes.Equal(PublicKeyHash(w.PublicKey), pubKeyHash) {
+			return w, true
+		}
+	}
+
+	return nil, false
+}
+
 // LoadFile loads wallets from a file.
 func (ws *Wallets) LoadFile(nodeId string) error {
 	walletFile := fmt.Sprintf(walletFile, nodeId)
@@ -78,9 +89,44 @@ func (ws *Wallets) LoadFile(nodeId string) error {
 
 	ws.Wallets = wallets.Wallets
 
+	// Wallets created before keys were padded keep their unpadded key, which no signature can be
+	// checked against. They get the padded key and, with it, a new address.
+	migrated, err := ws.migrateKeys()
+	if err != nil {
+		return err
+	}
+	if migrated {
+		ws.SaveFile(nodeId)
+	}
+
 	return nil
 }
 
+// migrateKeys replaces the unpadded public keys of older wallets with their padded encoding and
+// moves those wallets to their new address. Keys not matching their private key are refused.
+func (ws *Wallets) migrateKeys() (bool, error) {
+	migrated := false
+	for address, w := range ws.Wallets {
+		encoded := EncodePublicKey(w.PrivateKey.PublicKey)
+		if bytes.Equal(w.PublicKey, encoded) {
+			continue
+		}
+
+		raw := append(w.PrivateKey.PublicKey.X.Bytes(), w.PrivateKey.PublicKey.Y.Bytes()...)
+		if !bytes.Equal(w.PublicKey, raw) {
+			return false, fmt.Errorf("Wallet %s has a public key not matching its private key", address)
+		}
+
+		w.PublicKey = encoded
+		delete(ws.Wallets, address)
+		ws.Wallets[string(w.Address())] = w
+		fmt.Printf("Wallet %s has a short public key, its address is now %s. Coins sent to the old address cannot be spent.\n", address, w.Address())
+		migrated = true
+	}
+
+	return migrated, nil
+}
+
 // SaveFile saves the collection of wallets to a file.
 func (ws *Wallets) SaveFile(nodeId string) {
 	var content bytes.Buffer